@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"pg-migration/pkg/config"
+	"pg-migration/pkg/largeobject"
+	"pg-migration/pkg/preflight"
 	"pg-migration/pkg/replication"
 	"pg-migration/pkg/schema"
+	"pg-migration/pkg/state"
 )
 
 func main() {
@@ -36,9 +46,75 @@ func main() {
 	schemaFile := flag.String("schema-file", "", "File path for schema dump or restore (optional)")
 	setupReplication := flag.Bool("setup-replication", false, "Setup logical replication after migration")
 	fullMigration := flag.Bool("full-migration", false, "Perform complete migration (schema dump, restore, and replication setup)")
+	runPreflight := flag.Bool("preflight", false, "Run compatibility checks against the source, target and local client tools")
+	skipPreflight := flag.Bool("skip-preflight", false, "Skip the preflight checks that run before a full migration")
+	checkReplicaIdentity := flag.Bool("check-replica-identity", false, "List source tables without a primary key or replica identity")
+	migrationID := flag.String("migration-id", "", "ID the publication, subscription and slot are named after (default: derived from the target host, port and database)")
+	publicationName := flag.String("publication-name", "", "Publication name (default: aiven_db_migrate_<migration-id>_pub)")
+	subscriptionName := flag.String("subscription-name", "", "Subscription name (default: aiven_db_migrate_<migration-id>_sub)")
+	slotName := flag.String("slot-name", "", "Replication slot name (default: aiven_db_migrate_<migration-id>_slot)")
+	replicationBackend := flag.String("replication-backend", "auto", "Replication backend: auto, aiven_extras, native (CREATE PUBLICATION / CREATE SUBSCRIPTION) or pglogical")
+	replicaIdentityFix := flag.String("replica-identity-fix", "", "Set a replica identity on tables that lack one (index, full, index-or-full)")
+	checkPartitions := flag.Bool("check-partitions", false, "Validate that partitioned source tables can be applied to the target partition layout")
+	publishViaRoot := flag.Bool("publish-via-partition-root", false, "Publish partition changes under the partition root name (PostgreSQL 13+)")
+	publicationConfig := flag.String("publication-config", "", "JSON file with the published tables, their column lists and row filters")
+	publishTables := flag.String("publish-tables", "", "Comma-separated tables to publish instead of all tables")
+	publishTruncate := flag.Bool("publish-truncate", false, "Also replicate TRUNCATE (PostgreSQL 11+ source)")
+	syncSequences := flag.Bool("sync-sequences", false, "Copy current sequence values from source to target")
+	sequenceMargin := flag.Int64("sequence-margin", 0, "Advance target sequences this many increments beyond the source values")
+	syncLargeObjects := flag.Bool("sync-large-objects", false, "Copy large objects (with OIDs and privileges) to the target, re-syncing changed ones")
+	reindexCollations := flag.Bool("reindex-collations", false, "Rebuild target indexes whose collations differ from the source")
+	rulesFile := flag.String("rules-file", "", "JSON file with dump transformation rules applied on restore")
+	singleTransaction := flag.Bool("single-transaction", false, "Restore the schema file inside a single transaction that is rolled back on failure (streamed restores always are)")
+	compareFingerprints := flag.Bool("fingerprint", false, "Compare schema fingerprints of source and target and list differing objects")
+	reconcileReplication := flag.Bool("reconcile-replication", false, "Update the publication of an existing migration to the configured tables without recreating it")
+	recreatePublication := flag.Bool("recreate-publication", false, "Let --reconcile-replication drop and recreate, in one source transaction, a publication that switches between all tables and a table list")
+	stateFile := flag.String("state-file", "", "Journal file recording the completed steps of --full-migration, which a rerun resumes from")
+	stateTable := flag.Bool("state-table", false, "Also keep the --state-file journal in a table on the target")
+	resetState := flag.Bool("reset-state", false, "Discard the recorded --state-file journal and start the full migration over")
+	waitForSync := flag.Bool("wait-for-sync", false, "Block until every subscribed table has finished its initial copy")
+	syncTimeout := flag.Duration("sync-timeout", 0, "Give up waiting for the initial sync after this long (default: no timeout)")
+	syncPollInterval := flag.Duration("sync-poll-interval", 10*time.Second, "How often --wait-for-sync checks the table states")
+	maxSyncErrors := flag.Int64("max-sync-errors", 3, "Table sync failures tolerated by --wait-for-sync (PostgreSQL 15+ targets)")
+	cutover := flag.Bool("cutover", false, "Freeze writes on the source, wait for the subscriber to catch up, sync sequences and drop the replication objects")
+	freezeMode := flag.String("freeze-mode", replication.FreezeDatabase, "How --cutover stops writes on the source: database (read-only database) or roles (revoke write privileges)")
+	freezeRoles := flag.String("freeze-roles", "", "Comma-separated application roles whose write privileges --freeze-mode=roles revokes")
+	cutoverTimeout := flag.Duration("cutover-timeout", 5*time.Minute, "How long --cutover waits for the subscriber to catch up")
+	teardown := flag.Bool("teardown", false, "Drop the subscription, publication and replication slot of the migration on each side and list leftover slots")
+	guardWAL := flag.Bool("guard-wal", false, "Watch the WAL retained by the migration's replication slots on the source until interrupted")
+	walSoftLimit := flag.String("wal-soft-limit", "10GB", "Retained WAL at which --guard-wal warns")
+	walHardLimit := flag.String("wal-hard-limit", "", "Retained WAL past which --guard-wal reports an error, or protects the source with --wal-guard-protect")
+	walGuardProtect := flag.Bool("wal-guard-protect", false, "Past --wal-hard-limit, disable the subscription and drop the slot")
+	walGuardInterval := flag.Duration("wal-guard-interval", time.Minute, "How often --guard-wal reads the slots")
+	showStatus := flag.Bool("status", false, "Report the state of the subscription, its tables and replication slot")
+	outputFormat := flag.String("output", "text", "Output format of --status: text or json")
+	captureDDL := flag.Bool("capture-ddl", false, "Install an event trigger on the source that queues DDL statements for replay (requires superuser)")
+	applyDDL := flag.Bool("apply-ddl", false, "Replay queued source DDL on the target and refresh the subscription until interrupted")
+	ddlPollInterval := flag.Duration("ddl-poll-interval", 5*time.Second, "How often --apply-ddl checks the DDL queue")
+	consumeChanges := flag.Bool("consume-changes", false, "Replicate without a subscription: stream the slot with pgoutput and apply the changes to the target until interrupted")
+	consumeBatchSize := flag.Int("consume-batch-size", 100, "Source transactions --consume-changes and --replay-changes apply per target transaction")
+	consumeMaxChanges := flag.Int("consume-max-changes", 10000, "Changes --export-changes reads from the slot at a time")
+	consumePollInterval := flag.Duration("consume-poll-interval", time.Second, "How long --consume-changes waits for further changes before applying a partial batch, and how often --export-changes checks the slot when it has no changes")
+	exportChanges := flag.Bool("export-changes", false, "Write every published change to rotating NDJSON files in --cdc-dir until interrupted")
+	replayChanges := flag.Bool("replay-changes", false, "Apply the change files in --cdc-dir to the target")
+	cdcDir := flag.String("cdc-dir", "cdc", "Directory of the --export-changes files")
+	cdcFormat := flag.String("cdc-format", replication.CDCFormatPlain, "Record format of --export-changes: plain or debezium")
+	cdcSlot := flag.String("cdc-slot", "", "Replication slot --export-changes decodes (default: the migration slot name with a _cdc suffix)")
+	cdcMaxFileSize := flag.Int64("cdc-max-file-size", 64<<20, "Start a new change file after this many bytes (0: no limit)")
+	cdcRotateInterval := flag.Duration("cdc-rotate-interval", time.Hour, "Start a new change file after this long (0: no limit)")
+	removeDDLCapture := flag.Bool("remove-ddl-capture", false, "Remove the DDL capture trigger and queue from both databases")
 
 	flag.Parse()
 
+	switch *outputFormat {
+	case "text":
+	case "json":
+		// Keep stdout parseable
+		log.SetOutput(os.Stderr)
+	default:
+		log.Fatalf("Unknown --output format %q (expected text or json)", *outputFormat)
+	}
+
 	// Load configuration from flags or environment variables
 	sourceConfig, err := config.LoadSourceConfig(*sourceHost, *sourcePort, *sourceUser, *sourcePassword, *sourceDB, *sourceSSLMode)
 	if err != nil {
@@ -50,24 +126,171 @@ func main() {
 		log.Fatalf("Failed to load target configuration: %v", err)
 	}
 
+	replicator := replication.NewReplicator(sourceConfig, targetConfig)
+	if *migrationID != "" {
+		if err := replicator.SetMigrationID(*migrationID); err != nil {
+			log.Fatalf("Invalid --migration-id: %v", err)
+		}
+	}
+	if err := replicator.SetNames(*publicationName, *subscriptionName, *slotName); err != nil {
+		log.Fatalf("Invalid replication object name: %v", err)
+	}
+	if err := replicator.SetBackend(*replicationBackend); err != nil {
+		log.Fatalf("Invalid --replication-backend: %v", err)
+	}
+	// Migrations started before the object names included the migration ID
+	// still use the legacy names
+	defaultNames := *migrationID == "" && *publicationName == "" && *subscriptionName == "" && *slotName == ""
+	existingMigration := *showStatus || *teardown || *cutover || *reconcileReplication || *guardWAL || (*waitForSync && !*fullMigration)
+	if defaultNames && existingMigration && !*setupReplication && !*fullMigration {
+		if _, err := replicator.UseLegacyNames(); err != nil {
+			log.Fatalf("Failed to look up replication objects: %v", err)
+		}
+	}
+	if err := replicator.SetReplicaIdentityFix(*replicaIdentityFix); err != nil {
+		log.Fatalf("Invalid --replica-identity-fix: %v", err)
+	}
+	replicator.SetPublishViaPartitionRoot(*publishViaRoot)
+	replicator.SetRecreatePublication(*recreatePublication)
+
+	var publication replication.PublicationConfig
+	if *publicationConfig != "" {
+		cfg, err := replication.LoadPublicationConfig(*publicationConfig)
+		if err != nil {
+			log.Fatalf("Failed to load publication config: %v", err)
+		}
+		publication = *cfg
+	}
+	if *publishTables != "" {
+		for _, table := range strings.Split(*publishTables, ",") {
+			publication.Tables = append(publication.Tables, replication.PublishedTable{Table: strings.TrimSpace(table)})
+		}
+	}
+	publication.Truncate = publication.Truncate || *publishTruncate
+	if err := replicator.SetPublication(publication); err != nil {
+		log.Fatalf("Invalid publication: %v", err)
+	}
+
+	waitOptions := replication.WaitOptions{
+		Timeout:       *syncTimeout,
+		PollInterval:  *syncPollInterval,
+		MaxSyncErrors: *maxSyncErrors,
+	}
+
 	// Handle schema operations
-	schemaHandler := schema.NewSchemaHandler(sourceConfig, targetConfig)
+	schemaHandler, err := schema.NewSchemaHandler(sourceConfig, targetConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up schema handling: %v", err)
+	}
+	schemaHandler.SetSingleTransaction(*singleTransaction)
+	if *rulesFile != "" {
+		transformConfig, err := schema.LoadTransformConfig(*rulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load transformation rules: %v", err)
+		}
+		if err := schemaHandler.SetTransformConfig(transformConfig); err != nil {
+			log.Fatalf("Invalid transformation rules: %v", err)
+		}
+	}
+
+	// Preflight checks only
+	if *runPreflight {
+		log.Println("Running preflight checks...")
+		if failed := preflightChecks(sourceConfig, targetConfig, migrationSlots(replicator, *cdcSlot)); failed {
+			log.Fatalf("Preflight checks failed.")
+		}
+		log.Println("Preflight checks passed.")
+	}
 
 	// Full migration process
 	if *fullMigration {
 		log.Println("Starting full migration process...")
 
+		if !*skipPreflight && !*runPreflight {
+			log.Println("Running preflight checks...")
+			if failed := preflightChecks(sourceConfig, targetConfig, migrationSlots(replicator, *cdcSlot)); failed {
+				log.Fatalf("Preflight checks failed, fix the problems above or rerun with --skip-preflight.")
+			}
+		}
+
+		journal := openJournal(*stateFile, *stateTable, *resetState, replicator, schemaHandler, sourceConfig, targetConfig)
+		complete := func(step, lsn, detail string) {
+			if journal == nil {
+				return
+			}
+			if err := journal.Complete(state.StepRecord{Step: step, LSN: lsn, Detail: detail}); err != nil {
+				log.Fatalf("Failed to record step %s: %v", step, err)
+			}
+		}
+		done := func(step string) bool {
+			if journal != nil && journal.Completed(step) {
+				log.Printf("Skipping step %s, completed at %s.", step, journal.Step(step).CompletedAt.Format(time.RFC3339))
+				return true
+			}
+			return false
+		}
+
+		if *captureDDL && !done(state.StepDDLCapture) {
+			if err := replicator.EnableDDLCapture(); err != nil {
+				log.Fatalf("Failed to enable DDL capture: %v", err)
+			}
+			complete(state.StepDDLCapture, "", "")
+		}
+
 		// Step 1: Dump schema from source and restore to target
-		log.Println("Step 1: Dumping and restoring schema...")
-		if err := schemaHandler.DumpAndRestoreSchema(); err != nil {
-			log.Fatalf("Failed to dump and restore schema: %v", err)
+		if !done(state.StepSchema) {
+			ddlPosition, err := replicator.DDLCapturePosition()
+			if err != nil {
+				log.Fatalf("Failed to read DDL capture position: %v", err)
+			}
+
+			log.Println("Step 1: Dumping and restoring schema...")
+			if err := schemaHandler.DumpAndRestoreSchema(); err != nil {
+				log.Fatalf("Failed to dump and restore schema: %v", err)
+			}
+			if *captureDDL || ddlPosition > 0 {
+				// DDL queued before the dump is already part of the restored schema
+				if err := replicator.MarkDDLApplied(ddlPosition); err != nil {
+					log.Fatalf("Failed to record DDL position: %v", err)
+				}
+			}
+			if *rulesFile != "" {
+				schemaHandler.Rules().PrintReport(os.Stdout)
+			}
+			// Without a fingerprint, a resume cannot check the target schema
+			fingerprint := ""
+			if comparison := verifyFingerprints(schemaHandler, *compareFingerprints); comparison != nil {
+				fingerprint = comparison.Target.Overall
+			}
+			complete(state.StepSchema, "", fingerprint)
 		}
 
 		// Step 2: Setup logical replication
-		log.Println("Step 2: Setting up logical replication...")
-		replicator := replication.NewReplicator(sourceConfig, targetConfig)
-		if err := replicator.SetupReplication(); err != nil {
-			log.Fatalf("Failed to setup replication: %v", err)
+		if !done(state.StepReplication) {
+			log.Println("Step 2: Setting up logical replication...")
+			if err := replicator.SetupReplication(); err != nil {
+				log.Fatalf("Failed to setup replication: %v", err)
+			}
+			if journal != nil {
+				status, err := replicator.SubscriptionStatus()
+				if err != nil {
+					log.Fatalf("Failed to read replication status: %v", err)
+				}
+				journal.Backend = status.Backend
+				complete(state.StepReplication, slotLSN(status), "")
+			}
+		}
+
+		if *waitForSync && !done(state.StepInitialSync) {
+			log.Println("Step 3: Waiting for the initial data copy...")
+			waitSync(replicator, waitOptions)
+			if journal != nil {
+				status, err := replicator.SubscriptionStatus()
+				if err != nil {
+					log.Fatalf("Failed to read replication status: %v", err)
+				}
+				complete(state.StepInitialSync, slotLSN(status), "")
+			}
 		}
 
 		log.Println("Full migration process completed successfully.")
@@ -109,23 +332,408 @@ func main() {
 		if err := schemaHandler.RestoreSchemaFromFile(*schemaFile); err != nil {
 			log.Fatalf("Failed to restore schema: %v", err)
 		}
+		if *rulesFile != "" {
+			schemaHandler.Rules().PrintReport(os.Stdout)
+		}
 		log.Println("Schema restored successfully to target database.")
 	}
 
+	if *compareFingerprints {
+		log.Println("Comparing schema fingerprints...")
+		if !verifyFingerprints(schemaHandler, true).Equal() {
+			log.Fatalf("Source and target schemas differ.")
+		}
+	}
+
+	if *captureDDL {
+		log.Println("Enabling DDL capture...")
+		if err := replicator.EnableDDLCapture(); err != nil {
+			log.Fatalf("Failed to enable DDL capture: %v", err)
+		}
+	}
+
+	if *checkReplicaIdentity {
+		log.Println("Checking replica identities on source tables...")
+		remaining, err := replicator.CheckReplicaIdentity()
+		if err != nil {
+			log.Fatalf("Failed to check replica identities: %v", err)
+		}
+		if len(remaining) > 0 {
+			log.Fatalf("%d tables cannot replicate UPDATE/DELETE.", len(remaining))
+		}
+		log.Println("All tables can replicate UPDATE/DELETE.")
+	}
+
+	if *checkPartitions {
+		log.Println("Checking partitioned tables...")
+		issues, err := replicator.CheckPartitions()
+		if err != nil {
+			log.Fatalf("Failed to check partitioned tables: %v", err)
+		}
+		replication.PrintPartitionIssues(os.Stdout, issues)
+		for _, issue := range issues {
+			if issue.Blocking {
+				log.Fatalf("Partitioned tables cannot be replicated to the target layout.")
+			}
+		}
+		log.Println("Partitioned tables can be replicated to the target layout.")
+	}
+
+	if *syncSequences {
+		log.Println("Synchronizing sequence values...")
+		syncs, err := replicator.SyncSequences(*sequenceMargin)
+		if err != nil {
+			log.Fatalf("Failed to synchronize sequences: %v", err)
+		}
+		replication.PrintSequenceReport(os.Stdout, syncs)
+	}
+
+	if *syncLargeObjects {
+		log.Println("Synchronizing large objects...")
+		result, err := largeobject.NewCopier(sourceConfig, targetConfig).Sync()
+		if err != nil {
+			log.Fatalf("Failed to synchronize large objects: %v", err)
+		}
+		if len(result.ExtraOnTarget) > 0 {
+			log.Printf("Warning: large objects %v exist only on the target", result.ExtraOnTarget)
+		}
+	}
+
+	if *reindexCollations {
+		log.Println("Reindexing indexes affected by collation differences...")
+		if _, err := preflight.NewChecker(sourceConfig, targetConfig).ReindexCollations(); err != nil {
+			log.Fatalf("Failed to reindex: %v", err)
+		}
+	}
+
 	// Setup logical replication if requested
 	if *setupReplication {
 		log.Println("Setting up logical replication...")
-		replicator := replication.NewReplicator(sourceConfig, targetConfig)
 		if err := replicator.SetupReplication(); err != nil {
 			log.Fatalf("Failed to setup replication: %v", err)
 		}
 		log.Println("Logical replication setup completed successfully.")
 	}
 
-	if !*dumpSchema && !*restoreSchema && !*setupReplication && !*fullMigration {
-		log.Println("No operation specified. Use --dump-schema, --restore-schema, --setup-replication, or --full-migration.")
+	if *reconcileReplication {
+		log.Println("Reconciling logical replication...")
+		result, err := replicator.ReconcileReplication()
+		if err != nil {
+			log.Fatalf("Failed to reconcile replication: %v", err)
+		}
+		for _, table := range result.Added {
+			log.Printf("Added %s to the publication; its rows are being copied.", table)
+		}
+		for _, table := range result.Removed {
+			log.Printf("Removed %s from the publication; its rows on the target are kept.", table)
+		}
+	}
+
+	if *waitForSync && !*fullMigration {
+		log.Println("Waiting for the initial data copy...")
+		waitSync(replicator, waitOptions)
+	}
+
+	if *cutover {
+		log.Println("Cutting over to the target...")
+		opts := replication.CutoverOptions{
+			Freeze:         *freezeMode,
+			Timeout:        *cutoverTimeout,
+			SequenceMargin: *sequenceMargin,
+		}
+		if *freezeRoles != "" {
+			opts.Roles = strings.Split(*freezeRoles, ",")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		result, err := replicator.Cutover(ctx, opts)
+		stop()
+		if err != nil {
+			log.Fatalf("Cutover failed: %v", err)
+		}
+		replication.PrintSequenceReport(os.Stdout, result.Sequences)
+		replication.PrintCutoverReport(os.Stdout, result)
+	}
+
+	if *teardown {
+		log.Println("Tearing down replication...")
+		result, err := replicator.Teardown()
+		if result != nil {
+			replication.PrintLeftoverSlots(os.Stdout, result.LeftoverSlots)
+		}
+		if err != nil {
+			log.Fatalf("Failed to tear down replication: %v", err)
+		}
+		log.Println("Replication objects removed.")
+	}
+
+	if *guardWAL {
+		opts := replication.GuardOptions{Interval: *walGuardInterval, Protect: *walGuardProtect}
+		if opts.SoftLimit, err = parseSize(*walSoftLimit); err != nil {
+			log.Fatalf("Invalid --wal-soft-limit: %v", err)
+		}
+		if *walHardLimit != "" {
+			if opts.HardLimit, err = parseSize(*walHardLimit); err != nil {
+				log.Fatalf("Invalid --wal-hard-limit: %v", err)
+			}
+		}
+		if opts.Protect && opts.HardLimit == 0 {
+			log.Fatalf("--wal-guard-protect needs --wal-hard-limit")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := replicator.GuardWAL(ctx, opts)
+		stop()
+		if err != nil {
+			log.Fatalf("WAL guard: %v", err)
+		}
+	}
+
+	if *showStatus {
+		status, err := replicator.SubscriptionStatus()
+		if err != nil {
+			log.Fatalf("Failed to read replication status: %v", err)
+		}
+		if *outputFormat == "json" {
+			if err := status.WriteJSON(os.Stdout); err != nil {
+				log.Fatalf("Failed to write status: %v", err)
+			}
+		} else {
+			status.Print(os.Stdout)
+		}
+	}
+
+	if *applyDDL {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := replicator.ApplyDDL(ctx, *ddlPollInterval)
+		stop()
+		if err != nil {
+			log.Fatalf("Failed to apply DDL: %v", err)
+		}
+	}
+
+	if *consumeChanges {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := replicator.ConsumeChanges(ctx, replication.ConsumeOptions{
+			PollInterval: *consumePollInterval,
+			BatchSize:    *consumeBatchSize,
+		})
+		stop()
+		if err != nil {
+			log.Fatalf("Failed to consume changes: %v", err)
+		}
+	}
+
+	if *exportChanges {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := replicator.ExportChanges(ctx, replication.CDCOptions{
+			Dir:            *cdcDir,
+			Format:         *cdcFormat,
+			Slot:           *cdcSlot,
+			MaxFileSize:    *cdcMaxFileSize,
+			RotateInterval: *cdcRotateInterval,
+			PollInterval:   *consumePollInterval,
+			MaxChanges:     *consumeMaxChanges,
+		})
+		stop()
+		if err != nil {
+			log.Fatalf("Failed to export changes: %v", err)
+		}
+	}
+
+	if *replayChanges {
+		log.Printf("Replaying changes from %s...", *cdcDir)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := replicator.ReplayChanges(ctx, *cdcDir, *consumeBatchSize)
+		stop()
+		if err != nil {
+			log.Fatalf("Failed to replay changes: %v", err)
+		}
+	}
+
+	if *removeDDLCapture {
+		log.Println("Removing DDL capture...")
+		if err := replicator.DisableDDLCapture(); err != nil {
+			log.Fatalf("Failed to remove DDL capture: %v", err)
+		}
+	}
+
+	if !*dumpSchema && !*restoreSchema && !*setupReplication && !*fullMigration && !*runPreflight && !*checkReplicaIdentity && !*checkPartitions && !*syncSequences && !*syncLargeObjects && !*reindexCollations && !*compareFingerprints && !*captureDDL && !*applyDDL && !*removeDDLCapture && !*showStatus && !*waitForSync && !*cutover && !*teardown && !*reconcileReplication && !*consumeChanges && !*exportChanges && !*replayChanges && !*guardWAL {
+		log.Println("No operation specified. Use --preflight, --dump-schema, --restore-schema, --fingerprint, --check-replica-identity, --check-partitions, --setup-replication, --reconcile-replication, --wait-for-sync, --cutover, --teardown, --guard-wal, --status, --consume-changes, --export-changes, --replay-changes, --capture-ddl, --apply-ddl, --remove-ddl-capture, --sync-sequences, --sync-large-objects, --reindex-collations, or --full-migration.")
 		flag.Usage()
 	} else {
 		log.Println("Migration process completed.")
 	}
 }
+
+// migrationSlots returns the source replication slots of this migration,
+// including an explicitly named export slot
+func migrationSlots(replicator *replication.Replicator, cdcSlot string) []string {
+	slots := replicator.Slots()
+	if cdcSlot != "" {
+		slots = append(slots, cdcSlot)
+	}
+	return slots
+}
+
+// preflightChecks runs the preflight checks, prints the report and returns
+// whether any check failed. The migration's own slots are not counted as
+// used by others.
+func preflightChecks(source, target *config.DBConfig, slots []string) bool {
+	checker := preflight.NewChecker(source, target)
+	checker.SetMigrationSlots(slots...)
+	report, err := checker.Run()
+	if err != nil {
+		log.Fatalf("Failed to run preflight checks: %v", err)
+	}
+	report.Print(os.Stdout)
+	return report.Failed()
+}
+
+// verifyFingerprints compares the source and target schema fingerprints and
+// returns the comparison. When the user requested the comparison, the
+// per-object listing is always printed and a failure to compare is fatal;
+// otherwise the listing is only printed when the schemas differ, and a
+// failure is logged as a warning and nil returned.
+func verifyFingerprints(schemaHandler *schema.SchemaHandler, requested bool) *schema.FingerprintComparison {
+	comparison, err := schemaHandler.CompareFingerprints()
+	if err != nil {
+		if requested {
+			log.Fatalf("Failed to compare schema fingerprints: %v", err)
+		}
+		log.Printf("Warning: failed to compare schema fingerprints: %v", err)
+		return nil
+	}
+	if requested || !comparison.Equal() {
+		comparison.Print(os.Stdout)
+	}
+	if !comparison.Equal() {
+		log.Printf("Warning: target schema fingerprint %s differs from source %s", comparison.Target.Overall, comparison.Source.Overall)
+		return comparison
+	}
+	log.Printf("Schema fingerprints match: %s", comparison.Source.Overall)
+	return comparison
+}
+
+// openJournal opens the state journal of a full migration, or returns nil
+// without a state file. A journal with steps is only resumed when the
+// migration it describes still matches the configuration and the databases;
+// otherwise the run stops, unless reset discards the journal.
+func openJournal(path string, mirror, reset bool, replicator *replication.Replicator, schemaHandler *schema.SchemaHandler, source, target *config.DBConfig) *state.Journal {
+	if path == "" {
+		return nil
+	}
+	var mirrorTo *config.DBConfig
+	if mirror {
+		mirrorTo = target
+	}
+	journal, err := state.Open(path, mirrorTo, replicator.MigrationID())
+	if err != nil {
+		log.Fatalf("Failed to open migration state: %v", err)
+	}
+	if reset {
+		log.Println("Discarding recorded migration state.")
+		if err := journal.Reset(); err != nil {
+			log.Fatalf("Failed to reset migration state: %v", err)
+		}
+	}
+
+	names := replicator.Names()
+	current := state.Journal{
+		MigrationID:  replicator.MigrationID(),
+		Source:       state.Endpoint(source),
+		Target:       state.Endpoint(target),
+		Publication:  names.Publication,
+		Subscription: names.Subscription,
+		Slot:         names.Slot,
+	}
+	if journal.Empty() {
+		journal.SetIdentity(current)
+		return journal
+	}
+
+	log.Printf("Resuming migration %s after step %s.", journal.MigrationID, journal.Last())
+	drift := journal.ConfigDrift(current)
+	drift = append(drift, stateDrift(journal, replicator, schemaHandler)...)
+	if len(drift) > 0 {
+		for _, d := range drift {
+			log.Printf("Drift: %s", d)
+		}
+		log.Fatalf("The databases or configuration no longer match the recorded migration state; fix them or rerun with --reset-state to start over.")
+	}
+	return journal
+}
+
+// stateDrift compares the recorded steps with the databases: the target
+// schema must still have its recorded fingerprint, and the subscription and
+// slot of a recorded replication setup must still exist
+func stateDrift(journal *state.Journal, replicator *replication.Replicator, schemaHandler *schema.SchemaHandler) []string {
+	var drift []string
+	if rec := journal.Step(state.StepSchema); rec != nil && rec.Detail != "" {
+		comparison, err := schemaHandler.CompareFingerprints()
+		if err != nil {
+			log.Fatalf("Failed to compute schema fingerprints: %v", err)
+		}
+		if comparison.Target.Overall != rec.Detail {
+			drift = append(drift, fmt.Sprintf("target schema fingerprint is %s, recorded %s after the restore", comparison.Target.Overall, rec.Detail))
+		}
+	}
+
+	if journal.Completed(state.StepReplication) {
+		status, err := replicator.SubscriptionStatus()
+		if err != nil {
+			log.Fatalf("Failed to read replication status: %v", err)
+		}
+		if status.State == replication.StateMissing {
+			drift = append(drift, fmt.Sprintf("subscription '%s' no longer exists on the target", status.Subscription))
+		}
+		if status.Slot == nil || !status.Slot.Exists {
+			drift = append(drift, "the replication slot no longer exists on the source")
+		}
+		if journal.Backend != "" && status.Backend != journal.Backend {
+			drift = append(drift, fmt.Sprintf("replication backend was %s, now %s", journal.Backend, status.Backend))
+		}
+	}
+	return drift
+}
+
+// slotLSN returns the position the subscriber has confirmed, or else the
+// restart position of the slot
+func slotLSN(status *replication.Status) string {
+	if status.Slot == nil {
+		return ""
+	}
+	if status.Slot.ConfirmedFlushLSN != "" {
+		return status.Slot.ConfirmedFlushLSN
+	}
+	return status.Slot.RestartLSN
+}
+
+// waitSync blocks until the initial copy has finished, exiting on failure
+func waitSync(replicator *replication.Replicator, opts replication.WaitOptions) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := replicator.WaitForInitialSync(ctx, opts); err != nil {
+		log.Fatalf("Initial sync did not complete: %v", err)
+	}
+}
+
+// parseSize parses a byte size with an optional PostgreSQL-style unit (kB,
+// MB, GB, TB, all multiples of 1024)
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"kB", 1 << 10}, {"B", 1}}
+	s = strings.TrimSpace(s)
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, factor = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 512MB or 50GB)", s)
+	}
+	return n * factor, nil
+}
@@ -0,0 +1,330 @@
+package largeobject
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"pg-migration/pkg/config"
+
+	"github.com/lib/pq"
+)
+
+// chunkSize is the number of bytes read and written per round trip
+const chunkSize = 1 << 20
+
+// Copier copies large objects from the source to the target database. Large
+// objects are neither part of the schema dump nor carried by logical
+// replication, so they have to be copied separately.
+type Copier struct {
+	source *config.DBConfig
+	target *config.DBConfig
+}
+
+// NewCopier creates a new Copier instance
+func NewCopier(source, target *config.DBConfig) *Copier {
+	return &Copier{
+		source: source,
+		target: target,
+	}
+}
+
+// SyncResult summarizes a large object synchronization pass
+type SyncResult struct {
+	Copied        int     // Objects that did not exist on the target
+	Updated       int     // Objects whose content differed and were rewritten
+	Unchanged     int     // Objects already identical on the target
+	ExtraOnTarget []int64 // Objects on the target that no longer exist on the source
+}
+
+// largeObject is the metadata of one large object
+type largeObject struct {
+	oid   int64
+	owner string
+}
+
+// grant is one privilege on a large object, from aclexplode
+type grant struct {
+	grantee   string // Empty for PUBLIC
+	privilege string
+	grantable bool
+}
+
+// Count returns the number of large objects in the database
+func Count(db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM pg_largeobject_metadata;").Scan(&count)
+	return count, err
+}
+
+// listLargeObjects returns the large objects of a database in OID order
+func listLargeObjects(db *sql.DB) ([]largeObject, error) {
+	rows, err := db.Query("SELECT oid::bigint, pg_get_userbyid(lomowner) FROM pg_largeobject_metadata ORDER BY oid;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []largeObject
+	for rows.Next() {
+		var lo largeObject
+		if err := rows.Scan(&lo.oid, &lo.owner); err != nil {
+			return nil, err
+		}
+		objects = append(objects, lo)
+	}
+	return objects, rows.Err()
+}
+
+// hashChunkSize is the number of bytes hashed per round trip when comparing
+// content; only the hashes travel
+const hashChunkSize = 64 << 20
+
+// invRead is the INV_READ mode of lo_open
+const invRead = 0x40000
+
+// objectSize returns the size of a large object in bytes
+func objectSize(db *sql.DB, oid int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The descriptor only lives as long as the transaction
+	var size int64
+	err = tx.QueryRow("SELECT lo_lseek64(lo_open($1::oid, $2), 0, 2);", oid, invRead).Scan(&size)
+	return size, err
+}
+
+// sameContent compares a large object on both sides: by size first, then by
+// the MD5 of each chunk, computed server side, stopping at the first chunk
+// that differs. lo_get of a whole object fails beyond 1 GB, so it is read in
+// chunks.
+func sameContent(srcDB, tgtDB *sql.DB, oid int64) (bool, error) {
+	srcSize, err := objectSize(srcDB, oid)
+	if err != nil {
+		return false, fmt.Errorf("failed to read size of large object %d on source: %v", oid, err)
+	}
+	tgtSize, err := objectSize(tgtDB, oid)
+	if err != nil {
+		return false, fmt.Errorf("failed to read size of large object %d on target: %v", oid, err)
+	}
+	if srcSize != tgtSize {
+		return false, nil
+	}
+
+	for offset := int64(0); offset < srcSize; offset += hashChunkSize {
+		var srcHash, tgtHash string
+		query := "SELECT md5(lo_get($1::oid, $2, $3));"
+		if err := srcDB.QueryRow(query, oid, offset, hashChunkSize).Scan(&srcHash); err != nil {
+			return false, fmt.Errorf("failed to hash large object %d on source: %v", oid, err)
+		}
+		if err := tgtDB.QueryRow(query, oid, offset, hashChunkSize).Scan(&tgtHash); err != nil {
+			return false, fmt.Errorf("failed to hash large object %d on target: %v", oid, err)
+		}
+		if srcHash != tgtHash {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// listGrants returns the explicit privileges on a large object
+func listGrants(db *sql.DB, oid int64) ([]grant, error) {
+	query := `
+		SELECT CASE WHEN a.grantee = 0 THEN '' ELSE pg_get_userbyid(a.grantee) END,
+		       a.privilege_type, a.is_grantable
+		FROM pg_largeobject_metadata m,
+		     LATERAL aclexplode(m.lomacl) a
+		WHERE m.oid = $1::oid AND a.grantee <> m.lomowner;
+	`
+	rows, err := db.Query(query, oid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []grant
+	for rows.Next() {
+		var g grant
+		if err := rows.Scan(&g.grantee, &g.privilege, &g.grantable); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// Sync copies every large object of the source to the target, keeping its
+// OID, and rewrites objects whose content differs from the source. Running
+// it again after an earlier pass re-syncs the objects that changed since.
+func (c *Copier) Sync() (*SyncResult, error) {
+	srcDB, err := sql.Open("postgres", c.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", c.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	srcObjects, err := listLargeObjects(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list large objects on source: %v", err)
+	}
+	tgtObjects, err := listLargeObjects(tgtDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list large objects on target: %v", err)
+	}
+	log.Printf("Found %d large objects on source and %d on target", len(srcObjects), len(tgtObjects))
+
+	onSource := map[int64]bool{}
+	onTarget := map[int64]bool{}
+	for _, lo := range srcObjects {
+		onSource[lo.oid] = true
+	}
+	for _, lo := range tgtObjects {
+		onTarget[lo.oid] = true
+	}
+
+	result := &SyncResult{}
+	for _, lo := range srcObjects {
+		oid := lo.oid
+		if onTarget[oid] {
+			same, err := sameContent(srcDB, tgtDB, oid)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				result.Unchanged++
+			} else {
+				if err := copyObject(srcDB, tgtDB, oid, true); err != nil {
+					return nil, err
+				}
+				result.Updated++
+			}
+		} else {
+			if err := copyObject(srcDB, tgtDB, oid, false); err != nil {
+				return nil, err
+			}
+			result.Copied++
+		}
+
+		// Privileges are re-applied on every pass, as they may have changed too
+		if err := copyPrivileges(srcDB, tgtDB, lo); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, lo := range tgtObjects {
+		if !onSource[lo.oid] {
+			result.ExtraOnTarget = append(result.ExtraOnTarget, lo.oid)
+		}
+	}
+
+	log.Printf("Large objects: %d copied, %d updated, %d unchanged, %d only on target",
+		result.Copied, result.Updated, result.Unchanged, len(result.ExtraOnTarget))
+	return result, nil
+}
+
+// copyObject copies the content of one large object in chunks inside a
+// single target transaction, so a failure never leaves a partial object.
+// An existing object is replaced.
+func copyObject(srcDB, tgtDB *sql.DB, oid int64, replace bool) error {
+	tx, err := tgtDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for large object %d: %v", oid, err)
+	}
+	defer tx.Rollback() // No-op once the transaction is committed
+
+	if replace {
+		if _, err := tx.Exec("SELECT lo_unlink($1::oid);", oid); err != nil {
+			return fmt.Errorf("failed to remove outdated large object %d on target: %v", oid, err)
+		}
+	}
+	if _, err := tx.Exec("SELECT lo_create($1::oid);", oid); err != nil {
+		return fmt.Errorf("failed to create large object %d on target: %v", oid, err)
+	}
+
+	for offset := int64(0); ; offset += chunkSize {
+		var chunk []byte
+		if err := srcDB.QueryRow("SELECT lo_get($1::oid, $2, $3);", oid, offset, chunkSize).Scan(&chunk); err != nil {
+			return fmt.Errorf("failed to read large object %d on source: %v", oid, err)
+		}
+		if len(chunk) > 0 {
+			if _, err := tx.Exec("SELECT lo_put($1::oid, $2, $3);", oid, offset, chunk); err != nil {
+				return fmt.Errorf("failed to write large object %d on target: %v", oid, err)
+			}
+		}
+		if len(chunk) < chunkSize {
+			break
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit large object %d: %v", oid, err)
+	}
+	return nil
+}
+
+// copyPrivileges applies the source owner and grants of a large object on
+// the target, and revokes target privileges the source does not have.
+// Roles missing on the target are reported and skipped.
+func copyPrivileges(srcDB, tgtDB *sql.DB, lo largeObject) error {
+	if _, err := tgtDB.Exec(fmt.Sprintf("ALTER LARGE OBJECT %d OWNER TO %s;", lo.oid, pq.QuoteIdentifier(lo.owner))); err != nil {
+		log.Printf("Warning: could not set owner of large object %d to %s: %v", lo.oid, lo.owner, err)
+	}
+
+	grants, err := listGrants(srcDB, lo.oid)
+	if err != nil {
+		return fmt.Errorf("failed to read privileges of large object %d on source: %v", lo.oid, err)
+	}
+	existing, err := listGrants(tgtDB, lo.oid)
+	if err != nil {
+		return fmt.Errorf("failed to read privileges of large object %d on target: %v", lo.oid, err)
+	}
+
+	// Privileges by grantee and privilege, to whether they are grantable
+	onSource := map[[2]string]bool{}
+	for _, g := range grants {
+		onSource[[2]string{g.grantee, g.privilege}] = g.grantable
+	}
+	for _, g := range existing {
+		grantable, granted := onSource[[2]string{g.grantee, g.privilege}]
+		var stmt string
+		switch {
+		case !granted:
+			stmt = fmt.Sprintf("REVOKE %s ON LARGE OBJECT %d FROM %s", g.privilege, lo.oid, grantee(g))
+		case g.grantable && !grantable:
+			stmt = fmt.Sprintf("REVOKE GRANT OPTION FOR %s ON LARGE OBJECT %d FROM %s", g.privilege, lo.oid, grantee(g))
+		default:
+			continue
+		}
+		if _, err := tgtDB.Exec(stmt + ";"); err != nil {
+			log.Printf("Warning: could not apply %q on target: %v", stmt, err)
+		}
+	}
+
+	for _, g := range grants {
+		stmt := fmt.Sprintf("GRANT %s ON LARGE OBJECT %d TO %s", g.privilege, lo.oid, grantee(g))
+		if g.grantable {
+			stmt += " WITH GRANT OPTION"
+		}
+		if _, err := tgtDB.Exec(stmt + ";"); err != nil {
+			log.Printf("Warning: could not apply %q on target: %v", stmt, err)
+		}
+	}
+	return nil
+}
+
+// grantee returns the quoted grantee of a privilege, or PUBLIC
+func grantee(g grant) string {
+	if g.grantee == "" {
+		return "PUBLIC"
+	}
+	return pq.QuoteIdentifier(g.grantee)
+}
@@ -0,0 +1,305 @@
+// Package pgoutput decodes the messages of PostgreSQL's pgoutput logical
+// decoding plugin, protocol version 1
+package pgoutput
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LSN is a WAL position
+type LSN uint64
+
+// ParseLSN parses the textual form of an LSN, e.g. "16/B374D848"
+func ParseLSN(s string) (LSN, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	return LSN(h<<32 | l), nil
+}
+
+// String formats the LSN the way PostgreSQL does
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint64(l)>>32, uint32(l))
+}
+
+// postgresEpoch is the origin of pgoutput timestamps
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Message is a decoded pgoutput message: *Begin, *Commit, *Origin,
+// *Relation, *Type, *Insert, *Update, *Delete or *Truncate
+type Message interface{}
+
+// Begin starts a transaction
+type Begin struct {
+	FinalLSN   LSN // LSN of the commit record
+	CommitTime time.Time
+	XID        uint32
+}
+
+// Commit ends a transaction
+type Commit struct {
+	CommitLSN  LSN
+	EndLSN     LSN // End of the commit record; decoding resumes here
+	CommitTime time.Time
+}
+
+// Origin names the replication origin of a transaction
+type Origin struct {
+	LSN  LSN
+	Name string
+}
+
+// Column describes a column of a relation
+type Column struct {
+	Name    string
+	Key     bool // Part of the replica identity
+	TypeOID uint32
+	TypMod  int32
+}
+
+// Relation describes a table before the first change to it is sent
+type Relation struct {
+	ID              uint32
+	Namespace       string
+	Name            string
+	ReplicaIdentity byte // d (default), n (nothing), f (full) or i (index)
+	Columns         []Column
+}
+
+// Type describes a non-builtin data type
+type Type struct {
+	ID        uint32
+	Namespace string
+	Name      string
+}
+
+// Value kinds of TupleData columns
+const (
+	ValueNull      = 'n'
+	ValueUnchanged = 'u' // Unchanged TOASTed value, not sent
+	ValueText      = 't'
+)
+
+// Value is one column of a tuple
+type Value struct {
+	Kind byte
+	Data []byte // Text representation, for ValueText
+}
+
+// Tuple holds the column values of a row, in relation column order
+type Tuple []Value
+
+// Insert is a new row
+type Insert struct {
+	RelationID uint32
+	New        Tuple
+}
+
+// Update is a changed row. Old holds the replica identity columns when
+// they changed, or the whole old row with REPLICA IDENTITY FULL.
+type Update struct {
+	RelationID uint32
+	Old        Tuple // nil when the key is unchanged
+	OldIsKey   bool  // Old holds only the key columns
+	New        Tuple
+}
+
+// Delete is a removed row. Old holds the replica identity columns, or the
+// whole row with REPLICA IDENTITY FULL.
+type Delete struct {
+	RelationID uint32
+	Old        Tuple
+	OldIsKey   bool
+}
+
+// Truncate empties relations
+type Truncate struct {
+	Cascade         bool
+	RestartIdentity bool
+	RelationIDs     []uint32
+}
+
+// reader consumes the fields of a message
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) need(n int) bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("message truncated")
+		return false
+	}
+	return true
+}
+
+func (r *reader) byte1() byte {
+	if !r.need(1) {
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *reader) int16() uint16 {
+	if !r.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.data)
+	r.data = r.data[2:]
+	return v
+}
+
+func (r *reader) int32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *reader) int64() uint64 {
+	if !r.need(8) {
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *reader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	for i, b := range r.data {
+		if b == 0 {
+			s := string(r.data[:i])
+			r.data = r.data[i+1:]
+			return s
+		}
+	}
+	r.err = fmt.Errorf("unterminated string")
+	return ""
+}
+
+func (r *reader) bytes(n int) []byte {
+	if !r.need(n) {
+		return nil
+	}
+	b := append([]byte(nil), r.data[:n]...)
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) timestamp() time.Time {
+	return postgresEpoch.Add(time.Duration(int64(r.int64())) * time.Microsecond)
+}
+
+func (r *reader) tuple() Tuple {
+	n := int(r.int16())
+	tuple := make(Tuple, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		v := Value{Kind: r.byte1()}
+		switch v.Kind {
+		case ValueNull, ValueUnchanged:
+		case ValueText:
+			v.Data = r.bytes(int(r.int32()))
+		default:
+			r.err = fmt.Errorf("unknown tuple value kind %q", v.Kind)
+		}
+		tuple = append(tuple, v)
+	}
+	return tuple
+}
+
+// Parse decodes one pgoutput message. Logical decoding messages ('M') and
+// unknown message types are returned as nil without an error.
+func Parse(data []byte) (Message, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	r := &reader{data: data[1:]}
+
+	var msg Message
+	switch data[0] {
+	case 'B':
+		msg = &Begin{FinalLSN: LSN(r.int64()), CommitTime: r.timestamp(), XID: r.int32()}
+	case 'C':
+		r.byte1() // Flags, unused
+		msg = &Commit{CommitLSN: LSN(r.int64()), EndLSN: LSN(r.int64()), CommitTime: r.timestamp()}
+	case 'O':
+		msg = &Origin{LSN: LSN(r.int64()), Name: r.string()}
+	case 'R':
+		rel := &Relation{ID: r.int32(), Namespace: r.string(), Name: r.string(), ReplicaIdentity: r.byte1()}
+		n := int(r.int16())
+		for i := 0; i < n && r.err == nil; i++ {
+			flags := r.byte1()
+			rel.Columns = append(rel.Columns, Column{Key: flags&1 != 0, Name: r.string(), TypeOID: r.int32(), TypMod: int32(r.int32())})
+		}
+		msg = rel
+	case 'Y':
+		msg = &Type{ID: r.int32(), Namespace: r.string(), Name: r.string()}
+	case 'I':
+		ins := &Insert{RelationID: r.int32()}
+		if kind := r.byte1(); kind != 'N' && r.err == nil {
+			return nil, fmt.Errorf("unexpected tuple type %q in insert", kind)
+		}
+		ins.New = r.tuple()
+		msg = ins
+	case 'U':
+		upd := &Update{RelationID: r.int32()}
+		kind := r.byte1()
+		if kind == 'K' || kind == 'O' {
+			upd.OldIsKey = kind == 'K'
+			upd.Old = r.tuple()
+			kind = r.byte1()
+		}
+		if kind != 'N' && r.err == nil {
+			return nil, fmt.Errorf("unexpected tuple type %q in update", kind)
+		}
+		upd.New = r.tuple()
+		msg = upd
+	case 'D':
+		del := &Delete{RelationID: r.int32()}
+		kind := r.byte1()
+		if kind != 'K' && kind != 'O' && r.err == nil {
+			return nil, fmt.Errorf("unexpected tuple type %q in delete", kind)
+		}
+		del.OldIsKey = kind == 'K'
+		del.Old = r.tuple()
+		msg = del
+	case 'T':
+		n := int(r.int32())
+		options := r.byte1()
+		trunc := &Truncate{Cascade: options&1 != 0, RestartIdentity: options&2 != 0}
+		for i := 0; i < n && r.err == nil; i++ {
+			trunc.RelationIDs = append(trunc.RelationIDs, r.int32())
+		}
+		msg = trunc
+	default:
+		return nil, nil
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to decode %q message: %v", data[0], r.err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,192 @@
+package pgoutput
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// msg concatenates message fields: bytes, strings (NUL terminated), uint16,
+// uint32 and uint64 values in network byte order
+func msg(fields ...interface{}) []byte {
+	var b []byte
+	for _, f := range fields {
+		switch v := f.(type) {
+		case byte:
+			b = append(b, v)
+		case []byte:
+			b = append(b, v...)
+		case string:
+			b = append(append(b, v...), 0)
+		case uint16:
+			b = binary.BigEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		default:
+			panic("unsupported field type")
+		}
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	// 2024-01-01 00:00:00 UTC in microseconds since the PostgreSQL epoch
+	commitTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	micros := uint64(commitTime.Sub(postgresEpoch) / time.Microsecond)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    Message
+		wantErr bool
+	}{
+		{
+			name: "begin",
+			data: msg(byte('B'), uint64(0x16B374D848), micros, uint32(731)),
+			want: &Begin{FinalLSN: 0x16B374D848, CommitTime: commitTime, XID: 731},
+		},
+		{
+			name: "commit",
+			data: msg(byte('C'), byte(0), uint64(0x100), uint64(0x128), micros),
+			want: &Commit{CommitLSN: 0x100, EndLSN: 0x128, CommitTime: commitTime},
+		},
+		{
+			name: "origin",
+			data: msg(byte('O'), uint64(0x42), "node_a"),
+			want: &Origin{LSN: 0x42, Name: "node_a"},
+		},
+		{
+			name: "relation",
+			data: msg(byte('R'), uint32(16384), "public", "orders", byte('d'), uint16(2),
+				byte(1), "id", uint32(23), uint32(0xFFFFFFFF),
+				byte(0), "note", uint32(1043), uint32(68)),
+			want: &Relation{ID: 16384, Namespace: "public", Name: "orders", ReplicaIdentity: 'd', Columns: []Column{
+				{Name: "id", Key: true, TypeOID: 23, TypMod: -1},
+				{Name: "note", TypeOID: 1043, TypMod: 68},
+			}},
+		},
+		{
+			name: "type",
+			data: msg(byte('Y'), uint32(90001), "public", "mood"),
+			want: &Type{ID: 90001, Namespace: "public", Name: "mood"},
+		},
+		{
+			name: "insert",
+			data: msg(byte('I'), uint32(16384), byte('N'), uint16(3),
+				byte('t'), uint32(2), []byte("42"), byte('n'), byte('u')),
+			want: &Insert{RelationID: 16384, New: Tuple{
+				{Kind: ValueText, Data: []byte("42")}, {Kind: ValueNull}, {Kind: ValueUnchanged},
+			}},
+		},
+		{
+			name: "update without old tuple",
+			data: msg(byte('U'), uint32(16384), byte('N'), uint16(1), byte('t'), uint32(1), []byte("7")),
+			want: &Update{RelationID: 16384, New: Tuple{{Kind: ValueText, Data: []byte("7")}}},
+		},
+		{
+			name: "update with changed key",
+			data: msg(byte('U'), uint32(16384), byte('K'), uint16(1), byte('t'), uint32(1), []byte("6"),
+				byte('N'), uint16(1), byte('t'), uint32(1), []byte("7")),
+			want: &Update{RelationID: 16384, OldIsKey: true,
+				Old: Tuple{{Kind: ValueText, Data: []byte("6")}},
+				New: Tuple{{Kind: ValueText, Data: []byte("7")}}},
+		},
+		{
+			name: "update with full old row",
+			data: msg(byte('U'), uint32(16384), byte('O'), uint16(1), byte('n'),
+				byte('N'), uint16(1), byte('t'), uint32(0), []byte{}),
+			want: &Update{RelationID: 16384,
+				Old: Tuple{{Kind: ValueNull}},
+				New: Tuple{{Kind: ValueText}}}, // An empty text value
+		},
+		{
+			name: "delete",
+			data: msg(byte('D'), uint32(16384), byte('K'), uint16(1), byte('t'), uint32(1), []byte("6")),
+			want: &Delete{RelationID: 16384, OldIsKey: true, Old: Tuple{{Kind: ValueText, Data: []byte("6")}}},
+		},
+		{
+			name: "truncate",
+			data: msg(byte('T'), uint32(2), byte(3), uint32(16384), uint32(16390)),
+			want: &Truncate{Cascade: true, RestartIdentity: true, RelationIDs: []uint32{16384, 16390}},
+		},
+		{
+			name: "logical decoding message is skipped",
+			data: msg(byte('M'), byte(1), uint64(0x10), "prefix", uint32(0)),
+			want: nil,
+		},
+		{
+			name:    "empty message",
+			data:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "truncated begin",
+			data:    msg(byte('B'), uint64(0x10)),
+			wantErr: true,
+		},
+		{
+			name:    "unterminated relation name",
+			data:    append(msg(byte('R'), uint32(1), "public"), "orders"...),
+			wantErr: true,
+		},
+		{
+			name:    "unknown tuple value kind",
+			data:    msg(byte('I'), uint32(16384), byte('N'), uint16(1), byte('x')),
+			wantErr: true,
+		},
+		{
+			name:    "insert without new tuple",
+			data:    msg(byte('I'), uint32(16384), byte('K'), uint16(0)),
+			wantErr: true,
+		},
+		{
+			name:    "delete without old tuple",
+			data:    msg(byte('D'), uint32(16384), byte('N'), uint16(0)),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    LSN
+		wantErr bool
+	}{
+		{in: "0/0", want: 0},
+		{in: "16/B374D848", want: 0x16B374D848},
+		{in: "FFFFFFFF/FFFFFFFF", want: 0xFFFFFFFFFFFFFFFF},
+		{in: "16B374D848", wantErr: true},
+		{in: "1/G", wantErr: true},
+		{in: "100000000/0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLSN(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLSN(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLSN(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if !tt.wantErr && got.String() != tt.in {
+			t.Errorf("LSN(%q).String() = %q", tt.in, got.String())
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package preflight
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// databaseLocale is the encoding and default collation of a database
+type databaseLocale struct {
+	encoding    string
+	collate     string
+	ctype       string
+	provider    string // c (libc), i (ICU) or b (builtin); libc before PostgreSQL 15
+	icuLocale   string
+	collVersion string  // Actual version of the default collation, if known
+	version     Version // Server version; collation versions need PostgreSQL 10+
+}
+
+// databaseLocaleQuery reads the locale settings of the current database.
+// to_jsonb is used so the query works whether or not the locale provider
+// columns (PostgreSQL 15+, renamed in 17) exist.
+const databaseLocaleQuery = `
+SELECT pg_encoding_to_char(d.encoding), d.datcollate, d.datctype,
+       COALESCE(to_jsonb(d) ->> 'datlocprovider', 'c'),
+       COALESCE(to_jsonb(d) ->> 'datlocale', to_jsonb(d) ->> 'daticulocale', '')
+FROM pg_database d
+WHERE d.datname = current_database();
+`
+
+// indexCollationsQuery lists the non-C collations used by user indexes with
+// their actual versions as reported by the collation library
+const indexCollationsQuery = `
+SELECT DISTINCT co.collname, COALESCE(pg_collation_actual_version(co.oid), '')
+FROM pg_index x
+JOIN pg_class i ON i.oid = x.indexrelid
+JOIN pg_namespace n ON n.oid = i.relnamespace
+CROSS JOIN LATERAL unnest(x.indcollation::oid[]) AS ic(colloid)
+JOIN pg_collation co ON co.oid = ic.colloid
+WHERE co.collname NOT IN ('C', 'POSIX', 'ucs_basic', 'default')
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+ORDER BY 1;
+`
+
+// collationIndexesQuery lists the user indexes that use any of the given collations
+const collationIndexesQuery = `
+SELECT DISTINCT quote_ident(n.nspname) || '.' || quote_ident(i.relname)
+FROM pg_index x
+JOIN pg_class i ON i.oid = x.indexrelid
+JOIN pg_namespace n ON n.oid = i.relnamespace
+CROSS JOIN LATERAL unnest(x.indcollation::oid[]) AS ic(colloid)
+JOIN pg_collation co ON co.oid = ic.colloid
+WHERE co.collname = ANY ($1)
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+ORDER BY 1;
+`
+
+// readDatabaseLocale reads the locale settings and default collation version
+func readDatabaseLocale(db *sql.DB) (*databaseLocale, error) {
+	loc := &databaseLocale{}
+	if err := db.QueryRow(databaseLocaleQuery).Scan(&loc.encoding, &loc.collate, &loc.ctype, &loc.provider, &loc.icuLocale); err != nil {
+		return nil, err
+	}
+
+	version, err := ServerVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	loc.version = version
+	// pg_collation_actual_version is PostgreSQL 10+
+	if version < 100000 {
+		return loc, nil
+	}
+
+	// PostgreSQL 15 tracks the database collation version itself; before
+	// that, the libc collation of the same name reports it. initdb names
+	// libc collations after the normalized locale (en_US.utf8 for
+	// en_US.UTF-8), and they have no version before PostgreSQL 13.
+	query := `SELECT COALESCE(pg_database_collation_actual_version(oid), '') FROM pg_database WHERE datname = current_database();`
+	if version < 150000 {
+		query = `SELECT COALESCE((SELECT pg_collation_actual_version(oid) FROM pg_collation
+		         WHERE collname IN (current_setting('lc_collate'),
+		                            split_part(current_setting('lc_collate'), '.', 1) || '.' ||
+		                            lower(replace(split_part(current_setting('lc_collate'), '.', 2), '-', '')))
+		           AND collprovider = 'c'
+		         ORDER BY collname = current_setting('lc_collate') DESC LIMIT 1), '');`
+	}
+	if err := db.QueryRow(query).Scan(&loc.collVersion); err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
+
+// readIndexCollations returns the actual versions of the collations used by indexes
+func readIndexCollations(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query(indexCollationsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[string]string{}
+	for rows.Next() {
+		var name, version string
+		if err := rows.Scan(&name, &version); err != nil {
+			return nil, err
+		}
+		versions[name] = version
+	}
+	return versions, rows.Err()
+}
+
+// collationIndexes lists the indexes that use any of the given collations
+func collationIndexes(db *sql.DB, collations []string) ([]string, error) {
+	rows, err := db.Query(collationIndexesQuery, pq.Array(collations))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var indexes []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, name)
+	}
+	return indexes, rows.Err()
+}
+
+// affectedCollations compares the source and target locale settings and
+// collation versions. It returns the names of the collations that may sort
+// differently on the target ("default" stands for the database collation),
+// and records the comparison in the report when one is given.
+func affectedCollations(srcDB, tgtDB *sql.DB, report *Report) ([]string, error) {
+	srcLocale, err := readDatabaseLocale(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source locale settings: %v", err)
+	}
+	tgtLocale, err := readDatabaseLocale(tgtDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target locale settings: %v", err)
+	}
+	if report == nil {
+		report = &Report{}
+	}
+
+	switch {
+	case srcLocale.encoding == tgtLocale.encoding:
+		report.Pass("database encoding", fmt.Sprintf("both databases use %s", srcLocale.encoding))
+	case tgtLocale.encoding == "UTF8":
+		report.Warn("database encoding",
+			fmt.Sprintf("source uses %s, target uses UTF8", srcLocale.encoding),
+			"characters are converted to UTF8; check that the source data is valid in its declared encoding")
+	default:
+		report.Fail("database encoding",
+			fmt.Sprintf("source uses %s, target uses %s", srcLocale.encoding, tgtLocale.encoding),
+			"create the target database with the source encoding (CREATE DATABASE ... ENCODING) or UTF8")
+	}
+
+	var affected []string
+	defaultAffected := false
+
+	if srcLocale.collate != tgtLocale.collate || srcLocale.ctype != tgtLocale.ctype {
+		defaultAffected = true
+		report.Warn("LC_COLLATE/LC_CTYPE",
+			fmt.Sprintf("source uses %s/%s, target uses %s/%s", srcLocale.collate, srcLocale.ctype, tgtLocale.collate, tgtLocale.ctype),
+			"text ordering and case mapping may differ; create the target database with the source locale to keep them")
+	} else {
+		report.Pass("LC_COLLATE/LC_CTYPE", fmt.Sprintf("both databases use %s/%s", srcLocale.collate, srcLocale.ctype))
+	}
+
+	if srcLocale.provider != tgtLocale.provider || srcLocale.icuLocale != tgtLocale.icuLocale {
+		defaultAffected = true
+		report.Warn("locale provider",
+			fmt.Sprintf("source uses provider %q locale %q, target uses provider %q locale %q",
+				srcLocale.provider, srcLocale.icuLocale, tgtLocale.provider, tgtLocale.icuLocale),
+			"create the target database with the same LOCALE_PROVIDER and ICU locale as the source")
+	} else {
+		report.Pass("locale provider", fmt.Sprintf("both databases use provider %q", srcLocale.provider))
+	}
+
+	// Collation versions can only be read on PostgreSQL 10+
+	if srcLocale.version < 100000 || tgtLocale.version < 100000 {
+		report.Warn("collation versions",
+			fmt.Sprintf("source is version %s, target is version %s; collation versions can only be compared on PostgreSQL 10 or later",
+				srcLocale.version.MajorString(), tgtLocale.version.MajorString()),
+			"check that source and target use the same glibc or ICU version, or reindex text indexes after migration")
+		if defaultAffected {
+			affected = append(affected, "default")
+		}
+		sort.Strings(affected)
+		return affected, nil
+	}
+
+	switch {
+	case srcLocale.collVersion == "" || tgtLocale.collVersion == "":
+		// Equal empty versions say nothing about the libraries
+		defaultAffected = true
+		report.Warn("database collation version",
+			fmt.Sprintf("collation version unknown: source reports %q, target reports %q", srcLocale.collVersion, tgtLocale.collVersion),
+			"check that source and target use the same glibc or ICU version, or reindex text indexes using the database collation after migration")
+	case srcLocale.collVersion != tgtLocale.collVersion:
+		defaultAffected = true
+		report.Warn("database collation version",
+			fmt.Sprintf("source reports %q, target reports %q (different glibc or ICU versions)", srcLocale.collVersion, tgtLocale.collVersion),
+			"text indexes using the database collation may order differently; reindex them after migration")
+	default:
+		report.Pass("database collation version", fmt.Sprintf("both report %q", srcLocale.collVersion))
+	}
+	if defaultAffected {
+		affected = append(affected, "default")
+	}
+
+	srcCollations, err := readIndexCollations(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source collation versions: %v", err)
+	}
+	tgtCollations, err := readIndexCollations(tgtDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target collation versions: %v", err)
+	}
+
+	var mismatches, unknown []string
+	for name, srcVersion := range srcCollations {
+		// Collations only used on the source are compared once the schema is restored
+		tgtVersion, exists := tgtCollations[name]
+		switch {
+		case !exists:
+		case srcVersion == "" || tgtVersion == "":
+			// libc collations have no version before PostgreSQL 13
+			affected = append(affected, name)
+			unknown = append(unknown, fmt.Sprintf("%s (%q vs %q)", name, srcVersion, tgtVersion))
+		case tgtVersion != srcVersion:
+			affected = append(affected, name)
+			mismatches = append(mismatches, fmt.Sprintf("%s (%q vs %q)", name, srcVersion, tgtVersion))
+		}
+	}
+	sort.Strings(mismatches)
+	sort.Strings(unknown)
+	if len(unknown) > 0 {
+		report.Warn("collation versions unknown",
+			"collation version unknown on source or target: "+strings.Join(unknown, ", "),
+			"check that source and target use the same glibc or ICU version, or reindex indexes using these collations after migration")
+	}
+	if len(mismatches) > 0 {
+		report.Warn("collation versions",
+			"collation versions differ between source and target: "+strings.Join(mismatches, ", "),
+			"indexes using these collations may order differently; reindex them after migration")
+	} else if len(unknown) == 0 {
+		report.Pass("collation versions", fmt.Sprintf("%d collations used by indexes match", len(srcCollations)))
+	}
+
+	sort.Strings(affected)
+	return affected, nil
+}
+
+// checkCollations compares encodings, locales and collation versions and
+// lists the indexes that will need a REINDEX after migration
+func checkCollations(srcDB, tgtDB *sql.DB, report *Report) error {
+	affected, err := affectedCollations(srcDB, tgtDB, report)
+	if err != nil {
+		return err
+	}
+	if len(affected) == 0 {
+		report.Pass("index rebuild", "no indexes need a REINDEX for collation changes")
+		return nil
+	}
+
+	// The schema may not be restored yet, so the source tells which
+	// indexes will exist on the target
+	indexes, err := collationIndexes(srcDB, affected)
+	if err != nil {
+		return fmt.Errorf("failed to list indexes on collatable columns: %v", err)
+	}
+	if len(indexes) == 0 {
+		report.Pass("index rebuild", "no indexes use the affected collations")
+		return nil
+	}
+	report.Warn("index rebuild",
+		fmt.Sprintf("%d indexes use affected collations: %s", len(indexes), strings.Join(indexes, ", ")),
+		"run --reindex-collations after the migration, or REINDEX these indexes manually")
+	return nil
+}
+
+// ReindexCollations rebuilds the target indexes that use collations whose
+// locale settings or versions differ from the source
+func (c *Checker) ReindexCollations() ([]string, error) {
+	srcDB, err := sql.Open("postgres", c.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", c.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	affected, err := affectedCollations(srcDB, tgtDB, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(affected) == 0 {
+		log.Println("Collations match between source and target, nothing to reindex.")
+		return nil, nil
+	}
+
+	indexes, err := collationIndexes(tgtDB, affected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexes on collatable columns: %v", err)
+	}
+	for _, index := range indexes {
+		log.Printf("Reindexing %s...", index)
+		if _, err := tgtDB.Exec(fmt.Sprintf("REINDEX INDEX %s;", index)); err != nil {
+			return nil, fmt.Errorf("failed to reindex %s: %v", index, err)
+		}
+	}
+	log.Printf("Reindexed %d indexes on the target", len(indexes))
+	return indexes, nil
+}
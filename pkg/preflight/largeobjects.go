@@ -0,0 +1,26 @@
+package preflight
+
+import (
+	"database/sql"
+	"fmt"
+
+	"pg-migration/pkg/largeobject"
+)
+
+// checkLargeObjects warns when the source has large objects, which neither
+// the schema dump nor logical replication carry to the target
+func checkLargeObjects(srcDB *sql.DB, report *Report) error {
+	count, err := largeobject.Count(srcDB)
+	if err != nil {
+		return fmt.Errorf("failed to count large objects on source: %v", err)
+	}
+
+	if count > 0 {
+		report.Warn("large objects",
+			fmt.Sprintf("source has %d large objects, which are not migrated by schema dump or logical replication", count),
+			"run --sync-large-objects after the initial copy and again right before cutover")
+		return nil
+	}
+	report.Pass("large objects", "source has no large objects")
+	return nil
+}
@@ -0,0 +1,134 @@
+package preflight
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+
+	"pg-migration/pkg/config"
+
+	_ "github.com/lib/pq" // PostgreSQL driver
+)
+
+// Status is the outcome of a single preflight check
+type Status string
+
+const (
+	StatusPass Status = "PASS"
+	StatusWarn Status = "WARN"
+	StatusFail Status = "FAIL"
+)
+
+// Check is a single entry of a preflight report
+type Check struct {
+	Name   string
+	Status Status
+	Detail string // What was found
+	Fix    string // How to resolve a warning or failure
+}
+
+// Report collects the results of the preflight checks
+type Report struct {
+	Checks []Check
+}
+
+// Pass records a successful check
+func (r *Report) Pass(name, detail string) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: StatusPass, Detail: detail})
+}
+
+// Warn records a check that found a potential problem
+func (r *Report) Warn(name, detail, fix string) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: StatusWarn, Detail: detail, Fix: fix})
+}
+
+// Fail records a check that found a blocking problem
+func (r *Report) Fail(name, detail, fix string) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: StatusFail, Detail: detail, Fix: fix})
+}
+
+// Failed reports whether any check failed
+func (r *Report) Failed() bool {
+	for _, check := range r.Checks {
+		if check.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the report as a plain text table
+func (r *Report) Print(w io.Writer) {
+	width := 0
+	for _, check := range r.Checks {
+		if len(check.Name) > width {
+			width = len(check.Name)
+		}
+	}
+
+	counts := map[Status]int{}
+	for _, check := range r.Checks {
+		counts[check.Status]++
+		fmt.Fprintf(w, "[%s] %-*s  %s\n", check.Status, width, check.Name, check.Detail)
+		if check.Fix != "" && check.Status != StatusPass {
+			fmt.Fprintf(w, "       %-*s  fix: %s\n", width, "", check.Fix)
+		}
+	}
+	fmt.Fprintf(w, "%d passed, %d warnings, %d failed\n",
+		counts[StatusPass], counts[StatusWarn], counts[StatusFail])
+}
+
+// Checker runs preflight checks against the source and target databases
+type Checker struct {
+	source *config.DBConfig
+	target *config.DBConfig
+
+	ownSlots []string
+}
+
+// NewChecker creates a new Checker instance
+func NewChecker(source, target *config.DBConfig) *Checker {
+	return &Checker{
+		source: source,
+		target: target,
+	}
+}
+
+// SetMigrationSlots names the replication slots of the migration itself. If
+// they already exist, e.g. on a rerun, they are not counted as used by
+// others.
+func (c *Checker) SetMigrationSlots(slots ...string) {
+	c.ownSlots = slots
+}
+
+// Run executes all preflight checks and returns the combined report. An error
+// is only returned when the checks themselves could not be carried out.
+func (c *Checker) Run() (*Report, error) {
+	srcDB, err := sql.Open("postgres", c.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", c.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	report := &Report{}
+	if err := checkVersions(srcDB, tgtDB, report); err != nil {
+		return nil, err
+	}
+	if err := checkCollations(srcDB, tgtDB, report); err != nil {
+		return nil, err
+	}
+	if err := checkLargeObjects(srcDB, report); err != nil {
+		return nil, err
+	}
+	if err := checkReplication(srcDB, tgtDB, c.ownSlots, report); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,168 @@
+package preflight
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// intSetting returns the value of an integer server setting
+func intSetting(db *sql.DB, name string) (int, error) {
+	var value int
+	if err := db.QueryRow("SELECT current_setting($1)::int;", name).Scan(&value); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return value, nil
+}
+
+// countRows runs a count(*) query
+func countRows(db *sql.DB, query string) (int, error) {
+	var n int
+	err := db.QueryRow(query).Scan(&n)
+	return n, err
+}
+
+// checkReplication checks the server settings and privileges logical
+// replication needs: wal_level, free replication slots and WAL senders and
+// the REPLICATION privilege on the source, free logical replication workers
+// on the target. The initial copy runs up to max_sync_workers_per_subscription
+// table sync workers, each of which uses a slot and a WAL sender on the
+// source in addition to the apply worker's. The migration's own slots, which
+// exist on a rerun, do not count as used.
+func checkReplication(srcDB, tgtDB *sql.DB, ownSlots []string, report *Report) error {
+	tgtVersion, err := ServerVersion(tgtDB)
+	if err != nil {
+		return fmt.Errorf("failed to query target server version: %v", err)
+	}
+
+	var walLevel string
+	if err := srcDB.QueryRow("SELECT current_setting('wal_level');").Scan(&walLevel); err != nil {
+		return fmt.Errorf("failed to read wal_level on source: %v", err)
+	}
+	if walLevel == "logical" {
+		report.Pass("source wal_level", "wal_level is logical")
+	} else {
+		report.Fail("source wal_level",
+			fmt.Sprintf("wal_level is %s, logical decoding needs logical", walLevel),
+			"run ALTER SYSTEM SET wal_level = logical on the source and restart it")
+	}
+
+	// pglogical subscribers (targets older than 10) copy tables one at a time
+	syncWorkers := 1
+	if tgtVersion.Major() >= 100000 {
+		if syncWorkers, err = intSetting(tgtDB, "max_sync_workers_per_subscription"); err != nil {
+			return err
+		}
+	}
+	needed := 1 + syncWorkers
+
+	maxSlots, err := intSetting(srcDB, "max_replication_slots")
+	if err != nil {
+		return err
+	}
+	var usedSlots int
+	err = srcDB.QueryRow("SELECT count(*) FROM pg_replication_slots WHERE slot_name <> ALL($1::text[]);", pq.Array(ownSlots)).Scan(&usedSlots)
+	if err != nil {
+		return fmt.Errorf("failed to count replication slots on source: %v", err)
+	}
+	checkHeadroom(report, "source replication slots", "max_replication_slots", maxSlots, usedSlots, needed,
+		"drop unused slots (see --teardown) or raise max_replication_slots on the source (restart required)")
+
+	maxSenders, err := intSetting(srcDB, "max_wal_senders")
+	if err != nil {
+		return err
+	}
+	usedSenders, err := countRows(srcDB, "SELECT count(*) FROM pg_stat_replication;")
+	if err != nil {
+		return fmt.Errorf("failed to count WAL senders on source: %v", err)
+	}
+	checkHeadroom(report, "source WAL senders", "max_wal_senders", maxSenders, usedSenders, needed,
+		"raise max_wal_senders on the source (restart required)")
+
+	// Managed services grant replication through a role instead of the
+	// REPLICATION attribute, e.g. rds_replication on Amazon RDS
+	var canReplicate bool
+	err = srcDB.QueryRow(`
+		SELECT rolsuper OR rolreplication
+		       OR EXISTS(SELECT 1 FROM pg_roles WHERE rolname = 'rds_replication' AND pg_has_role(current_user, oid, 'member'))
+		FROM pg_roles
+		WHERE rolname = current_user;
+	`).Scan(&canReplicate)
+	if err != nil {
+		return fmt.Errorf("failed to check replication privilege on source: %v", err)
+	}
+	if canReplicate {
+		report.Pass("source replication privilege", "the migration user may open replication connections")
+	} else {
+		report.Fail("source replication privilege",
+			"the migration user has neither the REPLICATION attribute nor an equivalent role",
+			"run ALTER ROLE <user> REPLICATION on the source, or grant the provider's replication role")
+	}
+
+	if tgtVersion.Major() < 100000 {
+		maxWorkers, err := intSetting(tgtDB, "max_worker_processes")
+		if err != nil {
+			return err
+		}
+		report.Pass("target workers", fmt.Sprintf("max_worker_processes is %d (pglogical subscriber)", maxWorkers))
+		return nil
+	}
+
+	maxWorkers, err := intSetting(tgtDB, "max_logical_replication_workers")
+	if err != nil {
+		return err
+	}
+	usedWorkers, err := countRows(tgtDB, "SELECT count(*) FROM pg_stat_subscription WHERE pid IS NOT NULL;")
+	if err != nil {
+		return fmt.Errorf("failed to count logical replication workers on target: %v", err)
+	}
+	checkHeadroom(report, "target replication workers", "max_logical_replication_workers", maxWorkers, usedWorkers, needed,
+		"raise max_logical_replication_workers on the target (restart required)")
+
+	if syncWorkers < 1 {
+		report.Fail("target sync workers",
+			"max_sync_workers_per_subscription is 0, so no table would be copied",
+			"set max_sync_workers_per_subscription to at least 1 on the target")
+	} else {
+		report.Pass("target sync workers", fmt.Sprintf("up to %d tables are copied in parallel (max_sync_workers_per_subscription)", syncWorkers))
+	}
+	return nil
+}
+
+// checkHeadroom fails when not even one more of a limited resource is free
+// and warns when fewer than needed are free, which slows the initial copy
+func checkHeadroom(report *Report, name, setting string, max, used, needed int, fix string) {
+	free := max - used
+	detail := fmt.Sprintf("%d of %d (%s) in use, %d free, %d wanted", used, max, setting, free, needed)
+	switch {
+	case free < 1:
+		report.Fail(name, detail, fix)
+	case free < needed:
+		report.Warn(name, detail+"; the initial copy will run fewer tables in parallel", fix)
+	default:
+		report.Pass(name, detail)
+	}
+}
+
+// RunReplication checks only what logical replication needs, before any
+// replication object is created
+func (c *Checker) RunReplication() (*Report, error) {
+	srcDB, err := sql.Open("postgres", c.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", c.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	report := &Report{}
+	if err := checkReplication(srcDB, tgtDB, c.ownSlots, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,159 @@
+package preflight
+
+import (
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// versionPattern matches the version in "pg_dump (PostgreSQL) 16.2 (Ubuntu 16.2-1)"
+var versionPattern = regexp.MustCompile(`\(PostgreSQL\) (\d+)(?:\.(\d+))?(?:\.(\d+))?`)
+
+// Version is a PostgreSQL version in server_version_num format (e.g. 130012)
+type Version int
+
+// Major returns the major version in server_version_num format, e.g. 130000
+// for 13.12 and 90600 for 9.6.24
+func (v Version) Major() Version {
+	if v >= 100000 {
+		return v / 10000 * 10000
+	}
+	return v / 100 * 100
+}
+
+// String formats the version the way PostgreSQL prints it
+func (v Version) String() string {
+	if v >= 100000 {
+		return fmt.Sprintf("%d.%d", v/10000, v%10000)
+	}
+	return fmt.Sprintf("%d.%d.%d", v/10000, v/100%100, v%100)
+}
+
+// MajorString formats only the major version, e.g. "13" or "9.6"
+func (v Version) MajorString() string {
+	if v >= 100000 {
+		return strconv.Itoa(int(v / 10000))
+	}
+	return fmt.Sprintf("%d.%d", v/10000, v/100%100)
+}
+
+// ServerVersion returns the server_version_num of the connected server
+func ServerVersion(db *sql.DB) (Version, error) {
+	var num int
+	if err := db.QueryRow("SELECT current_setting('server_version_num')::int;").Scan(&num); err != nil {
+		return 0, err
+	}
+	return Version(num), nil
+}
+
+// ClientVersion runs "<tool> --version" and parses the reported version
+func ClientVersion(tool string) (Version, error) {
+	out, err := exec.Command(tool, "--version").Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to run %s --version: %v", tool, err)
+	}
+	return parseClientVersion(string(out))
+}
+
+// parseClientVersion parses the output of pg_dump/psql --version
+func parseClientVersion(out string) (Version, error) {
+	m := versionPattern.FindStringSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("unrecognized version output: %q", out)
+	}
+
+	parts := make([]int, 3)
+	for i := range parts {
+		if m[i+1] != "" {
+			parts[i], _ = strconv.Atoi(m[i+1])
+		}
+	}
+
+	// Since PostgreSQL 10 versions have two parts, before that three
+	if parts[0] >= 10 {
+		return Version(parts[0]*10000 + parts[1]), nil
+	}
+	return Version(parts[0]*10000 + parts[1]*100 + parts[2]), nil
+}
+
+// checkVersions compares the server versions with each other and with the
+// pg_dump and psql binaries found on PATH
+func checkVersions(srcDB, tgtDB *sql.DB, report *Report) error {
+	srcVersion, err := ServerVersion(srcDB)
+	if err != nil {
+		return fmt.Errorf("failed to query source server version: %v", err)
+	}
+	tgtVersion, err := ServerVersion(tgtDB)
+	if err != nil {
+		return fmt.Errorf("failed to query target server version: %v", err)
+	}
+
+	// Logical replication with publications and subscriptions needs
+	// PostgreSQL 10; older servers from 9.4 on can replicate with pglogical
+	if srcVersion.Major() < 100000 {
+		var pglogical bool
+		if err := srcDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_available_extensions WHERE name = 'pglogical');").Scan(&pglogical); err != nil {
+			return fmt.Errorf("failed to query available extensions on source: %v", err)
+		}
+		if srcVersion.Major() >= 90400 && pglogical {
+			report.Warn("source version",
+				fmt.Sprintf("source runs PostgreSQL %s, which has no native logical replication", srcVersion),
+				"replication will use the pglogical backend; pglogical must also be installed on the target")
+		} else {
+			report.Fail("source version",
+				fmt.Sprintf("source runs PostgreSQL %s", srcVersion),
+				"native logical replication requires PostgreSQL 10 or later on the source; upgrade it first, or install pglogical (9.4+)")
+		}
+	} else {
+		report.Pass("source version", fmt.Sprintf("source runs PostgreSQL %s", srcVersion))
+	}
+
+	switch {
+	case tgtVersion.Major() < srcVersion.Major():
+		report.Fail("target version",
+			fmt.Sprintf("target runs PostgreSQL %s, older than the source (%s)", tgtVersion, srcVersion),
+			fmt.Sprintf("DDL from a newer server is not guaranteed to be accepted; use a target running PostgreSQL %s or later", srcVersion.MajorString()))
+	default:
+		report.Pass("target version", fmt.Sprintf("target runs PostgreSQL %s", tgtVersion))
+	}
+
+	// pg_dump refuses to dump servers newer than itself, and newer pg_dump
+	// versions emit syntax older servers reject (e.g. default_table_access_method)
+	dumpVersion, err := ClientVersion("pg_dump")
+	switch {
+	case err != nil:
+		report.Fail("pg_dump version", err.Error(),
+			"install the PostgreSQL client tools and make sure pg_dump is on PATH")
+	case dumpVersion.Major() < srcVersion.Major():
+		report.Fail("pg_dump version",
+			fmt.Sprintf("pg_dump %s is older than the source server (%s)", dumpVersion, srcVersion),
+			fmt.Sprintf("install the PostgreSQL %s client tools (e.g. postgresql-client-%s) and put them first on PATH",
+				srcVersion.MajorString(), srcVersion.MajorString()))
+	case dumpVersion.Major() >= 120000 && tgtVersion.Major() < 120000:
+		report.Pass("pg_dump version",
+			fmt.Sprintf("pg_dump %s can dump the source; the SET default_table_access_method it emits is dropped for the target (%s)", dumpVersion, tgtVersion))
+	case dumpVersion.Major() > tgtVersion.Major():
+		report.Warn("pg_dump version",
+			fmt.Sprintf("pg_dump %s is newer than the target server (%s)", dumpVersion, tgtVersion),
+			fmt.Sprintf("if the restore fails on unknown settings or syntax, use the PostgreSQL %s client tools", tgtVersion.MajorString()))
+	default:
+		report.Pass("pg_dump version", fmt.Sprintf("pg_dump %s can dump the source", dumpVersion))
+	}
+
+	psqlVersion, err := ClientVersion("psql")
+	switch {
+	case err != nil:
+		report.Fail("psql version", err.Error(),
+			"install the PostgreSQL client tools and make sure psql is on PATH")
+	case psqlVersion.Major() < tgtVersion.Major():
+		report.Warn("psql version",
+			fmt.Sprintf("psql %s is older than the target server (%s)", psqlVersion, tgtVersion),
+			fmt.Sprintf("install the PostgreSQL %s client tools to avoid restore incompatibilities", tgtVersion.MajorString()))
+	default:
+		report.Pass("psql version", fmt.Sprintf("psql %s can restore to the target", psqlVersion))
+	}
+
+	return nil
+}
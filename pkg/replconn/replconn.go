@@ -0,0 +1,607 @@
+// Package replconn is a minimal client for PostgreSQL logical replication
+// connections. lib/pq cannot open them, so the frontend/backend protocol is
+// spoken directly: startup with replication=database, password, MD5 or
+// SCRAM-SHA-256 authentication, TLS, replication commands sent as simple
+// queries and the streaming replication sub-protocol.
+package replconn
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pg-migration/pkg/config"
+	"pg-migration/pkg/pgoutput"
+)
+
+// Protocol codes of the startup and SSL request messages
+const (
+	protocolVersion = 196608   // 3.0
+	sslRequestCode  = 80877103 // 1234.5679
+)
+
+// postgresEpoch is the origin of replication protocol timestamps
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Error is an error reported by the server
+type Error struct {
+	Severity string
+	Code     string // SQLSTATE
+	Message  string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// parseError decodes the fields of an ErrorResponse
+func parseError(body []byte) *Error {
+	e := &Error{}
+	for len(body) > 1 {
+		field := body[0]
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		body = body[2+end:]
+		switch field {
+		case 'S':
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		case 'D':
+			e.Detail = value
+		}
+	}
+	return e
+}
+
+// message is one backend message
+type message struct {
+	typ  byte
+	body []byte
+	err  error
+}
+
+// Conn is a replication connection
+type Conn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+
+	// Set once streaming started: messages are read by a goroutine so a
+	// wait can time out without losing a partly read message
+	messages chan message
+	done     chan struct{}
+	once     sync.Once
+
+	flushed pgoutput.LSN // Last position confirmed with SendStatus
+	idle    bool         // Keepalives may confirm the server's WAL end
+}
+
+// XLogData is a chunk of WAL data sent while streaming; for a logical slot,
+// one message of the output plugin
+type XLogData struct {
+	WALStart   pgoutput.LSN
+	WALEnd     pgoutput.LSN
+	ServerTime time.Time
+	Data       []byte
+}
+
+// Slot is a replication slot created by CreateSlot
+type Slot struct {
+	Name            string
+	ConsistentPoint pgoutput.LSN
+	SnapshotName    string // Valid until the next command on the connection
+}
+
+// Connect opens a replication connection to the database of cfg. The user
+// needs the REPLICATION privilege.
+func Connect(ctx context.Context, cfg *config.DBConfig) (*Conn, error) {
+	var d net.Dialer
+	network, address := "tcp", net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	if strings.HasPrefix(cfg.Host, "/") {
+		network, address = "unix", fmt.Sprintf("%s/.s.PGSQL.%d", cfg.Host, cfg.Port)
+	}
+	nc, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	sslMode := cfg.SSLMode
+	if sslMode == "" {
+		sslMode = "require" // As ConnectionString
+	}
+	if network == "tcp" {
+		if nc, err = startTLS(ctx, nc, cfg.Host, sslMode); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Conn{conn: nc, rd: bufio.NewReader(nc)}
+	if err := c.startup(ctx, cfg.User, cfg.Password, cfg.Database); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startTLS negotiates TLS as the sslmode asks. require encrypts without
+// verifying the server certificate, as libpq does without a root
+// certificate; verify-ca and verify-full verify it against the system roots.
+func startTLS(ctx context.Context, nc net.Conn, host, sslMode string) (net.Conn, error) {
+	if sslMode == "disable" || sslMode == "allow" {
+		return nc, nil
+	}
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:], 8)
+	binary.BigEndian.PutUint32(request[4:], sslRequestCode)
+	if _, err := nc.Write(request); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(nc, answer); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if answer[0] == 'N' {
+		if sslMode == "prefer" {
+			return nc, nil
+		}
+		nc.Close()
+		return nil, fmt.Errorf("server does not support SSL, but sslmode %s requires it", sslMode)
+	}
+	if answer[0] != 'S' {
+		nc.Close()
+		return nil, fmt.Errorf("unexpected answer %q to SSL request", answer[0])
+	}
+
+	tlsConfig := &tls.Config{ServerName: host}
+	switch sslMode {
+	case "verify-full":
+	case "verify-ca":
+		// Verify the chain but not the host name
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(raw))
+			for i, der := range raw {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Intermediates: intermediates})
+			return err
+		}
+	default:
+		tlsConfig.InsecureSkipVerify = true
+	}
+	tc := tls.Client(nc, tlsConfig)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return tc, nil
+}
+
+// send writes one frontend message; typ 0 is for the startup message, which
+// has no type byte
+func (c *Conn) send(typ byte, payload []byte) error {
+	msg := make([]byte, 0, 5+len(payload))
+	if typ != 0 {
+		msg = append(msg, typ)
+	}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(4+len(payload)))
+	msg = append(msg, payload...)
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// receive reads one backend message
+func (c *Conn) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.rd, header); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint32(header[1:])) - 4
+	if n < 0 {
+		return 0, nil, fmt.Errorf("invalid length of %q message", header[0])
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.rd, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// watch closes the connection when ctx is cancelled before the returned
+// function is called, which ends a blocking read or write
+func (c *Conn) watch(ctx context.Context) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// startup sends the startup message, authenticates and waits until the
+// server is ready for commands
+func (c *Conn) startup(ctx context.Context, user, password, database string) error {
+	defer c.watch(ctx)()
+
+	payload := binary.BigEndian.AppendUint32(nil, protocolVersion)
+	for _, param := range [][2]string{
+		{"user", user},
+		{"database", database},
+		{"replication", "database"},
+		{"application_name", "pg-migration"},
+	} {
+		payload = append(payload, param[0]...)
+		payload = append(payload, 0)
+		payload = append(payload, param[1]...)
+		payload = append(payload, 0)
+	}
+	payload = append(payload, 0)
+	if err := c.send(0, payload); err != nil {
+		return err
+	}
+
+	var sc *scram
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			return parseError(body)
+		case 'Z':
+			return nil
+		case 'S', 'K', 'N':
+			// Parameter status, cancellation key and notices are not needed
+		case 'R':
+			if len(body) < 4 {
+				return fmt.Errorf("invalid authentication request")
+			}
+			code, data := binary.BigEndian.Uint32(body), body[4:]
+			switch code {
+			case 0: // AuthenticationOk
+			case 3: // Cleartext password
+				err = c.send('p', append([]byte(password), 0))
+			case 5: // MD5 password with a 4 byte salt
+				inner := md5.Sum([]byte(password + user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data...))
+				err = c.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0))
+			case 10: // SASL, with the mechanisms offered
+				if !strings.Contains(string(data), scramMechanism+"\x00") {
+					return fmt.Errorf("server offers no supported SASL mechanism: %q", data)
+				}
+				if sc, err = newSCRAM("", password); err != nil {
+					return err
+				}
+				first := sc.clientFirst()
+				msg := append([]byte(scramMechanism), 0)
+				msg = binary.BigEndian.AppendUint32(msg, uint32(len(first)))
+				err = c.send('p', append(msg, first...))
+			case 11: // SASL continue
+				if sc == nil {
+					return fmt.Errorf("SASL continue without SASL authentication")
+				}
+				var final string
+				if final, err = sc.clientFinal(string(data)); err == nil {
+					err = c.send('p', []byte(final))
+				}
+			case 12: // SASL final
+				if sc == nil {
+					return fmt.Errorf("SASL final without SASL authentication")
+				}
+				err = sc.verifyServerFinal(string(data))
+			default:
+				return fmt.Errorf("unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return fmt.Errorf("authentication failed: %v", err)
+			}
+		default:
+			return fmt.Errorf("unexpected message %q during startup", typ)
+		}
+	}
+}
+
+// Exec runs a replication command and returns the rows of its result by
+// column name. NULLs are returned as empty strings.
+func (c *Conn) Exec(ctx context.Context, command string) ([]map[string]string, error) {
+	if c.messages != nil {
+		return nil, fmt.Errorf("connection is streaming")
+	}
+	defer c.watch(ctx)()
+	if err := c.send('Q', append([]byte(command), 0)); err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	var rows []map[string]string
+	var cmdErr error
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'T':
+			columns = parseRowDescription(body)
+		case 'D':
+			values := parseDataRow(body)
+			row := map[string]string{}
+			for i, value := range values {
+				if i < len(columns) {
+					row[columns[i]] = value
+				}
+			}
+			rows = append(rows, row)
+		case 'E':
+			cmdErr = parseError(body)
+		case 'Z':
+			return rows, cmdErr
+		case 'C', 'I', 'N', 'S':
+		default:
+			return nil, fmt.Errorf("unexpected message %q in response to %s", typ, strings.Fields(command)[0])
+		}
+	}
+}
+
+// parseRowDescription returns the column names of a RowDescription
+func parseRowDescription(body []byte) []string {
+	if len(body) < 2 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	var columns []string
+	for i := 0; i < n; i++ {
+		end := strings.IndexByte(string(body), 0)
+		if end < 0 || len(body) < end+19 {
+			break
+		}
+		columns = append(columns, string(body[:end]))
+		body = body[end+19:] // Name, table OID, attnum, type OID, size, modifier, format
+	}
+	return columns
+}
+
+// parseDataRow returns the text values of a DataRow
+func parseDataRow(body []byte) []string {
+	if len(body) < 2 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	values := make([]string, 0, n)
+	for i := 0; i < n && len(body) >= 4; i++ {
+		size := int32(binary.BigEndian.Uint32(body))
+		body = body[4:]
+		if size < 0 || int(size) > len(body) {
+			values = append(values, "")
+			continue
+		}
+		values = append(values, string(body[:size]))
+		body = body[size:]
+	}
+	return values
+}
+
+// CreateSlot creates a logical replication slot and exports a snapshot of
+// the database as of the slot's consistent point. The snapshot can be
+// imported with SET TRANSACTION SNAPSHOT until the next command is sent on
+// this connection, so changes streamed from the slot start exactly where a
+// copy made in it ends.
+func (c *Conn) CreateSlot(ctx context.Context, name, plugin string) (*Slot, error) {
+	rows, err := c.Exec(ctx, fmt.Sprintf("CREATE_REPLICATION_SLOT %s LOGICAL %s EXPORT_SNAPSHOT", quoteIdent(name), quoteIdent(plugin)))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("CREATE_REPLICATION_SLOT returned %d rows", len(rows))
+	}
+	slot := &Slot{Name: rows[0]["slot_name"], SnapshotName: rows[0]["snapshot_name"]}
+	if slot.ConsistentPoint, err = pgoutput.ParseLSN(rows[0]["consistent_point"]); err != nil {
+		return nil, err
+	}
+	return slot, nil
+}
+
+// StartReplication starts streaming a logical slot from start, or from its
+// confirmed position when start is zero, passing the plugin options. The
+// connection then only serves Receive and SendStatus.
+func (c *Conn) StartReplication(ctx context.Context, slot string, start pgoutput.LSN, options map[string]string) error {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := make([]string, len(names))
+	for i, name := range names {
+		args[i] = fmt.Sprintf("%s '%s'", quoteIdent(name), strings.ReplaceAll(options[name], "'", "''"))
+	}
+	command := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL %s", quoteIdent(slot), start)
+	if len(args) > 0 {
+		command += " (" + strings.Join(args, ", ") + ")"
+	}
+
+	stop := c.watch(ctx)
+	if err := c.send('Q', append([]byte(command), 0)); err != nil {
+		stop()
+		return err
+	}
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			stop()
+			return err
+		}
+		switch typ {
+		case 'W': // CopyBothResponse
+			stop()
+			c.messages = make(chan message)
+			c.done = make(chan struct{})
+			go c.readMessages()
+			return nil
+		case 'E':
+			stop()
+			return parseError(body)
+		case 'N', 'S':
+		default:
+			stop()
+			return fmt.Errorf("unexpected message %q in response to START_REPLICATION", typ)
+		}
+	}
+}
+
+// readMessages passes streamed messages to Receive until the connection
+// ends or is closed
+func (c *Conn) readMessages() {
+	for {
+		typ, body, err := c.receive()
+		select {
+		case c.messages <- message{typ: typ, body: body, err: err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// SetIdle tells Receive whether everything received so far was applied and
+// no transaction is partly received. While idle, keepalives are answered
+// with the server's WAL end, which confirms it: pgoutput skips transactions
+// that touch no published table, so the slot would otherwise not advance
+// while the published tables are idle.
+func (c *Conn) SetIdle(idle bool) {
+	c.idle = idle
+}
+
+// Receive returns the next WAL data message, or nil when none arrives within
+// wait. Keepalives asking for a reply are answered with the position last
+// passed to SendStatus, or with the server's WAL end when idle (see
+// SetIdle).
+func (c *Conn) Receive(ctx context.Context, wait time.Duration) (*XLogData, error) {
+	if c.messages == nil {
+		return nil, fmt.Errorf("connection is not streaming")
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		var msg message
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, nil
+		case msg = <-c.messages:
+		}
+		if msg.err != nil {
+			return nil, msg.err
+		}
+
+		switch msg.typ {
+		case 'd':
+			if len(msg.body) == 0 {
+				continue
+			}
+			switch msg.body[0] {
+			case 'w':
+				if len(msg.body) < 25 {
+					return nil, fmt.Errorf("truncated WAL data message")
+				}
+				return &XLogData{
+					WALStart:   pgoutput.LSN(binary.BigEndian.Uint64(msg.body[1:])),
+					WALEnd:     pgoutput.LSN(binary.BigEndian.Uint64(msg.body[9:])),
+					ServerTime: postgresEpoch.Add(time.Duration(int64(binary.BigEndian.Uint64(msg.body[17:]))) * time.Microsecond),
+					Data:       msg.body[25:],
+				}, nil
+			case 'k':
+				if len(msg.body) < 18 {
+					return nil, fmt.Errorf("truncated keepalive message")
+				}
+				flushed := c.flushed
+				if walEnd := pgoutput.LSN(binary.BigEndian.Uint64(msg.body[1:])); c.idle && walEnd > flushed {
+					flushed = walEnd
+				}
+				if flushed != c.flushed || msg.body[17] == 1 {
+					if err := c.SendStatus(flushed); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case 'E':
+			return nil, parseError(msg.body)
+		case 'c':
+			return nil, fmt.Errorf("server ended replication")
+		case 'N', 'S':
+		default:
+			return nil, fmt.Errorf("unexpected message %q while streaming", msg.typ)
+		}
+	}
+}
+
+// SendStatus confirms that everything up to flushed was written durably,
+// which lets the slot advance and the server release the WAL before it. A
+// zero position confirms nothing.
+func (c *Conn) SendStatus(flushed pgoutput.LSN) error {
+	c.flushed = flushed
+	msg := []byte{'r'}
+	for i := 0; i < 3; i++ { // Written, flushed and applied
+		msg = binary.BigEndian.AppendUint64(msg, uint64(flushed))
+	}
+	msg = binary.BigEndian.AppendUint64(msg, uint64(time.Since(postgresEpoch)/time.Microsecond))
+	msg = append(msg, 0) // No reply requested
+	return c.send('d', msg)
+}
+
+// Close ends the connection
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+	c.send('X', nil)
+	return c.conn.Close()
+}
+
+// quoteIdent quotes a name for a replication command
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
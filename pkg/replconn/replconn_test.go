@@ -0,0 +1,89 @@
+package replconn
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"pg-migration/pkg/pgoutput"
+)
+
+// keepalive builds a CopyData keepalive message for walEnd
+func keepalive(walEnd pgoutput.LSN, reply bool) []byte {
+	body := []byte{'k'}
+	body = binary.BigEndian.AppendUint64(body, uint64(walEnd))
+	body = binary.BigEndian.AppendUint64(body, 0)
+	if reply {
+		body = append(body, 1)
+	} else {
+		body = append(body, 0)
+	}
+	msg := binary.BigEndian.AppendUint32([]byte{'d'}, uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+func TestReceiveKeepalive(t *testing.T) {
+	tests := []struct {
+		name    string
+		idle    bool
+		walEnd  pgoutput.LSN
+		reply   bool
+		want    pgoutput.LSN
+		wantMsg bool
+	}{
+		{name: "idle confirms the WAL end", idle: true, walEnd: 0x200, want: 0x200, wantMsg: true},
+		{name: "idle reply confirms the WAL end", idle: true, walEnd: 0x200, reply: true, want: 0x200, wantMsg: true},
+		{name: "busy reply keeps the flushed position", walEnd: 0x200, reply: true, want: 0x100, wantMsg: true},
+		{name: "busy without reply request sends nothing", walEnd: 0x200, want: 0x100},
+		{name: "idle behind the flushed position sends nothing", idle: true, walEnd: 0x80, want: 0x100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			c := &Conn{conn: client, rd: bufio.NewReader(client), messages: make(chan message), done: make(chan struct{}), flushed: 0x100}
+			defer c.Close()
+			defer server.Close() // Before Close, which would wait to send its Terminate message
+			go c.readMessages()
+			c.SetIdle(tt.idle)
+
+			status := make(chan pgoutput.LSN, 1)
+			go func() {
+				defer close(status)
+				if _, err := server.Write(keepalive(tt.walEnd, tt.reply)); err != nil {
+					return
+				}
+				// Standby status update: CopyData 'r' with the written position first
+				msg := make([]byte, 5+1+8*4+1)
+				if _, err := server.Read(msg); err != nil {
+					return
+				}
+				status <- pgoutput.LSN(binary.BigEndian.Uint64(msg[6:]))
+			}()
+
+			data, err := c.Receive(context.Background(), 50*time.Millisecond)
+			if err != nil || data != nil {
+				t.Fatalf("Receive() = %v, %v, want nil, nil", data, err)
+			}
+			if c.flushed != tt.want {
+				t.Errorf("flushed = %s, want %s", c.flushed, tt.want)
+			}
+			select {
+			case got, ok := <-status:
+				if !ok || !tt.wantMsg {
+					t.Fatalf("status sent = %t, want %t", ok, tt.wantMsg)
+				}
+				if got != tt.want {
+					t.Errorf("status = %s, want %s", got, tt.want)
+				}
+			case <-time.After(50 * time.Millisecond):
+				if tt.wantMsg {
+					t.Errorf("no status sent")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package replconn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scramMechanism is the SASL mechanism PostgreSQL offers for password
+// authentication; channel binding is not used
+const scramMechanism = "SCRAM-SHA-256"
+
+// scram carries the state of a SCRAM-SHA-256 exchange (RFC 5802, RFC 7677)
+type scram struct {
+	user        string // Ignored by PostgreSQL, which uses the startup user
+	password    string
+	clientNonce string
+
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+// newSCRAM starts an exchange with a random client nonce
+func newSCRAM(user, password string) (*scram, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scram{user: user, password: password, clientNonce: base64.StdEncoding.EncodeToString(nonce)}, nil
+}
+
+// clientFirst returns the client-first-message
+func (s *scram) clientFirst() string {
+	s.clientFirstBare = "n=" + s.user + ",r=" + s.clientNonce
+	return "n,," + s.clientFirstBare
+}
+
+// clientFinal answers the server-first-message with the client proof
+func (s *scram) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, s.clientNonce) || len(nonce) == len(s.clientNonce) {
+		return "", fmt.Errorf("server nonce does not extend the client nonce")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || len(saltBytes) == 0 {
+		return "", fmt.Errorf("invalid salt in server-first-message")
+	}
+	if iterations <= 0 {
+		return "", fmt.Errorf("invalid iteration count in server-first-message")
+	}
+
+	s.saltedPassword = pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws,r=" + nonce // biws is base64 of the "n,," header
+	s.authMessage = s.clientFirstBare + "," + serverFirst + "," + withoutProof
+	signature := hmacSHA256(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks the server signature, which proves that the
+// server knows the password as well
+func (s *scram) verifyServerFinal(serverFinal string) error {
+	if strings.HasPrefix(serverFinal, "e=") {
+		return fmt.Errorf("server rejected authentication: %s", serverFinal[2:])
+	}
+	if !strings.HasPrefix(serverFinal, "v=") {
+		return fmt.Errorf("invalid server-final-message")
+	}
+	serverKey := hmacSHA256(s.saltedPassword, "Server Key")
+	expected := base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, s.authMessage))
+	if !hmac.Equal([]byte(serverFinal[2:]), []byte(expected)) {
+		return fmt.Errorf("server signature does not match")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a 32 byte key, a single PBKDF2 block
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
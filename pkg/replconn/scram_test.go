@@ -0,0 +1,65 @@
+package replconn
+
+import (
+	"testing"
+)
+
+func TestSCRAM(t *testing.T) {
+	// Example exchange of RFC 7677, section 3
+	tests := []struct {
+		name        string
+		serverFirst string
+		clientFinal string
+		serverFinal string
+		wantErr     bool
+	}{
+		{
+			name:        "rfc 7677 example",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+		{
+			name:        "wrong server signature",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+			wantErr:     true,
+		},
+		{
+			name:        "server error",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "e=invalid-proof",
+			wantErr:     true,
+		},
+		{
+			name:        "foreign nonce",
+			serverFirst: "r=somethingElse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &scram{user: "user", password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+			if got, want := s.clientFirst(), "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"; got != want {
+				t.Fatalf("clientFirst() = %q, want %q", got, want)
+			}
+			final, err := s.clientFinal(tt.serverFirst)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("clientFinal() error = %v", err)
+				}
+				return
+			}
+			if final != tt.clientFinal {
+				t.Fatalf("clientFinal() = %q, want %q", final, tt.clientFinal)
+			}
+			err = s.verifyServerFinal(tt.serverFinal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyServerFinal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
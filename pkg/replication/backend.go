@@ -0,0 +1,490 @@
+package replication
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Replication backend names accepted by SetBackend
+const (
+	BackendAuto        = "auto"
+	BackendAivenExtras = "aiven_extras"
+	BackendNative      = "native"
+	BackendPglogical   = "pglogical"
+)
+
+// queryer runs statements on a connection pool or inside a transaction
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Backend creates and removes the publication and subscription of a
+// migration. Existing objects with the same names are replaced.
+type Backend interface {
+	// Name returns the backend name, e.g. BackendNative
+	Name() string
+	// Prepare installs what the backend needs on the source and target, or
+	// checks that the users may create what pub needs
+	Prepare(srcDB, tgtDB *sql.DB, pub PublicationConfig) error
+	// CreatePublication (re)creates the publication on the source, which
+	// may be a transaction. The tables of pub are resolved to quoted
+	// schema-qualified names.
+	CreatePublication(srcDB queryer, names Names, pub PublicationConfig, publishViaRoot bool) error
+	// CreateSubscription (re)creates the subscription, and with it the
+	// replication slot, on the target
+	CreateSubscription(tgtDB *sql.DB, names Names, sourceConnStr string) error
+	// ReconcilePublication adds tables to and removes tables from the
+	// existing publication so that it matches pub, returning the changed
+	// tables. The subscription must be refreshed afterwards.
+	ReconcilePublication(srcDB *sql.DB, names Names, pub PublicationConfig, publishViaRoot bool) (added, removed []string, err error)
+	// RefreshSubscription makes the subscription pick up tables created on
+	// the source since it was set up, copying their existing rows
+	RefreshSubscription(srcDB, tgtDB *sql.DB, names Names) error
+	// Status reports the state of the subscription and its tables
+	Status(tgtDB *sql.DB, names Names) (*Status, error)
+	// DisableSubscription stops the subscription's apply worker, if the
+	// subscription exists, so its slot on the source becomes inactive
+	DisableSubscription(tgtDB *sql.DB, names Names) error
+	// DropSubscription disables and drops the subscription, if it exists,
+	// without connecting to the source. Its replication slot may be left
+	// on the source.
+	DropSubscription(tgtDB *sql.DB, names Names) error
+	// DropPublication drops the publication, if it exists
+	DropPublication(srcDB *sql.DB, names Names) error
+}
+
+// SetBackend selects the replication backend (see Backend*). With
+// BackendAuto, the backend is detected from the extensions and privileges
+// available when replication is set up.
+func (r *Replicator) SetBackend(name string) error {
+	switch name {
+	case "", BackendAuto:
+		r.backendName = BackendAuto
+		return nil
+	case BackendAivenExtras, BackendNative, BackendPglogical:
+		r.backendName = name
+		return nil
+	}
+	return fmt.Errorf("unknown replication backend %q (expected %s, %s, %s or %s)",
+		name, BackendAuto, BackendAivenExtras, BackendNative, BackendPglogical)
+}
+
+// backend returns the configured backend, detecting it if needed
+func (r *Replicator) backend(srcDB, tgtDB *sql.DB) (Backend, error) {
+	name := r.backendName
+	if name == BackendAuto {
+		detected, err := DetectBackend(srcDB, tgtDB, r.publication)
+		if err != nil {
+			return nil, err
+		}
+		name = detected
+	}
+
+	switch name {
+	case BackendAivenExtras:
+		return aivenExtrasBackend{}, nil
+	case BackendPglogical:
+		return pglogicalBackend{sourceDSN: r.source.ConnectionString(), targetDSN: r.target.ConnectionString(), tables: r.publication.Tables}, nil
+	}
+	return nativeBackend{}, nil
+}
+
+// DetectBackend picks the backend to use for the given databases: pglogical
+// for sources older than PostgreSQL 10, aiven_extras when it is already
+// installed on both sides, native replication when the users have the
+// privileges for it (which depend on whether pub lists tables), and otherwise
+// aiven_extras when it can be installed on both sides
+func DetectBackend(srcDB, tgtDB *sql.DB, pub PublicationConfig) (string, error) {
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return "", fmt.Errorf("failed to check source server version: %v", err)
+	}
+	if version < 100000 {
+		log.Printf("Using the pglogical replication backend (source runs server version %d, without native logical replication).", version)
+		return BackendPglogical, nil
+	}
+
+	srcInstalled, err := checkExtensionInstalled(srcDB, "aiven_extras")
+	if err != nil {
+		return "", fmt.Errorf("failed to check aiven_extras extension on source: %v", err)
+	}
+	tgtInstalled, err := checkExtensionInstalled(tgtDB, "aiven_extras")
+	if err != nil {
+		return "", fmt.Errorf("failed to check aiven_extras extension on target: %v", err)
+	}
+	if srcInstalled && tgtInstalled {
+		log.Println("Using the aiven_extras replication backend (extension installed on source and target).")
+		return BackendAivenExtras, nil
+	}
+
+	missing, err := nativePrivilegesMissing(srcDB, tgtDB, pub)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) == 0 {
+		log.Println("Using the native replication backend (CREATE PUBLICATION / CREATE SUBSCRIPTION).")
+		return BackendNative, nil
+	}
+
+	srcAvailable, err := checkExtensionAvailable(srcDB, "aiven_extras")
+	if err != nil {
+		return "", fmt.Errorf("failed to check available extensions on source: %v", err)
+	}
+	tgtAvailable, err := checkExtensionAvailable(tgtDB, "aiven_extras")
+	if err != nil {
+		return "", fmt.Errorf("failed to check available extensions on target: %v", err)
+	}
+	if srcAvailable && tgtAvailable {
+		log.Println("Using the aiven_extras replication backend (extension available on source and target).")
+		return BackendAivenExtras, nil
+	}
+
+	return "", fmt.Errorf("no replication backend is usable: aiven_extras is not available on both databases, and native replication needs %s",
+		strings.Join(missing, "; "))
+}
+
+// checkExtensionAvailable reports whether an extension can be created in the database
+func checkExtensionAvailable(db *sql.DB, extName string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_available_extensions WHERE name = $1);", extName).Scan(&exists)
+	return exists, err
+}
+
+// nativePrivilegesMissing lists the privileges that native replication needs
+// and the connected users lack. Publishing all tables requires a superuser
+// on the source, publishing a table list CREATE on the source database and
+// ownership of the tables; creating subscriptions requires a superuser on
+// the target, or membership in pg_create_subscription from PostgreSQL 16.
+func nativePrivilegesMissing(srcDB, tgtDB *sql.DB, pub PublicationConfig) ([]string, error) {
+	var missing []string
+
+	if len(pub.Tables) == 0 {
+		var srcSuper bool
+		if err := srcDB.QueryRow("SELECT rolsuper FROM pg_roles WHERE rolname = current_user;").Scan(&srcSuper); err != nil {
+			return nil, fmt.Errorf("failed to check source user privileges: %v", err)
+		}
+		if !srcSuper {
+			missing = append(missing, "a superuser on the source to create a publication for all tables")
+		}
+	} else {
+		var canCreate bool
+		if err := srcDB.QueryRow("SELECT has_database_privilege(current_database(), 'CREATE');").Scan(&canCreate); err != nil {
+			return nil, fmt.Errorf("failed to check source user privileges: %v", err)
+		}
+		if !canCreate {
+			missing = append(missing, "CREATE on the source database to create a publication")
+		}
+
+		tables := make([]string, len(pub.Tables))
+		for i, t := range pub.Tables {
+			tables[i] = t.Table
+		}
+		// Tables missing on the source are reported when the names are resolved
+		rows, err := srcDB.Query(`
+			SELECT t FROM unnest($1::text[]) AS t
+			JOIN pg_class c ON c.oid = to_regclass(t)
+			WHERE NOT pg_has_role(current_user, c.relowner, 'USAGE')
+			ORDER BY 1;
+		`, pq.Array(tables))
+		if err != nil {
+			return nil, fmt.Errorf("failed to check ownership of published tables: %v", err)
+		}
+		var notOwned []string
+		for rows.Next() {
+			var table string
+			if err := rows.Scan(&table); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			notOwned = append(notOwned, table)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to check ownership of published tables: %v", err)
+		}
+		if len(notOwned) > 0 {
+			missing = append(missing, "ownership of the published tables on the source (not owned: "+strings.Join(notOwned, ", ")+")")
+		}
+	}
+
+	var tgtAllowed bool
+	query := `
+		SELECT rolsuper OR (current_setting('server_version_num')::int >= 160000
+		                    AND pg_has_role(current_user, 'pg_create_subscription', 'USAGE'))
+		FROM pg_roles WHERE rolname = current_user;
+	`
+	if err := tgtDB.QueryRow(query).Scan(&tgtAllowed); err != nil {
+		return nil, fmt.Errorf("failed to check target user privileges: %v", err)
+	}
+	if !tgtAllowed {
+		missing = append(missing, "a superuser (or pg_create_subscription member on PostgreSQL 16+) on the target to create a subscription")
+	}
+	return missing, nil
+}
+
+// subscriptionExists reports whether a subscription exists in the target database
+func subscriptionExists(tgtDB *sql.DB, name string) (bool, error) {
+	var exists bool
+	err := tgtDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_subscription WHERE subname = $1 AND subdbid = (SELECT oid FROM pg_database WHERE datname = current_database()));", name).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up subscription '%s': %v", name, err)
+	}
+	return exists, nil
+}
+
+// dropSubscription drops the subscription with the given name, if it exists
+func dropSubscription(tgtDB *sql.DB, name string) error {
+	if _, err := tgtDB.Exec(fmt.Sprintf("DROP SUBSCRIPTION IF EXISTS %s;", pq.QuoteIdentifier(name))); err != nil {
+		return fmt.Errorf("failed to drop existing subscription: %v", err)
+	}
+	log.Printf("Dropped existing subscription '%s' (if any) on target database.", name)
+	return nil
+}
+
+// dropPublication drops the publication with the given name, if it exists
+func dropPublication(srcDB queryer, name string) error {
+	if _, err := srcDB.Exec(fmt.Sprintf("DROP PUBLICATION IF EXISTS %s;", pq.QuoteIdentifier(name))); err != nil {
+		return fmt.Errorf("failed to drop existing publication: %v", err)
+	}
+	log.Printf("Dropped existing publication '%s' (if any) on source database.", name)
+	return nil
+}
+
+// aivenExtrasBackend creates the replication objects through the functions of
+// the aiven_extras extension, which lets non-superusers on Aiven create them
+type aivenExtrasBackend struct{}
+
+func (aivenExtrasBackend) Name() string { return BackendAivenExtras }
+
+func (aivenExtrasBackend) Prepare(srcDB, tgtDB *sql.DB, _ PublicationConfig) error {
+	for _, side := range []struct {
+		name string
+		db   *sql.DB
+	}{{"source", srcDB}, {"target", tgtDB}} {
+		installed, err := checkExtensionInstalled(side.db, "aiven_extras")
+		if err != nil {
+			return fmt.Errorf("failed to check aiven_extras extension on %s: %v", side.name, err)
+		}
+		if !installed {
+			log.Printf("aiven_extras extension not found on %s database, attempting to install it...", side.name)
+			if err := installExtension(side.db, "aiven_extras"); err != nil {
+				return fmt.Errorf("failed to install aiven_extras extension on %s: %v", side.name, err)
+			}
+			log.Printf("Successfully installed aiven_extras extension on %s database.", side.name)
+		}
+	}
+	return nil
+}
+
+// CreatePublication creates the publication through the Aiven Extras
+// functions, which take no column lists, row filters or
+// publish_via_partition_root, so these are set on the publication afterwards
+func (aivenExtrasBackend) CreatePublication(srcDB queryer, names Names, pub PublicationConfig, publishViaRoot bool) error {
+	if err := dropPublication(srcDB, names.Publication); err != nil {
+		return err
+	}
+
+	operations := strings.ToUpper(strings.ReplaceAll(publishedOperations(pub), " ", ""))
+	if len(pub.Tables) == 0 {
+		createPubQuery := `
+			SELECT * FROM aiven_extras.pg_create_publication_for_all_tables($1, $2);
+		`
+		if _, err := srcDB.Exec(createPubQuery, names.Publication, operations); err != nil {
+			return fmt.Errorf("failed to create publication on source: %v", err)
+		}
+	} else {
+		tables := make([]string, len(pub.Tables))
+		filtered := false
+		for i, t := range pub.Tables {
+			tables[i] = t.Table
+			filtered = filtered || t.Filtered()
+		}
+		createPubQuery := `
+			SELECT * FROM aiven_extras.pg_create_publication($1, $2, VARIADIC $3::text[]);
+		`
+		if _, err := srcDB.Exec(createPubQuery, names.Publication, operations, pq.Array(tables)); err != nil {
+			return fmt.Errorf("failed to create publication on source: %v", err)
+		}
+
+		if filtered {
+			alterPubQuery := fmt.Sprintf("ALTER PUBLICATION %s SET %s;", pq.QuoteIdentifier(names.Publication),
+				publicationTableList(pub.Tables))
+			if _, err := srcDB.Exec(alterPubQuery); err != nil {
+				return fmt.Errorf("failed to set column lists and row filters on publication (the migration user must own the publication): %v", err)
+			}
+		}
+	}
+
+	if publishViaRoot {
+		alterPubQuery := fmt.Sprintf("ALTER PUBLICATION %s SET (publish_via_partition_root = true);", pq.QuoteIdentifier(names.Publication))
+		if _, err := srcDB.Exec(alterPubQuery); err != nil {
+			return fmt.Errorf("failed to enable publish_via_partition_root on publication (the migration user must own the publication): %v", err)
+		}
+	}
+	return validatePublishedIdentity(srcDB, names, pub)
+}
+
+// ReconcilePublication alters the publication directly, which requires the
+// migration user to own it
+func (aivenExtrasBackend) ReconcilePublication(srcDB *sql.DB, names Names, pub PublicationConfig, publishViaRoot bool) ([]string, []string, error) {
+	return reconcilePublication(srcDB, names, pub, publishViaRoot)
+}
+
+func (aivenExtrasBackend) CreateSubscription(tgtDB *sql.DB, names Names, sourceConnStr string) error {
+	if err := dropSubscription(tgtDB, names.Subscription); err != nil {
+		return err
+	}
+
+	createSubQuery := `
+		SELECT * FROM aiven_extras.pg_create_subscription($1, $2, $3, $4, true, true);
+	`
+	if _, err := tgtDB.Exec(createSubQuery, names.Subscription, sourceConnStr, names.Publication, names.Slot); err != nil {
+		return fmt.Errorf("failed to create subscription on target: %v", err)
+	}
+	return nil
+}
+
+func (aivenExtrasBackend) RefreshSubscription(srcDB, tgtDB *sql.DB, names Names) error {
+	if _, err := tgtDB.Exec("SELECT * FROM aiven_extras.pg_alter_subscription_refresh_publication($1, true);", names.Subscription); err != nil {
+		return fmt.Errorf("failed to refresh subscription '%s': %v", names.Subscription, err)
+	}
+	return nil
+}
+
+func (aivenExtrasBackend) Status(tgtDB *sql.DB, names Names) (*Status, error) {
+	return nativeStatus(tgtDB, BackendAivenExtras, names)
+}
+
+func (aivenExtrasBackend) DisableSubscription(tgtDB *sql.DB, names Names) error {
+	exists, err := subscriptionExists(tgtDB, names.Subscription)
+	if err != nil || !exists {
+		return err
+	}
+	if _, err := tgtDB.Exec("SELECT * FROM aiven_extras.pg_alter_subscription_disable($1);", names.Subscription); err != nil {
+		return fmt.Errorf("failed to disable subscription '%s': %v", names.Subscription, err)
+	}
+	log.Printf("Disabled subscription '%s' on target database.", names.Subscription)
+	return nil
+}
+
+// DropSubscription uses pg_drop_subscription, which disables the
+// subscription and detaches it from its slot before dropping it
+func (aivenExtrasBackend) DropSubscription(tgtDB *sql.DB, names Names) error {
+	exists, err := subscriptionExists(tgtDB, names.Subscription)
+	if err != nil || !exists {
+		return err
+	}
+	if _, err := tgtDB.Exec("SELECT * FROM aiven_extras.pg_drop_subscription($1);", names.Subscription); err != nil {
+		return fmt.Errorf("failed to drop subscription '%s': %v", names.Subscription, err)
+	}
+	log.Printf("Dropped subscription '%s' on target database.", names.Subscription)
+	return nil
+}
+
+func (aivenExtrasBackend) DropPublication(srcDB *sql.DB, names Names) error {
+	return dropPublication(srcDB, names.Publication)
+}
+
+// nativeBackend uses CREATE PUBLICATION and CREATE SUBSCRIPTION directly
+type nativeBackend struct{}
+
+func (nativeBackend) Name() string { return BackendNative }
+
+func (nativeBackend) Prepare(srcDB, tgtDB *sql.DB, pub PublicationConfig) error {
+	missing, err := nativePrivilegesMissing(srcDB, tgtDB, pub)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("native replication needs %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+func (nativeBackend) CreatePublication(srcDB queryer, names Names, pub PublicationConfig, publishViaRoot bool) error {
+	if err := dropPublication(srcDB, names.Publication); err != nil {
+		return err
+	}
+
+	options := fmt.Sprintf("publish = '%s'", publishedOperations(pub))
+	if publishViaRoot {
+		options += ", publish_via_partition_root = true"
+	}
+	createPubQuery := fmt.Sprintf("CREATE PUBLICATION %s %s WITH (%s);", pq.QuoteIdentifier(names.Publication), publicationTarget(pub), options)
+	if _, err := srcDB.Exec(createPubQuery); err != nil {
+		return fmt.Errorf("failed to create publication on source: %v", err)
+	}
+	return validatePublishedIdentity(srcDB, names, pub)
+}
+
+func (nativeBackend) ReconcilePublication(srcDB *sql.DB, names Names, pub PublicationConfig, publishViaRoot bool) ([]string, []string, error) {
+	return reconcilePublication(srcDB, names, pub, publishViaRoot)
+}
+
+func (nativeBackend) CreateSubscription(tgtDB *sql.DB, names Names, sourceConnStr string) error {
+	if err := dropSubscription(tgtDB, names.Subscription); err != nil {
+		return err
+	}
+
+	createSubQuery := fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s WITH (slot_name = %s, create_slot = true, copy_data = true, enabled = true);",
+		pq.QuoteIdentifier(names.Subscription), pq.QuoteLiteral(sourceConnStr),
+		pq.QuoteIdentifier(names.Publication), pq.QuoteLiteral(names.Slot))
+	if _, err := tgtDB.Exec(createSubQuery); err != nil {
+		return fmt.Errorf("failed to create subscription on target: %v", err)
+	}
+	return nil
+}
+
+func (nativeBackend) RefreshSubscription(srcDB, tgtDB *sql.DB, names Names) error {
+	if _, err := tgtDB.Exec(fmt.Sprintf("ALTER SUBSCRIPTION %s REFRESH PUBLICATION WITH (copy_data = true);", pq.QuoteIdentifier(names.Subscription))); err != nil {
+		return fmt.Errorf("failed to refresh subscription '%s': %v", names.Subscription, err)
+	}
+	return nil
+}
+
+func (nativeBackend) Status(tgtDB *sql.DB, names Names) (*Status, error) {
+	return nativeStatus(tgtDB, BackendNative, names)
+}
+
+func (nativeBackend) DisableSubscription(tgtDB *sql.DB, names Names) error {
+	exists, err := subscriptionExists(tgtDB, names.Subscription)
+	if err != nil || !exists {
+		return err
+	}
+	if _, err := tgtDB.Exec(fmt.Sprintf("ALTER SUBSCRIPTION %s DISABLE;", pq.QuoteIdentifier(names.Subscription))); err != nil {
+		return fmt.Errorf("failed to disable subscription '%s': %v", names.Subscription, err)
+	}
+	log.Printf("Disabled subscription '%s' on target database.", names.Subscription)
+	return nil
+}
+
+// DropSubscription detaches the subscription from its slot first, as
+// DROP SUBSCRIPTION would otherwise connect to the source to drop the slot
+func (nativeBackend) DropSubscription(tgtDB *sql.DB, names Names) error {
+	exists, err := subscriptionExists(tgtDB, names.Subscription)
+	if err != nil || !exists {
+		return err
+	}
+	sub := pq.QuoteIdentifier(names.Subscription)
+	for _, stmt := range []string{
+		fmt.Sprintf("ALTER SUBSCRIPTION %s DISABLE;", sub),
+		fmt.Sprintf("ALTER SUBSCRIPTION %s SET (slot_name = NONE);", sub),
+		fmt.Sprintf("DROP SUBSCRIPTION %s;", sub),
+	} {
+		if _, err := tgtDB.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to drop subscription '%s': %v", names.Subscription, err)
+		}
+	}
+	log.Printf("Dropped subscription '%s' on target database.", names.Subscription)
+	return nil
+}
+
+func (nativeBackend) DropPublication(srcDB *sql.DB, names Names) error {
+	return dropPublication(srcDB, names.Publication)
+}
@@ -0,0 +1,807 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"pg-migration/pkg/pgoutput"
+)
+
+// Record formats of the change export
+const (
+	// CDCFormatPlain writes one flat record per change
+	CDCFormatPlain = "plain"
+	// CDCFormatDebezium wraps each change in a Debezium-style key/value
+	// envelope with before, after, source and op
+	CDCFormatDebezium = "debezium"
+)
+
+// debeziumUnavailable stands for an unchanged TOASTed value that was not sent,
+// as in Debezium's PostgreSQL connector
+const debeziumUnavailable = "__debezium_unavailable_value"
+
+// CDCOptions control ExportChanges
+type CDCOptions struct {
+	Dir            string // Directory the NDJSON files are written to
+	Format         string // CDCFormatPlain or CDCFormatDebezium
+	Slot           string // Export slot, default: the migration slot name with a _cdc suffix
+	MaxFileSize    int64  // Start a new file after this many bytes, 0 for no limit
+	RotateInterval time.Duration
+	PollInterval   time.Duration
+	MaxChanges     int
+}
+
+// cdcSlotName returns the default export slot of a migration slot. The
+// subscription keeps the migration slot itself busy, so the export decodes
+// the same publication through a slot of its own. Slot names longer than 59
+// characters are shortened, with a hash of the full name to keep them apart,
+// so the suffix fits in the 63 character limit.
+func cdcSlotName(slot string) string {
+	const suffix = "_cdc"
+	if len(slot)+len(suffix) <= 63 {
+		return slot + suffix
+	}
+	sum := sha256.Sum256([]byte(slot))
+	hash := hex.EncodeToString(sum[:4])
+	return slot[:63-len(suffix)-len(hash)-1] + "_" + hash + suffix
+}
+
+// cdcRelation names the table of a change
+type cdcRelation struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+}
+
+// cdcRecord is a change in the plain format. Column values are in their text
+// representation; null values are JSON null, and unchanged TOASTed values,
+// which are not sent, are left out of new.
+type cdcRecord struct {
+	LSN             string             `json:"lsn"` // End of the transaction; replay resumes after it
+	CommitLSN       string             `json:"commit_lsn"`
+	XID             uint32             `json:"xid"`
+	CommitTime      time.Time          `json:"commit_time"`
+	Relation        cdcRelation        `json:"relation"`
+	Op              string             `json:"op"`
+	Key             map[string]*string `json:"key,omitempty"` // Replica identity before the change; absent with REPLICA IDENTITY FULL
+	New             map[string]*string `json:"new,omitempty"`
+	Old             map[string]*string `json:"old,omitempty"` // Whole old row, with REPLICA IDENTITY FULL
+	Cascade         bool               `json:"cascade,omitempty"`
+	RestartIdentity bool               `json:"restart_identity,omitempty"`
+}
+
+// debeziumSource describes where a Debezium-style change came from
+type debeziumSource struct {
+	Connector string `json:"connector"`
+	Name      string `json:"name"` // Migration ID
+	TsMs      int64  `json:"ts_ms"`
+	DB        string `json:"db"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	TxID      uint32 `json:"txId"`
+	LSN       uint64 `json:"lsn"` // End of the transaction
+}
+
+// debeziumValue is the value of a Debezium-style change
+type debeziumValue struct {
+	Before map[string]*string `json:"before"`
+	After  map[string]*string `json:"after"`
+	Source debeziumSource     `json:"source"`
+	Op     string             `json:"op"` // c, u, d or t
+	TsMs   int64              `json:"ts_ms"`
+}
+
+// debeziumEvent is a change in the Debezium-style format
+type debeziumEvent struct {
+	Key   map[string]*string `json:"key"`
+	Value debeziumValue      `json:"value"`
+}
+
+// tupleMap returns the values of a tuple by column name. Unchanged TOASTed
+// values are left out, or set to unavailable when it is not empty.
+func tupleMap(rel *pgoutput.Relation, tuple pgoutput.Tuple, unavailable string) map[string]*string {
+	if tuple == nil {
+		return nil
+	}
+	values := map[string]*string{}
+	for i, v := range tuple {
+		if i >= len(rel.Columns) {
+			break
+		}
+		switch v.Kind {
+		case pgoutput.ValueNull:
+			values[rel.Columns[i].Name] = nil
+		case pgoutput.ValueUnchanged:
+			if unavailable != "" {
+				values[rel.Columns[i].Name] = &unavailable
+			}
+		default:
+			s := string(v.Data)
+			values[rel.Columns[i].Name] = &s
+		}
+	}
+	return values
+}
+
+// changeKey returns the replica identity of the row a change applies to, or
+// nil for relations without a key
+func changeKey(c change) map[string]*string {
+	keys := keyColumns(c.Relation)
+	if keys == nil {
+		return nil
+	}
+	row := c.Old
+	if row == nil {
+		row = c.New
+	}
+	key := map[string]*string{}
+	for _, i := range keys {
+		if i < len(row) && row[i].Kind == pgoutput.ValueText {
+			s := string(row[i].Data)
+			key[c.Relation.Columns[i].Name] = &s
+		} else {
+			key[c.Relation.Columns[i].Name] = nil
+		}
+	}
+	return key
+}
+
+// cdcRecords formats the changes of a transaction as NDJSON lines. A
+// truncate becomes one record per table, as in Debezium; replay merges them
+// again.
+func cdcRecords(txn *transaction, format, migrationID, database string) ([][]byte, error) {
+	var lines [][]byte
+	add := func(v interface{}) error {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+		return nil
+	}
+
+	for _, c := range txn.Changes {
+		relations := []*pgoutput.Relation{c.Relation}
+		if c.Op == opTruncate {
+			relations = c.Truncated
+		}
+		for _, rel := range relations {
+			var err error
+			if format == CDCFormatDebezium {
+				event := debeziumEvent{Value: debeziumValue{
+					Source: debeziumSource{
+						Connector: "postgresql",
+						Name:      migrationID,
+						TsMs:      txn.CommitTime.UnixMilli(),
+						DB:        database,
+						Schema:    rel.Namespace,
+						Table:     rel.Name,
+						TxID:      txn.XID,
+						LSN:       uint64(txn.EndLSN),
+					},
+					Op:   map[string]string{opInsert: "c", opUpdate: "u", opDelete: "d", opTruncate: "t"}[c.Op],
+					TsMs: time.Now().UnixMilli(),
+				}}
+				if c.Op != opTruncate {
+					event.Key = changeKey(c)
+					event.Value.Before = tupleMap(rel, c.Old, debeziumUnavailable)
+					event.Value.After = tupleMap(rel, c.New, debeziumUnavailable)
+				}
+				err = add(event)
+			} else {
+				record := cdcRecord{
+					LSN:        txn.EndLSN.String(),
+					CommitLSN:  txn.CommitLSN.String(),
+					XID:        txn.XID,
+					CommitTime: txn.CommitTime,
+					Relation:   cdcRelation{Schema: rel.Namespace, Table: rel.Name},
+					Op:         c.Op,
+				}
+				if c.Op == opTruncate {
+					record.Cascade, record.RestartIdentity = c.Cascade, c.RestartIdentity
+				} else {
+					record.Key = changeKey(c)
+					record.New = tupleMap(rel, c.New, "")
+					if !c.OldIsKey {
+						record.Old = tupleMap(rel, c.Old, "")
+					}
+				}
+				err = add(record)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to format change of %s: %v", qualifiedName(rel), err)
+			}
+		}
+	}
+	return lines, nil
+}
+
+// cdcEntry is a change read back from an export file
+type cdcEntry struct {
+	endLSN    pgoutput.LSN
+	commitLSN pgoutput.LSN
+	xid       uint32
+	change    change
+}
+
+// recordRelation builds the description of a relation from the columns a
+// record carries. Without key columns, rows are matched by all old values.
+func recordRelation(schema, table string, key map[string]*string, rows ...map[string]*string) *pgoutput.Relation {
+	seen := map[string]bool{}
+	var names []string
+	for _, row := range append(rows, key) {
+		for name := range row {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	rel := &pgoutput.Relation{Namespace: schema, Name: table, ReplicaIdentity: 'f'}
+	if len(key) > 0 {
+		rel.ReplicaIdentity = 'd'
+	}
+	for _, name := range names {
+		_, isKey := key[name]
+		rel.Columns = append(rel.Columns, pgoutput.Column{Name: name, Key: isKey})
+	}
+	return rel
+}
+
+// recordTuple returns the values of a record row in relation column order.
+// Columns the row lacks, or marks unavailable, are unchanged.
+func recordTuple(rel *pgoutput.Relation, row map[string]*string) pgoutput.Tuple {
+	if row == nil {
+		return nil
+	}
+	tuple := make(pgoutput.Tuple, len(rel.Columns))
+	for i, column := range rel.Columns {
+		v, ok := row[column.Name]
+		switch {
+		case !ok || (v != nil && *v == debeziumUnavailable):
+			tuple[i] = pgoutput.Value{Kind: pgoutput.ValueUnchanged}
+		case v == nil:
+			tuple[i] = pgoutput.Value{Kind: pgoutput.ValueNull}
+		default:
+			tuple[i] = pgoutput.Value{Kind: pgoutput.ValueText, Data: []byte(*v)}
+		}
+	}
+	return tuple
+}
+
+// parseCDCLine reads a record of either format back into a change
+func parseCDCLine(line []byte) (*cdcEntry, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, err
+	}
+
+	var entry cdcEntry
+	var schema, table, op string
+	var key, before, after map[string]*string
+	if _, ok := fields["value"]; ok {
+		var event debeziumEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, err
+		}
+		entry.endLSN = pgoutput.LSN(event.Value.Source.LSN)
+		entry.xid = event.Value.Source.TxID
+		schema, table = event.Value.Source.Schema, event.Value.Source.Table
+		key, before, after = event.Key, event.Value.Before, event.Value.After
+		op = map[string]string{"c": opInsert, "r": opInsert, "u": opUpdate, "d": opDelete, "t": opTruncate}[event.Value.Op]
+	} else {
+		var record cdcRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, err
+		}
+		var err error
+		if entry.endLSN, err = pgoutput.ParseLSN(record.LSN); err != nil {
+			return nil, err
+		}
+		if record.CommitLSN != "" {
+			if entry.commitLSN, err = pgoutput.ParseLSN(record.CommitLSN); err != nil {
+				return nil, err
+			}
+		}
+		entry.xid = record.XID
+		schema, table = record.Relation.Schema, record.Relation.Table
+		key, before, after = record.Key, record.Old, record.New
+		op = record.Op
+		entry.change.Cascade, entry.change.RestartIdentity = record.Cascade, record.RestartIdentity
+	}
+
+	rel := recordRelation(schema, table, key, before, after)
+	entry.change.Op = op
+	switch op {
+	case opInsert:
+		entry.change.Relation, entry.change.New = rel, recordTuple(rel, after)
+	case opUpdate, opDelete:
+		entry.change.Relation = rel
+		if op == opUpdate {
+			entry.change.New = recordTuple(rel, after)
+		}
+		if before != nil && rel.ReplicaIdentity == 'f' {
+			entry.change.Old = recordTuple(rel, before)
+		} else {
+			entry.change.Old, entry.change.OldIsKey = recordTuple(rel, key), true
+		}
+		if entry.change.Old == nil {
+			return nil, fmt.Errorf("%s of %s.%s carries neither key nor old row", op, schema, table)
+		}
+	case opTruncate:
+		entry.change.Truncated = []*pgoutput.Relation{rel}
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op)
+	}
+	return &entry, nil
+}
+
+// cdcWriter writes NDJSON files that rotate at transaction boundaries. The
+// open file has a .partial suffix until it is complete.
+type cdcWriter struct {
+	dir, slot      string
+	maxSize        int64
+	rotateInterval time.Duration
+
+	file   *os.File
+	buf    *bufio.Writer
+	path   string
+	size   int64
+	opened time.Time
+}
+
+// rotateIfDue completes the open file once it is large or old enough
+func (w *cdcWriter) rotateIfDue() error {
+	if w.file == nil {
+		return nil
+	}
+	if (w.maxSize > 0 && w.size >= w.maxSize) || (w.rotateInterval > 0 && time.Since(w.opened) >= w.rotateInterval) {
+		return w.close()
+	}
+	return nil
+}
+
+// write appends the records of a transaction, starting a new file named
+// after its end LSN if none is open, so file names sort in LSN order. Files
+// are only rotated between batches, once the slot has been advanced past
+// everything they hold.
+func (w *cdcWriter) write(txn *transaction, lines [][]byte) error {
+	if w.file == nil {
+		w.path = filepath.Join(w.dir, fmt.Sprintf("%s.%016X.ndjson.partial", w.slot, uint64(txn.EndLSN)))
+		file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to create change file: %v", err)
+		}
+		w.file, w.buf, w.size, w.opened = file, bufio.NewWriter(file), 0, time.Now()
+	}
+	for _, line := range lines {
+		if _, err := w.buf.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("failed to write change file: %v", err)
+		}
+		w.size += int64(len(line)) + 1
+	}
+	return nil
+}
+
+// sync flushes the open file to disk
+func (w *cdcWriter) sync() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.buf.Flush(); err != nil {
+		return fmt.Errorf("failed to write change file: %v", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync change file: %v", err)
+	}
+	return nil
+}
+
+// close completes the open file by removing its .partial suffix
+func (w *cdcWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close change file: %v", err)
+	}
+	w.file = nil
+	final := strings.TrimSuffix(w.path, ".partial")
+	if err := os.Rename(w.path, final); err != nil {
+		return fmt.Errorf("failed to complete change file: %v", err)
+	}
+	log.Printf("Completed change file %s.", final)
+	return nil
+}
+
+// recoverPartialFiles completes the files left open by an interrupted
+// export. Records after the slot's confirmed position are cut off, including
+// a torn last line: the slot was not advanced past them, so they are
+// written again.
+func recoverPartialFiles(dir string, confirmed pgoutput.LSN) error {
+	partials, err := filepath.Glob(filepath.Join(dir, "*.ndjson.partial"))
+	if err != nil {
+		return err
+	}
+	for _, path := range partials {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to read change file: %v", err)
+		}
+		reader := bufio.NewReader(file)
+		var keep int64
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			entry, parseErr := parseCDCLine(line)
+			if parseErr != nil || entry.endLSN > confirmed {
+				break
+			}
+			keep += int64(len(line))
+		}
+		file.Close()
+
+		if keep == 0 {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove change file: %v", err)
+			}
+			continue
+		}
+		if err := os.Truncate(path, keep); err != nil {
+			return fmt.Errorf("failed to truncate change file: %v", err)
+		}
+		if err := os.Rename(path, strings.TrimSuffix(path, ".partial")); err != nil {
+			return fmt.Errorf("failed to complete change file: %v", err)
+		}
+		log.Printf("Completed change file %s left by an interrupted export.", strings.TrimSuffix(path, ".partial"))
+	}
+	return nil
+}
+
+// lastExportedLSN returns the end LSN of the last record in the newest
+// completed file of a slot, or zero when there is none. A file can be
+// completed before the slot was advanced past its records, so those records
+// are peeked again after a restart and must not be written twice.
+func lastExportedLSN(dir, slot string) (pgoutput.LSN, error) {
+	files, err := filepath.Glob(filepath.Join(dir, slot+".*.ndjson"))
+	if err != nil || len(files) == 0 {
+		return 0, err
+	}
+	sort.Strings(files)
+	file, err := os.Open(files[len(files)-1])
+	if err != nil {
+		return 0, fmt.Errorf("failed to read change file: %v", err)
+	}
+	defer file.Close()
+
+	var last pgoutput.LSN
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		entry, err := parseCDCLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", files[len(files)-1], err)
+		}
+		last = entry.endLSN
+	}
+	return last, nil
+}
+
+// ExportChanges writes every change of the migration's publication to
+// rotating NDJSON files in opts.Dir, for archiving or auditing the
+// migration window. Changes are decoded with pgoutput from an export slot,
+// created on first run. Each batch is synced to disk before the slot is
+// advanced, so a restart continues without gaps. It runs until ctx is
+// cancelled.
+func (r *Replicator) ExportChanges(ctx context.Context, opts CDCOptions) error {
+	if opts.Format != CDCFormatPlain && opts.Format != CDCFormatDebezium {
+		return fmt.Errorf("unknown change format %q (expected %s or %s)", opts.Format, CDCFormatPlain, CDCFormatDebezium)
+	}
+	slot := opts.Slot
+	if slot == "" {
+		slot = cdcSlotName(r.names.Slot)
+	}
+	if !namePattern.MatchString(slot) {
+		return fmt.Errorf("invalid export slot name %q: use up to 63 lowercase letters, digits and underscores", slot)
+	}
+
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	reader, err := newSlotReader(srcDB, slot, r.names.Publication)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	if err := srcDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_publication WHERE pubname = $1);", r.names.Publication).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up publication '%s': %v", r.names.Publication, err)
+	}
+	if !exists {
+		return fmt.Errorf("publication '%s' does not exist on the source; set up replication first", r.names.Publication)
+	}
+	created, err := reader.ensureSlot()
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Printf("Export slot '%s' created on source database; changes from now on are exported.", slot)
+	}
+
+	var confirmed string
+	if err := srcDB.QueryRow("SELECT confirmed_flush_lsn::text FROM pg_replication_slots WHERE slot_name = $1;", slot).Scan(&confirmed); err != nil {
+		return fmt.Errorf("failed to read position of replication slot '%s': %v", slot, err)
+	}
+	confirmedLSN, err := pgoutput.ParseLSN(confirmed)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create change directory: %v", err)
+	}
+	if err := recoverPartialFiles(opts.Dir, confirmedLSN); err != nil {
+		return err
+	}
+	exported, err := lastExportedLSN(opts.Dir, slot)
+	if err != nil {
+		return err
+	}
+
+	writer := &cdcWriter{dir: opts.Dir, slot: slot, maxSize: opts.MaxFileSize, rotateInterval: opts.RotateInterval}
+	// After a failure the open file keeps its .partial suffix, so that the
+	// next run cuts off what the slot did not confirm
+	defer func() {
+		if writer.file != nil {
+			writer.file.Close()
+		}
+	}()
+
+	log.Printf("Exporting changes from slot '%s' to %s, press Ctrl+C to stop...", slot, opts.Dir)
+	advanced := confirmedLSN
+	for {
+		// pgoutput skips transactions that touch no published table from
+		// PostgreSQL 15, so an idle publication returns nothing; the slot is
+		// then advanced to the WAL position read before the peek, which the
+		// peek decoded completely
+		current, err := currentLSN(srcDB)
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("failed to read the source WAL position: %v", err)
+		}
+		txns, err := reader.peek(ctx, opts.MaxChanges)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if len(txns) == 0 && err == nil && ctx.Err() == nil {
+			before, err := pgoutput.ParseLSN(current)
+			if err != nil {
+				return err
+			}
+			if before > advanced {
+				if err := reader.advance(before); err != nil {
+					return err
+				}
+				advanced = before
+			}
+		}
+
+		if len(txns) > 0 {
+			records := 0
+			for _, txn := range txns {
+				// Transactions touching only unpublished tables arrive empty
+				if len(txn.Changes) == 0 || txn.EndLSN <= exported {
+					continue
+				}
+				lines, err := cdcRecords(txn, opts.Format, r.migrationID, r.source.Database)
+				if err != nil {
+					return err
+				}
+				if err := writer.write(txn, lines); err != nil {
+					return err
+				}
+				records += len(lines)
+			}
+			if err := writer.sync(); err != nil {
+				return err
+			}
+			last := txns[len(txns)-1].EndLSN
+			if err := reader.advance(last); err != nil {
+				return err
+			}
+			advanced = last
+			if records > 0 {
+				log.Printf("Exported %d changes of %d transactions up to %s.", records, len(txns), last)
+			}
+		}
+
+		// The slot is past everything written, so the file can be completed
+		if err := writer.rotateIfDue(); err != nil {
+			return err
+		}
+		if len(txns) > 0 && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			if err := writer.close(); err != nil {
+				return err
+			}
+			log.Println("Stopped exporting changes.")
+			return nil
+		case <-time.After(opts.PollInterval):
+		}
+	}
+}
+
+// cdcFiles returns the completed export files of a directory in LSN order
+// and the export slot they came from
+func cdcFiles(dir string) ([]string, string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.ndjson"))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(files) == 0 {
+		return nil, "", fmt.Errorf("no change files in %s", dir)
+	}
+	sort.Strings(files)
+
+	var slot string
+	for _, file := range files {
+		name := filepath.Base(file)
+		parts := strings.Split(strings.TrimSuffix(name, ".ndjson"), ".")
+		if len(parts) != 2 || len(parts[1]) != 16 {
+			return nil, "", fmt.Errorf("unexpected change file name %s", name)
+		}
+		if slot != "" && parts[0] != slot {
+			return nil, "", fmt.Errorf("%s holds changes of slots '%s' and '%s'; replay them separately", dir, slot, parts[0])
+		}
+		slot = parts[0]
+	}
+	return files, slot, nil
+}
+
+// ReplayChanges applies exported change files to the target in LSN order,
+// batchSize transactions per target transaction. The position is recorded
+// in aiven_db_migrate.apply_position under the export slot's name, so a
+// replay that is interrupted, or run again over more files, skips what it
+// already applied.
+func (r *Replicator) ReplayChanges(ctx context.Context, dir string, batchSize int) error {
+	files, slot, err := cdcFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	if _, err := tgtDB.Exec(applyPositionTable); err != nil {
+		return fmt.Errorf("failed to create apply position table on target: %v", err)
+	}
+	pos, err := readApplyPosition(tgtDB, slot)
+	if err != nil {
+		return err
+	}
+	replicaRole := sessionReplicationRole(tgtDB)
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	applied := pos.lsn
+	total := 0
+	var batch []*transaction
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		changes, err := applyTransactions(tgtDB, slot, batch, replicaRole)
+		if err != nil {
+			return err
+		}
+		applied = batch[len(batch)-1].EndLSN
+		total += changes
+		batch = nil
+		return nil
+	}
+
+	// Transactions never span two files, so a transaction in a file that
+	// ends at or before the last one of the previous file is a copy an
+	// interrupted export wrote again
+	var current *transaction
+	var previous pgoutput.LSN
+	finish := func() error {
+		if current != nil && current.EndLSN > applied {
+			batch = append(batch, current)
+			if len(batch) >= batchSize {
+				return flush()
+			}
+		}
+		return nil
+	}
+
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to read change file: %v", err)
+		}
+		if current != nil {
+			previous = current.EndLSN
+		}
+		reader := bufio.NewReader(file)
+		for lineNo := 1; ; lineNo++ {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF && len(line) == 0 {
+				break
+			}
+			if err != nil && err != io.EOF {
+				file.Close()
+				return fmt.Errorf("failed to read %s: %v", path, err)
+			}
+			entry, err := parseCDCLine(line)
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			if entry.endLSN <= previous {
+				continue
+			}
+
+			if current == nil || current.EndLSN != entry.endLSN {
+				if err := finish(); err != nil {
+					file.Close()
+					return err
+				}
+				current = &transaction{XID: entry.xid, CommitLSN: entry.commitLSN, EndLSN: entry.endLSN}
+			}
+			// The tables of one TRUNCATE arrive as consecutive records
+			if n := len(current.Changes); n > 0 && entry.change.Op == opTruncate && current.Changes[n-1].Op == opTruncate &&
+				current.Changes[n-1].Cascade == entry.change.Cascade && current.Changes[n-1].RestartIdentity == entry.change.RestartIdentity {
+				current.Changes[n-1].Truncated = append(current.Changes[n-1].Truncated, entry.change.Truncated...)
+			} else {
+				current.Changes = append(current.Changes, entry.change)
+			}
+		}
+		file.Close()
+
+		if ctx.Err() != nil {
+			if err := flush(); err != nil {
+				return err
+			}
+			log.Printf("Stopped replaying changes at %s.", applied)
+			return nil
+		}
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	log.Printf("Replayed %d changes from %d files up to %s.", total, len(files), applied)
+	return nil
+}
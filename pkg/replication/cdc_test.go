@@ -0,0 +1,193 @@
+package replication
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pg-migration/pkg/pgoutput"
+)
+
+func text(s string) pgoutput.Value {
+	return pgoutput.Value{Kind: pgoutput.ValueText, Data: []byte(s)}
+}
+
+var (
+	null      = pgoutput.Value{Kind: pgoutput.ValueNull}
+	unchanged = pgoutput.Value{Kind: pgoutput.ValueUnchanged}
+)
+
+func TestParseCDCLine(t *testing.T) {
+	keyed := &pgoutput.Relation{Namespace: "public", Name: "orders", ReplicaIdentity: 'd', Columns: []pgoutput.Column{
+		{Name: "id", Key: true}, {Name: "note"},
+	}}
+	full := &pgoutput.Relation{Namespace: "public", Name: "events", ReplicaIdentity: 'f', Columns: []pgoutput.Column{
+		{Name: "at"}, {Name: "what"},
+	}}
+
+	tests := []struct {
+		name    string
+		line    string
+		want    *cdcEntry
+		wantErr bool
+	}{
+		{
+			name: "plain insert",
+			line: `{"lsn":"0/1A0","commit_lsn":"0/170","xid":7,"commit_time":"2024-01-01T00:00:00Z",` +
+				`"relation":{"schema":"public","table":"orders"},"op":"insert","key":{"id":"1"},"new":{"id":"1","note":null}}`,
+			want: &cdcEntry{endLSN: 0x1A0, commitLSN: 0x170, xid: 7, change: change{
+				Op: opInsert, Relation: keyed, New: pgoutput.Tuple{text("1"), null},
+			}},
+		},
+		{
+			// The record only knows the columns it carries
+			name: "plain update with unchanged TOASTed value",
+			line: `{"lsn":"0/1A0","xid":7,"relation":{"schema":"public","table":"orders"},"op":"update","key":{"id":"1"},"new":{"id":"2"}}`,
+			want: &cdcEntry{endLSN: 0x1A0, xid: 7, change: change{
+				Op: opUpdate, Relation: &pgoutput.Relation{Namespace: "public", Name: "orders", ReplicaIdentity: 'd', Columns: []pgoutput.Column{{Name: "id", Key: true}}},
+				Old: pgoutput.Tuple{text("1")}, OldIsKey: true,
+				New: pgoutput.Tuple{text("2")},
+			}},
+		},
+		{
+			name: "plain delete with REPLICA IDENTITY FULL",
+			line: `{"lsn":"0/1A0","xid":7,"relation":{"schema":"public","table":"events"},"op":"delete","old":{"at":"2024-01-01","what":"x;y"}}`,
+			want: &cdcEntry{endLSN: 0x1A0, xid: 7, change: change{
+				Op: opDelete, Relation: full, Old: pgoutput.Tuple{text("2024-01-01"), text("x;y")},
+			}},
+		},
+		{
+			name: "plain truncate",
+			line: `{"lsn":"0/1A0","xid":7,"relation":{"schema":"public","table":"orders"},"op":"truncate","cascade":true}`,
+			want: &cdcEntry{endLSN: 0x1A0, xid: 7, change: change{
+				Op: opTruncate, Cascade: true,
+				Truncated: []*pgoutput.Relation{{Namespace: "public", Name: "orders", ReplicaIdentity: 'f'}},
+			}},
+		},
+		{
+			name: "debezium update",
+			line: `{"key":{"id":"1"},"value":{"before":null,"after":{"id":"1","note":"__debezium_unavailable_value"},` +
+				`"source":{"connector":"postgresql","schema":"public","table":"orders","txId":7,"lsn":416},"op":"u"}}`,
+			want: &cdcEntry{endLSN: 416, xid: 7, change: change{
+				Op: opUpdate, Relation: keyed,
+				Old: pgoutput.Tuple{text("1"), unchanged}, OldIsKey: true,
+				New: pgoutput.Tuple{text("1"), unchanged},
+			}},
+		},
+		{
+			name: "debezium snapshot read is an insert",
+			line: `{"key":null,"value":{"before":null,"after":{"at":"2024-01-01","what":null},` +
+				`"source":{"schema":"public","table":"events","txId":8,"lsn":512},"op":"r"}}`,
+			want: &cdcEntry{endLSN: 512, xid: 8, change: change{
+				Op: opInsert, Relation: full, New: pgoutput.Tuple{text("2024-01-01"), null},
+			}},
+		},
+		{
+			name:    "invalid JSON",
+			line:    `{"lsn":`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid LSN",
+			line:    `{"lsn":"1A0","relation":{"schema":"public","table":"orders"},"op":"insert","new":{"id":"1"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown operation",
+			line:    `{"lsn":"0/1A0","relation":{"schema":"public","table":"orders"},"op":"merge","new":{"id":"1"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "delete without key or old row",
+			line:    `{"lsn":"0/1A0","relation":{"schema":"public","table":"orders"},"op":"delete"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCDCLine([]byte(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCDCLine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCDCLine() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCDCRecordsRoundTrip(t *testing.T) {
+	rel := &pgoutput.Relation{Namespace: "public", Name: "orders", ReplicaIdentity: 'd', Columns: []pgoutput.Column{
+		{Name: "id", Key: true}, {Name: "note"},
+	}}
+	txn := &transaction{
+		XID:        7,
+		CommitLSN:  0x170,
+		EndLSN:     0x1A0,
+		CommitTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Changes: []change{
+			{Op: opInsert, Relation: rel, New: pgoutput.Tuple{text("1"), text("it's \"quoted\"")}},
+			{Op: opUpdate, Relation: rel, New: pgoutput.Tuple{text("1"), unchanged}},
+			{Op: opDelete, Relation: rel, Old: pgoutput.Tuple{text("1"), null}, OldIsKey: true},
+		},
+	}
+	// Updates without a changed key carry the key of the new row
+	wantOld := []pgoutput.Tuple{nil, {text("1"), unchanged}, {text("1"), unchanged}}
+
+	for _, format := range []string{CDCFormatPlain, CDCFormatDebezium} {
+		t.Run(format, func(t *testing.T) {
+			lines, err := cdcRecords(txn, format, "m1", "app")
+			if err != nil {
+				t.Fatalf("cdcRecords() error = %v", err)
+			}
+			if len(lines) != len(txn.Changes) {
+				t.Fatalf("cdcRecords() returned %d lines, want %d", len(lines), len(txn.Changes))
+			}
+			for i, line := range lines {
+				entry, err := parseCDCLine(line)
+				if err != nil {
+					t.Fatalf("parseCDCLine(%s) error = %v", line, err)
+				}
+				want := txn.Changes[i]
+				got := entry.change
+				if entry.endLSN != txn.EndLSN || entry.xid != txn.XID || got.Op != want.Op {
+					t.Errorf("line %d: %s at %v in %d, want %s at %v in %d", i, got.Op, entry.endLSN, entry.xid, want.Op, txn.EndLSN, txn.XID)
+				}
+				// Columns are compared by name, as records do not keep their order
+				if g, w := tupleMap(got.Relation, got.New, ""), tupleMap(rel, want.New, ""); !reflect.DeepEqual(g, w) {
+					t.Errorf("line %d: new = %v, want %v", i, g, w)
+				}
+				if g, w := tupleMap(got.Relation, got.Old, ""), tupleMap(rel, wantOld[i], ""); !reflect.DeepEqual(g, w) {
+					t.Errorf("line %d: old = %v, want %v", i, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestCDCSlotName(t *testing.T) {
+	long := strings.Repeat("s", 63)
+	tests := []struct {
+		slot string
+		want string
+	}{
+		{slot: "aiven_db_migrate_slot", want: "aiven_db_migrate_slot_cdc"},
+		{slot: long[:59], want: long[:59] + "_cdc"},
+		{slot: long[:60], want: long[:50] + "_b577fa89_cdc"},
+	}
+
+	for _, tt := range tests {
+		got := cdcSlotName(tt.slot)
+		if len(got) > 63 || !namePattern.MatchString(got) {
+			t.Errorf("cdcSlotName(%q) = %q, which is not a valid slot name", tt.slot, got)
+		}
+		if got != tt.want {
+			t.Errorf("cdcSlotName(%q) = %q, want %q", tt.slot, got, tt.want)
+		}
+	}
+	if cdcSlotName(long[:60]) == cdcSlotName(long) {
+		t.Errorf("cdcSlotName() returns the same name for slots sharing a prefix")
+	}
+}
@@ -0,0 +1,633 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"pg-migration/pkg/pgoutput"
+	"pg-migration/pkg/replconn"
+
+	"github.com/lib/pq"
+)
+
+// applyPositionTable records on the target how far the built-in consumer has
+// applied the slot. It is written in the same transaction as the changes,
+// so the position and the data cannot disagree.
+const applyPositionTable = `
+CREATE SCHEMA IF NOT EXISTS aiven_db_migrate;
+CREATE TABLE IF NOT EXISTS aiven_db_migrate.apply_position (
+    slot_name text PRIMARY KEY,
+    lsn pg_lsn,                           -- End of the last applied transaction
+    copied boolean NOT NULL DEFAULT false, -- Initial copy completed
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+`
+
+// ConsumeOptions control ConsumeChanges
+type ConsumeOptions struct {
+	PollInterval time.Duration // Wait for further changes before applying a partial batch
+	BatchSize    int           // Source transactions applied per target transaction
+	CopyBatch    int           // Rows inserted per statement during the initial copy
+}
+
+// applyPosition is the row of the consumer in aiven_db_migrate.apply_position
+type applyPosition struct {
+	exists bool
+	lsn    pgoutput.LSN // Zero until the first transaction was applied
+	copied bool
+}
+
+// readApplyPosition reads the position of a slot's consumer from the target
+func readApplyPosition(tgtDB *sql.DB, slot string) (*applyPosition, error) {
+	pos := &applyPosition{}
+	var lsn sql.NullString
+	err := tgtDB.QueryRow("SELECT lsn::text, copied FROM aiven_db_migrate.apply_position WHERE slot_name = $1;", slot).Scan(&lsn, &pos.copied)
+	if err == sql.ErrNoRows {
+		return pos, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read apply position on target: %v", err)
+	}
+	pos.exists = true
+	if lsn.Valid {
+		if pos.lsn, err = pgoutput.ParseLSN(lsn.String); err != nil {
+			return nil, err
+		}
+	}
+	return pos, nil
+}
+
+// ConsumeChanges replicates without a subscription: the tool itself streams
+// the migration slot with pgoutput over a replication connection and applies
+// the changes to the target over a normal connection, for targets that
+// cannot create subscriptions.
+//
+// On first run it creates the publication and the slot, exporting a snapshot
+// as of the slot's start, and copies the existing rows in that snapshot, so
+// the stream continues exactly where the copy ends. Source transactions are
+// then applied in batches, each in one target transaction together with its
+// position; the position is confirmed to the source after the commit. A
+// restart skips what the target already has and continues from there.
+//
+// It runs until ctx is cancelled.
+func (r *Replicator) ConsumeChanges(ctx context.Context, opts ConsumeOptions) error {
+	if r.backendName == BackendPglogical {
+		return fmt.Errorf("the built-in consumer decodes a publication with pgoutput and cannot use the pglogical backend")
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return fmt.Errorf("failed to check source server version: %v", err)
+	}
+	if version < 100000 {
+		return fmt.Errorf("the pgoutput plugin requires PostgreSQL 10 or later on the source, found %d", version)
+	}
+	if _, err := tgtDB.Exec(applyPositionTable); err != nil {
+		return fmt.Errorf("failed to create apply position table on target: %v", err)
+	}
+	pos, err := readApplyPosition(tgtDB, r.names.Slot)
+	if err != nil {
+		return err
+	}
+
+	slotExists, err := checkSlot(srcDB, r.names.Slot)
+	if err != nil {
+		return err
+	}
+	if !slotExists && pos.exists {
+		return fmt.Errorf("replication slot '%s' no longer exists but the target has applied changes from it, so changes since %s are lost; empty the target tables and delete its row from aiven_db_migrate.apply_position to start over",
+			r.names.Slot, pos.lsn)
+	}
+	if slotExists && !pos.copied {
+		// The snapshot the interrupted copy read from is gone, and a new one
+		// only comes with a new slot
+		log.Printf("Initial copy from slot '%s' did not complete; recreating the slot to copy again.", r.names.Slot)
+		if err := dropSlot(srcDB, r.names.Slot, 30*time.Second); err != nil {
+			return err
+		}
+		slotExists = false
+	}
+
+	replicaRole := sessionReplicationRole(tgtDB)
+	if !replicaRole {
+		log.Println("Warning: the target user may not set session_replication_role, so triggers and foreign keys on the target fire while changes are applied.")
+	}
+
+	stream, err := replconn.Connect(ctx, r.source)
+	if err != nil {
+		return fmt.Errorf("failed to open replication connection to source database: %v", err)
+	}
+	defer stream.Close()
+
+	if !slotExists {
+		// pgoutput looks the publication up as of each change, so it has to
+		// exist before the slot and must not be recreated while it is used
+		if err := r.createConsumerPublication(srcDB); err != nil {
+			return err
+		}
+		slot, err := stream.CreateSlot(ctx, r.names.Slot, "pgoutput")
+		if err != nil {
+			return fmt.Errorf("failed to create replication slot '%s': %v", r.names.Slot, err)
+		}
+		log.Printf("Replication slot '%s' created on source database at %s.", r.names.Slot, slot.ConsistentPoint)
+
+		// The snapshot stays valid while the replication connection is idle
+		if err := copyPublishedTables(ctx, srcDB, tgtDB, r.names.Publication, slot.SnapshotName, opts.CopyBatch, replicaRole); err != nil {
+			return err
+		}
+		_, err = tgtDB.Exec(`
+			INSERT INTO aiven_db_migrate.apply_position (slot_name, copied) VALUES ($1, true)
+			ON CONFLICT (slot_name) DO UPDATE SET copied = true, updated_at = now();
+		`, r.names.Slot)
+		if err != nil {
+			return fmt.Errorf("failed to record initial copy on target: %v", err)
+		}
+		log.Println("Initial data copy completed.")
+	}
+
+	// Streaming starts at the slot's confirmed position
+	err = stream.StartReplication(ctx, r.names.Slot, 0, map[string]string{
+		"proto_version":     "1",
+		"publication_names": pq.QuoteIdentifier(r.names.Publication),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stream replication slot '%s': %v", r.names.Slot, err)
+	}
+	log.Printf("Applying changes from slot '%s', press Ctrl+C to stop...", r.names.Slot)
+
+	applied := pos.lsn
+	if err := stream.SendStatus(applied); err != nil {
+		return err
+	}
+	dec := newDecoder()
+	var pending []*transaction
+	apply := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		changes, err := applyTransactions(tgtDB, r.names.Slot, pending, replicaRole)
+		if err != nil {
+			return err
+		}
+		applied = pending[len(pending)-1].EndLSN
+		if err := stream.SendStatus(applied); err != nil {
+			return fmt.Errorf("failed to confirm %s to the source: %v", applied, err)
+		}
+		log.Printf("Applied %d transactions (%d changes) up to %s.", len(pending), changes, applied)
+		pending = pending[:0]
+		return nil
+	}
+
+	for {
+		// Keepalives may only confirm the source's WAL end once everything
+		// before it was applied
+		stream.SetIdle(len(pending) == 0 && dec.current == nil)
+		data, err := stream.Receive(ctx, opts.PollInterval)
+		if ctx.Err() != nil {
+			// Complete transactions received so far are applied before stopping
+			if err := apply(); err != nil {
+				return err
+			}
+			log.Printf("Stopped applying changes at %s.", applied)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stream replication slot '%s': %v", r.names.Slot, err)
+		}
+		if data == nil {
+			// The source is idle: apply what has arrived
+			if err := apply(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		txn, err := dec.decode(data.Data)
+		if err != nil {
+			return err
+		}
+		// Transactions up to the recorded position were committed on the
+		// target before their position could be confirmed to the source
+		if txn == nil || txn.EndLSN <= applied {
+			continue
+		}
+		pending = append(pending, txn)
+		if opts.BatchSize > 0 && len(pending) >= opts.BatchSize {
+			if err := apply(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// createConsumerPublication creates the publication through aiven_extras when
+// it is selected, or detected on the source, and directly otherwise
+func (r *Replicator) createConsumerPublication(srcDB *sql.DB) error {
+	remaining, err := r.CheckReplicaIdentity()
+	if err != nil {
+		return err
+	}
+	if len(remaining) > 0 {
+		return fmt.Errorf("tables without primary key or replica identity would reject UPDATE/DELETE once published: %s; set a replica identity (see the suggestions above) first",
+			identityIssueNames(remaining))
+	}
+
+	pub := r.publication
+	if pub.Tables, err = resolvePublishedTables(srcDB, pub.Tables); err != nil {
+		return err
+	}
+	if err := checkPublicationSupport(srcDB, pub); err != nil {
+		return err
+	}
+
+	var backend Backend = nativeBackend{}
+	if r.backendName != BackendNative {
+		installed, err := checkExtensionInstalled(srcDB, "aiven_extras")
+		if err != nil {
+			return fmt.Errorf("failed to check aiven_extras extension on source: %v", err)
+		}
+		if installed || r.backendName == BackendAivenExtras {
+			backend = aivenExtrasBackend{}
+		}
+	}
+	if err := backend.CreatePublication(srcDB, r.names, pub, r.publishViaRoot); err != nil {
+		return err
+	}
+	log.Printf("Publication '%s' created on source database.", r.names.Publication)
+	return nil
+}
+
+// sessionReplicationRole reports whether the target user may set
+// session_replication_role to replica, which keeps triggers and foreign key
+// checks from firing for replicated rows, as for a subscription
+func sessionReplicationRole(tgtDB *sql.DB) bool {
+	tx, err := tgtDB.Begin()
+	if err != nil {
+		return false
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("SET LOCAL session_replication_role = replica;")
+	return err == nil
+}
+
+// copiedTable is a published table and the columns the publication carries
+type copiedTable struct {
+	name        string // Quoted schema-qualified name
+	partitioned bool
+	columns     []string
+	where       string
+}
+
+// listCopiedTables lists the tables of a publication, with the column lists
+// and row filters of PostgreSQL 15+ (read through row_to_json, as older
+// servers lack these columns). Generated columns (PostgreSQL 12+) are not
+// published.
+func listCopiedTables(srcDB *sql.DB, publication string) ([]copiedTable, error) {
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check source server version: %v", err)
+	}
+	generated := ""
+	if version >= 120000 {
+		generated = "AND a.attgenerated = ''"
+	}
+
+	rows, err := srcDB.Query(fmt.Sprintf(`
+		SELECT format('%%I.%%I', p.schemaname, p.tablename),
+		       c.relkind = 'p',
+		       COALESCE(row_to_json(p) ->> 'rowfilter', ''),
+		       ARRAY(
+		           SELECT a.attname
+		           FROM pg_attribute a
+		           WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+		             %s
+		             AND (row_to_json(p) -> 'attnames' IS NULL
+		                  OR json_typeof(row_to_json(p) -> 'attnames') = 'null'
+		                  OR a.attname IN (SELECT json_array_elements_text(row_to_json(p) -> 'attnames')))
+		           ORDER BY a.attnum
+		       )
+		FROM pg_publication_tables p
+		JOIN pg_class c ON c.oid = format('%%I.%%I', p.schemaname, p.tablename)::regclass
+		WHERE p.pubname = $1
+		ORDER BY 1;
+	`, generated), publication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables of publication '%s': %v", publication, err)
+	}
+	defer rows.Close()
+
+	var tables []copiedTable
+	for rows.Next() {
+		var t copiedTable
+		if err := rows.Scan(&t.name, &t.partitioned, &t.where, pq.Array(&t.columns)); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, rows.Err()
+}
+
+// copyPublishedTables copies the published rows to the target, reading them
+// in the snapshot exported with the replication slot. Rows travel as JSON
+// and are inserted with json_populate_recordset, batchSize at a time. Each
+// table is copied in one target transaction that first removes rows left by
+// an interrupted copy.
+func copyPublishedTables(ctx context.Context, srcDB, tgtDB *sql.DB, publication, snapshotName string, batchSize int, replicaRole bool) error {
+	tables, err := listCopiedTables(srcDB, publication)
+	if err != nil {
+		return err
+	}
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	snapshot, err := srcDB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to start copy snapshot on source: %v", err)
+	}
+	defer snapshot.Rollback()
+	if _, err := snapshot.ExecContext(ctx, fmt.Sprintf("SET TRANSACTION SNAPSHOT %s;", pq.QuoteLiteral(snapshotName))); err != nil {
+		return fmt.Errorf("failed to import snapshot of replication slot: %v", err)
+	}
+
+	for _, t := range tables {
+		copied, err := copyTable(ctx, snapshot, tgtDB, t, batchSize, replicaRole)
+		if err != nil {
+			return err
+		}
+		log.Printf("Copied %d rows of %s.", copied, t.name)
+	}
+	return nil
+}
+
+// copyTable copies the published rows of one table
+func copyTable(ctx context.Context, snapshot *sql.Tx, tgtDB *sql.DB, t copiedTable, batchSize int, replicaRole bool) (int64, error) {
+	columns := make([]string, len(t.columns))
+	for i, column := range t.columns {
+		columns[i] = pq.QuoteIdentifier(column)
+	}
+	columnList := strings.Join(columns, ", ")
+
+	// ONLY keeps inheritance children, which are published themselves, from
+	// being copied twice; partitioned tables hold no rows of their own
+	only := "ONLY "
+	if t.partitioned {
+		only = ""
+	}
+	query := fmt.Sprintf("SELECT row_to_json(p)::text FROM (SELECT %s FROM %s%s", columnList, only, t.name)
+	if t.where != "" {
+		query += " WHERE " + t.where
+	}
+	query += ") p;"
+
+	tx, err := tgtDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction on target: %v", err)
+	}
+	defer tx.Rollback()
+	if replicaRole {
+		if _, err := tx.Exec("SET LOCAL session_replication_role = replica;"); err != nil {
+			return 0, fmt.Errorf("failed to set session_replication_role on target: %v", err)
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s%s;", only, t.name)); err != nil {
+		return 0, fmt.Errorf("failed to empty %s on target: %v", t.name, err)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM json_populate_recordset(NULL::%s, $1);", t.name, columnList, columnList, t.name)
+
+	rows, err := snapshot.QueryContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s on source: %v", t.name, err)
+	}
+	defer rows.Close()
+
+	var copied int64
+	batch := make([]string, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := tx.Exec(insert, "["+strings.Join(batch, ",")+"]"); err != nil {
+			return fmt.Errorf("failed to copy rows of %s to target: %v", t.name, err)
+		}
+		copied += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return 0, err
+		}
+		batch = append(batch, row)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %s on source: %v", t.name, err)
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit copy of %s on target: %v", t.name, err)
+	}
+	return copied, nil
+}
+
+// applyTransactions applies source transactions in one target transaction
+// and records the end of the last one as the apply position. It returns the
+// number of changes applied.
+func applyTransactions(tgtDB *sql.DB, slot string, txns []*transaction, replicaRole bool) (int, error) {
+	tx, err := tgtDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction on target: %v", err)
+	}
+	defer tx.Rollback()
+	if replicaRole {
+		if _, err := tx.Exec("SET LOCAL session_replication_role = replica;"); err != nil {
+			return 0, fmt.Errorf("failed to set session_replication_role on target: %v", err)
+		}
+	}
+
+	changes := 0
+	for _, txn := range txns {
+		for _, c := range txn.Changes {
+			if err := applyChange(tx, c); err != nil {
+				return 0, fmt.Errorf("failed to apply transaction %d (commit %s) on target: %v", txn.XID, txn.CommitLSN, err)
+			}
+			changes++
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO aiven_db_migrate.apply_position (slot_name, lsn, copied) VALUES ($1, $2::pg_lsn, true)
+		ON CONFLICT (slot_name) DO UPDATE SET lsn = EXCLUDED.lsn, updated_at = now();
+	`, slot, txns[len(txns)-1].EndLSN.String())
+	if err != nil {
+		return 0, fmt.Errorf("failed to record apply position on target: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit applied changes on target: %v", err)
+	}
+	return changes, nil
+}
+
+// tupleValue returns a column value as a query argument
+func tupleValue(v pgoutput.Value) interface{} {
+	if v.Kind == pgoutput.ValueNull {
+		return nil
+	}
+	return string(v.Data)
+}
+
+// keyColumns returns the indexes of the replica identity columns of a
+// relation, or nil for REPLICA IDENTITY FULL or NOTHING, where rows have no
+// key (pgoutput flags every column as key with FULL)
+func keyColumns(rel *pgoutput.Relation) []int {
+	if rel.ReplicaIdentity == 'f' || rel.ReplicaIdentity == 'n' {
+		return nil
+	}
+	var keys []int
+	for i, column := range rel.Columns {
+		if column.Key {
+			keys = append(keys, i)
+		}
+	}
+	return keys
+}
+
+// rowCondition builds a WHERE condition matching a row by its key columns,
+// or by all of its old values when the relation has no key. Keyless matches
+// are limited to one row through its ctid, as a subscription would do.
+func rowCondition(rel *pgoutput.Relation, old pgoutput.Tuple, args []interface{}) (string, []interface{}) {
+	keys := keyColumns(rel)
+	var conditions []string
+	if keys != nil {
+		for _, i := range keys {
+			args = append(args, tupleValue(old[i]))
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(rel.Columns[i].Name), len(args)))
+		}
+		return strings.Join(conditions, " AND "), args
+	}
+	for i, v := range old {
+		if i >= len(rel.Columns) || v.Kind == pgoutput.ValueUnchanged {
+			continue
+		}
+		args = append(args, tupleValue(v))
+		conditions = append(conditions, fmt.Sprintf("%s IS NOT DISTINCT FROM $%d", pq.QuoteIdentifier(rel.Columns[i].Name), len(args)))
+	}
+	return fmt.Sprintf("ctid = (SELECT ctid FROM %s WHERE %s LIMIT 1)", qualifiedName(rel), strings.Join(conditions, " AND ")), args
+}
+
+// upsertRow inserts a row, updating the existing row with the same key.
+// Change files replayed onto any target may hold rows it already has.
+func upsertRow(tx *sql.Tx, rel *pgoutput.Relation, row pgoutput.Tuple) error {
+	var columns, placeholders, updates []string
+	var args []interface{}
+	for i, v := range row {
+		if i >= len(rel.Columns) || v.Kind == pgoutput.ValueUnchanged {
+			continue
+		}
+		name := pq.QuoteIdentifier(rel.Columns[i].Name)
+		args = append(args, tupleValue(v))
+		columns = append(columns, name)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		if !rel.Columns[i].Key {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", name, name))
+		}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", qualifiedName(rel), strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	if keys := keyColumns(rel); keys != nil {
+		keyNames := make([]string, len(keys))
+		for i, k := range keys {
+			keyNames[i] = pq.QuoteIdentifier(rel.Columns[k].Name)
+		}
+		query += fmt.Sprintf(" ON CONFLICT (%s)", strings.Join(keyNames, ", "))
+		if len(updates) > 0 {
+			query += " DO UPDATE SET " + strings.Join(updates, ", ")
+		} else {
+			query += " DO NOTHING"
+		}
+	}
+	_, err := tx.Exec(query, args...)
+	return err
+}
+
+// applyChange applies one decoded change on the target
+func applyChange(tx *sql.Tx, c change) error {
+	switch c.Op {
+	case opInsert:
+		return upsertRow(tx, c.Relation, c.New)
+
+	case opUpdate:
+		var sets []string
+		var args []interface{}
+		for i, v := range c.New {
+			if i >= len(c.Relation.Columns) || v.Kind == pgoutput.ValueUnchanged {
+				continue
+			}
+			args = append(args, tupleValue(v))
+			sets = append(sets, fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(c.Relation.Columns[i].Name), len(args)))
+		}
+		old := c.Old
+		if old == nil {
+			old = c.New
+		}
+		condition, args := rowCondition(c.Relation, old, args)
+		result, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s WHERE %s;", qualifiedName(c.Relation), strings.Join(sets, ", "), condition), args...)
+		if err != nil {
+			return err
+		}
+		// Change files replayed onto any target may update rows it never
+		// had; a keyed row is inserted then
+		if n, err := result.RowsAffected(); err == nil && n == 0 && keyColumns(c.Relation) != nil {
+			return upsertRow(tx, c.Relation, c.New)
+		}
+		return nil
+
+	case opDelete:
+		condition, args := rowCondition(c.Relation, c.Old, nil)
+		_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s;", qualifiedName(c.Relation), condition), args...)
+		return err
+
+	case opTruncate:
+		names := make([]string, len(c.Truncated))
+		for i, rel := range c.Truncated {
+			names[i] = qualifiedName(rel)
+		}
+		query := "TRUNCATE " + strings.Join(names, ", ")
+		if c.RestartIdentity {
+			query += " RESTART IDENTITY"
+		}
+		if c.Cascade {
+			query += " CASCADE"
+		}
+		_, err := tx.Exec(query + ";")
+		return err
+	}
+	return fmt.Errorf("unknown change %q", c.Op)
+}
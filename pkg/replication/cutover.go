@@ -0,0 +1,376 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Ways of stopping writes on the source during cutover
+const (
+	// FreezeDatabase sets default_transaction_read_only on the source
+	// database and terminates the sessions connected to it
+	FreezeDatabase = "database"
+	// FreezeRoles revokes write privileges on all user tables and sequences
+	// from the listed application roles
+	FreezeRoles = "roles"
+)
+
+// CutoverOptions control Cutover
+type CutoverOptions struct {
+	Freeze         string   // FreezeDatabase or FreezeRoles
+	Roles          []string // Application roles for FreezeRoles
+	Timeout        time.Duration
+	PollInterval   time.Duration
+	SequenceMargin int64
+}
+
+// CutoverResult records what a cutover did
+type CutoverResult struct {
+	FinalLSN  string // Source WAL position once writes were stopped
+	FrozenAt  time.Time
+	CaughtUp  time.Duration // From the freeze until the subscriber confirmed FinalLSN
+	Frozen    time.Duration // From the freeze until the replication objects were dropped
+	Sequences []SequenceSync
+}
+
+// userSchemasQuery lists the schemas holding application tables
+const userSchemasQuery = `
+SELECT nspname
+FROM pg_namespace
+WHERE nspname NOT IN ('pg_catalog', 'information_schema', 'pglogical', 'aiven_extras', 'aiven_db_migrate')
+  AND nspname NOT LIKE 'pg_toast%'
+  AND nspname NOT LIKE 'pg_temp%'
+ORDER BY 1;
+`
+
+// currentLSN returns the current WAL write position of the server. The WAL
+// functions were renamed in PostgreSQL 10.
+func currentLSN(db *sql.DB) (string, error) {
+	version, err := serverVersion(db)
+	if err != nil {
+		return "", err
+	}
+	query := "SELECT pg_current_wal_lsn()::text;"
+	if version < 100000 {
+		query = "SELECT pg_current_xlog_location()::text;"
+	}
+	var lsn string
+	err = db.QueryRow(query).Scan(&lsn)
+	return lsn, err
+}
+
+// slotConfirmed reports whether the subscriber has confirmed the slot up to lsn
+func slotConfirmed(srcDB *sql.DB, slot, lsn string) (bool, error) {
+	var confirmed sql.NullString
+	err := srcDB.QueryRow("SELECT row_to_json(s) ->> 'confirmed_flush_lsn' FROM pg_replication_slots s WHERE slot_name = $1;", slot).Scan(&confirmed)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("replication slot '%s' does not exist on the source", slot)
+	}
+	if err != nil {
+		return false, err
+	}
+	if !confirmed.Valid {
+		return false, fmt.Errorf("replication slot '%s' reports no confirmed_flush_lsn (PostgreSQL 9.6+ is needed)", slot)
+	}
+
+	var reached bool
+	if err := srcDB.QueryRow("SELECT $1::pg_lsn >= $2::pg_lsn;", confirmed.String, lsn).Scan(&reached); err != nil {
+		return false, err
+	}
+	return reached, nil
+}
+
+// dropSlot drops a replication slot on the source, if it exists. A slot
+// stays active for a moment after its subscription is disabled, so an active
+// slot is retried until the timeout.
+func dropSlot(srcDB *sql.DB, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var exists, active bool
+		err := srcDB.QueryRow("SELECT true, active FROM pg_replication_slots WHERE slot_name = $1;", name).Scan(&exists, &active)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to look up replication slot '%s': %v", name, err)
+		}
+
+		if !active {
+			if _, err := srcDB.Exec("SELECT pg_drop_replication_slot($1);", name); err != nil {
+				return fmt.Errorf("failed to drop replication slot '%s': %v", name, err)
+			}
+			log.Printf("Dropped replication slot '%s' on source database.", name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("replication slot '%s' is still in use by a walsender", name)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// dropExportSlot drops the default export slot once it has exported the
+// changes up to lsn. The publication it decodes is gone after a cutover, so
+// the slot would only hold WAL on the source.
+func dropExportSlot(srcDB *sql.DB, slot, lsn string) error {
+	var exists bool
+	if err := srcDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_replication_slots WHERE slot_name = $1);", slot).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up export slot '%s': %v", slot, err)
+	}
+	if !exists {
+		return nil
+	}
+	exported, err := slotConfirmed(srcDB, slot, lsn)
+	if err != nil {
+		return err
+	}
+	if !exported {
+		return fmt.Errorf("export slot '%s' has not exported the changes up to %s yet and was kept; it holds WAL on the source, so stop --export-changes once it has caught up and drop the slot with --teardown", slot, lsn)
+	}
+	if err := dropSlot(srcDB, slot, 10*time.Second); err != nil {
+		return fmt.Errorf("%v; it holds WAL on the source, so stop --export-changes and drop the slot with --teardown", err)
+	}
+	return nil
+}
+
+// clientSessionsQuery lists the other client sessions of the current
+// database; walsenders are left out, and before PostgreSQL 10 not listed
+const clientSessionsQuery = `
+SELECT pid
+FROM pg_stat_activity a
+WHERE datname = current_database()
+  AND pid <> pg_backend_pid()
+  AND COALESCE(row_to_json(a) ->> 'backend_type', 'client backend') = 'client backend'
+`
+
+// terminateSessions ends the client sessions of the current database that
+// match condition and waits until they are gone. A terminated backend may
+// still be committing, and that commit has to be written before the final
+// LSN is read.
+func terminateSessions(srcDB *sql.DB, condition string, args ...interface{}) (int, error) {
+	sessions := clientSessionsQuery + "  AND " + condition
+	var terminated int
+	if err := srcDB.QueryRow("SELECT count(pg_terminate_backend(pid)) FROM ("+sessions+") s;", args...).Scan(&terminated); err != nil {
+		return 0, fmt.Errorf("failed to terminate sessions on source: %v", err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var remaining int
+		if err := srcDB.QueryRow("SELECT count(*) FROM ("+sessions+") s;", args...).Scan(&remaining); err != nil {
+			return terminated, fmt.Errorf("failed to check for terminated sessions on source: %v", err)
+		}
+		if remaining == 0 {
+			return terminated, nil
+		}
+		if time.Now().After(deadline) {
+			return terminated, fmt.Errorf("%d terminated sessions on source have not exited", remaining)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// freezeSource stops application writes on the source and ends the
+// sessions that could still be writing. When it fails after writes were
+// already (partly) stopped, frozen is true.
+func freezeSource(srcDB *sql.DB, opts CutoverOptions) (frozen bool, err error) {
+	switch opts.Freeze {
+	case FreezeDatabase:
+		var db string
+		if err := srcDB.QueryRow("SELECT current_database();").Scan(&db); err != nil {
+			return false, err
+		}
+		if _, err := srcDB.Exec(fmt.Sprintf("ALTER DATABASE %s SET default_transaction_read_only = on;", pq.QuoteIdentifier(db))); err != nil {
+			return false, fmt.Errorf("failed to make database '%s' read-only: %v", db, err)
+		}
+
+		// The setting applies to new sessions only, so end the existing ones
+		terminated, err := terminateSessions(srcDB, "true")
+		if err != nil {
+			return true, err
+		}
+		log.Printf("Database '%s' is now read-only; terminated %d sessions.", db, terminated)
+		return true, nil
+
+	case FreezeRoles:
+		if len(opts.Roles) == 0 {
+			return false, fmt.Errorf("no application roles given to revoke write privileges from")
+		}
+		rows, err := srcDB.Query(userSchemasQuery)
+		if err != nil {
+			return false, fmt.Errorf("failed to list schemas on source: %v", err)
+		}
+		var schemas []string
+		for rows.Next() {
+			var schema string
+			if err := rows.Scan(&schema); err != nil {
+				rows.Close()
+				return false, err
+			}
+			schemas = append(schemas, pq.QuoteIdentifier(schema))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return false, err
+		}
+
+		roles := make([]string, len(opts.Roles))
+		for i, role := range opts.Roles {
+			roles[i] = pq.QuoteIdentifier(role)
+		}
+		var revoked []string
+		for _, schema := range schemas {
+			for _, stmt := range []string{
+				fmt.Sprintf("REVOKE INSERT, UPDATE, DELETE, TRUNCATE ON ALL TABLES IN SCHEMA %s FROM %s;", schema, strings.Join(roles, ", ")),
+				fmt.Sprintf("REVOKE USAGE, UPDATE ON ALL SEQUENCES IN SCHEMA %s FROM %s;", schema, strings.Join(roles, ", ")),
+			} {
+				if _, err := srcDB.Exec(stmt); err != nil {
+					if len(revoked) == 0 {
+						return false, fmt.Errorf("failed to revoke write privileges in schema %s: %v", schema, err)
+					}
+					return true, fmt.Errorf("failed to revoke write privileges in schema %s, after revoking them in %s: %v",
+						schema, strings.Join(revoked, ", "), err)
+				}
+			}
+			revoked = append(revoked, schema)
+		}
+
+		// Statements already running keep the privileges they were checked
+		// with, so end the sessions of the roles and their members
+		terminated, err := terminateSessions(srcDB,
+			"EXISTS(SELECT 1 FROM unnest($1::text[]) r WHERE pg_has_role(a.usesysid, r, 'member'))", pq.Array(opts.Roles))
+		if err != nil {
+			return true, err
+		}
+		log.Printf("Revoked write privileges from %s in %d schemas; terminated %d sessions.", strings.Join(opts.Roles, ", "), len(schemas), terminated)
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown freeze mode %q (expected %s or %s)", opts.Freeze, FreezeDatabase, FreezeRoles)
+}
+
+// Cutover switches the application over to the target: it stops writes on
+// the source, waits until the subscriber has confirmed every change written
+// before that, synchronizes the sequences and drops the subscription,
+// publication and replication slot. The source stays read-only afterwards.
+// Every table must have finished its initial copy.
+func (r *Replicator) Cutover(ctx context.Context, opts CutoverOptions) (*CutoverResult, error) {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+	// Keep a single session: it was opened before the database became
+	// read-only, so it can still drop the publication afterwards
+	srcDB.SetMaxOpenConns(1)
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	backend, err := r.backend(srcDB, tgtDB)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+
+	status, err := backend.Status(tgtDB, r.names)
+	if err != nil {
+		return nil, err
+	}
+	if status.State != StateReplicating {
+		return nil, fmt.Errorf("subscription '%s' is %s; cutover needs a replicating subscription with every table ready",
+			r.names.Subscription, status.State)
+	}
+	slot := status.SlotName
+	if slot == "" {
+		slot = r.names.Slot
+	}
+
+	// Sequences are synchronized while the source is frozen; make sure they
+	// can be read, and take the margin, before freezing it
+	if err := checkSequences(srcDB, opts.SequenceMargin); err != nil {
+		return nil, err
+	}
+
+	// Once freezing has started, the source refuses (some) application
+	// writes until it is unfrozen by hand, so errors say so
+	frozenErr := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%s; the source remains frozen (%s mode)", fmt.Sprintf(format, args...), opts.Freeze)
+	}
+
+	result := &CutoverResult{}
+	result.FrozenAt = time.Now()
+	if frozen, err := freezeSource(srcDB, opts); err != nil {
+		if frozen {
+			return nil, frozenErr("%v", err)
+		}
+		return nil, err
+	}
+
+	if result.FinalLSN, err = currentLSN(srcDB); err != nil {
+		return nil, frozenErr("failed to read the source WAL position: %v", err)
+	}
+	log.Printf("Waiting for the subscriber to confirm %s...", result.FinalLSN)
+
+	waitCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	for {
+		reached, err := slotConfirmed(srcDB, slot, result.FinalLSN)
+		if err != nil {
+			return nil, frozenErr("%v", err)
+		}
+		if reached {
+			break
+		}
+		select {
+		case <-waitCtx.Done():
+			return nil, frozenErr("subscriber did not confirm %s in time", result.FinalLSN)
+		case <-time.After(opts.PollInterval):
+		}
+	}
+	result.CaughtUp = time.Since(result.FrozenAt)
+	log.Printf("Subscriber caught up with %s after %s.", result.FinalLSN, result.CaughtUp.Round(time.Millisecond))
+
+	if result.Sequences, err = r.SyncSequences(opts.SequenceMargin); err != nil {
+		return nil, frozenErr("%v", err)
+	}
+
+	if err := backend.DropSubscription(tgtDB, r.names); err != nil {
+		return nil, frozenErr("%v", err)
+	}
+	if err := backend.DropPublication(srcDB, r.names); err != nil {
+		return nil, frozenErr("%v", err)
+	}
+	if err := dropSlot(srcDB, slot, 30*time.Second); err != nil {
+		return nil, frozenErr("%v", err)
+	}
+	if err := dropExportSlot(srcDB, cdcSlotName(r.names.Slot), result.FinalLSN); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	result.Frozen = time.Since(result.FrozenAt)
+	return result, nil
+}
+
+// PrintCutoverReport writes the outcome of a cutover
+func PrintCutoverReport(w io.Writer, result *CutoverResult) {
+	fmt.Fprintf(w, "Final source LSN:  %s\n", result.FinalLSN)
+	fmt.Fprintf(w, "Writes frozen at:  %s\n", result.FrozenAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Caught up after:   %s\n", result.CaughtUp.Round(time.Millisecond))
+	fmt.Fprintf(w, "Write freeze:      %s\n", result.Frozen.Round(time.Millisecond))
+	fmt.Fprintf(w, "Sequences synced:  %d\n", len(result.Sequences))
+}
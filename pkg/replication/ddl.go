@@ -0,0 +1,475 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"pg-migration/pkg/schema"
+
+	"github.com/lib/pq"
+)
+
+// ddlSchema holds the DDL capture objects. The schema dump excludes it.
+const ddlSchema = "aiven_db_migrate"
+
+// ddlQueueTable is created on both sides: the queue is a regular table, so
+// the publication for all tables includes it and the target needs a copy
+const ddlQueueTable = `
+CREATE SCHEMA IF NOT EXISTS aiven_db_migrate;
+CREATE TABLE IF NOT EXISTS aiven_db_migrate.ddl_queue (
+    id bigserial PRIMARY KEY,
+    captured_at timestamptz NOT NULL DEFAULT now(),
+    txid bigint NOT NULL,
+    command_tag text NOT NULL,
+    role_name text NOT NULL,
+    search_path text NOT NULL,
+    ddl text NOT NULL
+);
+`
+
+// ddlCaptureTrigger installs the event trigger that records every DDL
+// statement run on the source. current_query() returns the whole statement
+// string sent by the client, which fires the trigger once per command it
+// contains, so a string is only recorded once per transaction.
+const ddlCaptureTrigger = `
+CREATE OR REPLACE FUNCTION aiven_db_migrate.capture_ddl() RETURNS event_trigger
+LANGUAGE plpgsql AS $fn$
+BEGIN
+    IF tg_tag IN ('CREATE PUBLICATION', 'ALTER PUBLICATION', 'DROP PUBLICATION',
+                  'CREATE SUBSCRIPTION', 'ALTER SUBSCRIPTION', 'DROP SUBSCRIPTION') THEN
+        RETURN;
+    END IF;
+    -- Skip commands run by extension scripts, on temporary objects or on the queue itself
+    IF tg_tag NOT LIKE 'DROP %' AND NOT EXISTS (
+        SELECT 1 FROM pg_event_trigger_ddl_commands()
+        WHERE NOT in_extension
+          AND COALESCE(schema_name, '') <> 'aiven_db_migrate'
+          AND COALESCE(schema_name, '') NOT LIKE 'pg_temp%') THEN
+        RETURN;
+    END IF;
+    IF EXISTS (SELECT 1 FROM aiven_db_migrate.ddl_queue
+               WHERE txid = txid_current() AND ddl = current_query()) THEN
+        RETURN;
+    END IF;
+    INSERT INTO aiven_db_migrate.ddl_queue (txid, command_tag, role_name, search_path, ddl)
+    VALUES (txid_current(), tg_tag, current_user, current_setting('search_path'), current_query());
+END
+$fn$;
+DROP EVENT TRIGGER IF EXISTS aiven_db_migrate_ddl_capture;
+CREATE EVENT TRIGGER aiven_db_migrate_ddl_capture ON ddl_command_end
+    EXECUTE PROCEDURE aiven_db_migrate.capture_ddl();
+`
+
+// ddlAppliedTable records on the target which queue entries were applied
+const ddlAppliedTable = `
+CREATE TABLE IF NOT EXISTS aiven_db_migrate.ddl_applied (
+    id bigint PRIMARY KEY,
+    applied_at timestamptz NOT NULL DEFAULT now()
+);
+`
+
+// ddlCommands are the leading keywords of statements that only change the
+// schema. Anything else may change rows, which the subscription already
+// replicates, so replaying it would apply those changes twice.
+var ddlCommands = map[string]bool{
+	"ALTER": true, "COMMENT": true, "CREATE": true, "DROP": true, "GRANT": true,
+	"IMPORT": true, "REFRESH": true, "REINDEX": true, "REVOKE": true, "SECURITY": true,
+}
+
+// reviewDDL returns why a captured statement string cannot be replayed as
+// is, or "" when it can. current_query() records the whole string the client
+// sent, which may hold more than one statement, or a DO block or function
+// call that ran the DDL along with anything else.
+func reviewDDL(ddl string) string {
+	scanner := schema.NewStatementScanner(strings.NewReader(ddl))
+	var commands []string
+	for scanner.Scan() {
+		stmt := scanner.Statement()
+		if stmt.Meta || strings.TrimRight(stmt.SQL, "; \t\r\n") == "" {
+			continue
+		}
+		word := strings.ToUpper(strings.TrimLeft(leadingWord(stmt.SQL), "("))
+		commands = append(commands, word)
+		if command := populatingCommand(stmt.SQL); command != "" {
+			return fmt.Sprintf("it contains %s, which fills a new relation with rows the subscription may already replicate", command)
+		}
+		if !ddlCommands[word] {
+			return fmt.Sprintf("it contains %s, which may change rows the subscription already replicates", word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Sprintf("it could not be split into statements: %v", err)
+	}
+	if len(commands) > 1 {
+		return fmt.Sprintf("it contains %d statements (%s) sent as one string", len(commands), strings.Join(commands, ", "))
+	}
+	return ""
+}
+
+// populatingCommand returns the command of a statement that creates a
+// relation and fills it with the result of a query (CREATE TABLE ... AS,
+// CREATE MATERIALIZED VIEW and SELECT ... INTO unless WITH NO DATA), or ""
+func populatingCommand(sql string) string {
+	words := topLevelWords(sql)
+	withNoData := len(words) >= 3 && strings.Join(words[len(words)-3:], " ") == "WITH NO DATA"
+	contains := func(word string) bool {
+		for _, w := range words {
+			if w == word {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch schema.StatementType(sql) {
+	case "CREATE TABLE":
+		if contains("AS") && !withNoData {
+			return "CREATE TABLE ... AS"
+		}
+	case "CREATE MATERIALIZED VIEW":
+		if !withNoData {
+			return "CREATE MATERIALIZED VIEW"
+		}
+	case "SELECT":
+		if contains("INTO") {
+			return "SELECT ... INTO"
+		}
+	}
+	return ""
+}
+
+// topLevelWords returns the keywords and names of a statement in upper case,
+// leaving out anything in parentheses, quotes or comments
+func topLevelWords(sql string) []string {
+	var words []string
+	depth := 0
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(sql[i+1:], c)
+			if end < 0 {
+				return words
+			}
+			i += end + 2
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				return words
+			}
+			i += end + 1
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i:], "*/")
+			if end < 0 {
+				return words
+			}
+			i += end + 2
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_':
+			end := i + 1
+			for end < len(sql) && (sql[end] >= 'a' && sql[end] <= 'z' || sql[end] >= 'A' && sql[end] <= 'Z' ||
+				sql[end] >= '0' && sql[end] <= '9' || sql[end] == '_' || sql[end] == '$') {
+				end++
+			}
+			if depth == 0 {
+				words = append(words, strings.ToUpper(sql[i:end]))
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+	return words
+}
+
+// leadingWord returns the first keyword of a statement, skipping leading
+// comments
+func leadingWord(sql string) string {
+	for {
+		sql = strings.TrimSpace(sql)
+		switch {
+		case strings.HasPrefix(sql, "--"):
+			if i := strings.IndexByte(sql, '\n'); i >= 0 {
+				sql = sql[i+1:]
+				continue
+			}
+			return ""
+		case strings.HasPrefix(sql, "/*"):
+			if i := strings.Index(sql, "*/"); i >= 0 {
+				sql = sql[i+2:]
+				continue
+			}
+			return ""
+		}
+		end := strings.IndexFunc(sql, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_')
+		})
+		if end < 0 {
+			return sql
+		}
+		return sql[:end]
+	}
+}
+
+// ddlEntry is one captured DDL statement
+type ddlEntry struct {
+	id         int64
+	capturedAt time.Time
+	commandTag string
+	searchPath string
+	ddl        string
+}
+
+// EnableDDLCapture installs the DDL queue and event trigger on the source
+// and prepares the target to receive the queue. Creating event triggers
+// requires superuser privileges on the source.
+func (r *Replicator) EnableDDLCapture() error {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	if _, err := tgtDB.Exec(ddlQueueTable + ddlAppliedTable); err != nil {
+		return fmt.Errorf("failed to create DDL queue on target: %v", err)
+	}
+	if _, err := srcDB.Exec(ddlQueueTable + ddlCaptureTrigger); err != nil {
+		return fmt.Errorf("failed to install DDL capture on source (event triggers require superuser): %v", err)
+	}
+
+	log.Println("DDL capture installed on source database.")
+	return nil
+}
+
+// DisableDDLCapture removes the event trigger and the DDL queue from both databases
+func (r *Replicator) DisableDDLCapture() error {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	drop := fmt.Sprintf("DROP EVENT TRIGGER IF EXISTS aiven_db_migrate_ddl_capture; DROP SCHEMA IF EXISTS %s CASCADE;", ddlSchema)
+	if _, err := srcDB.Exec(drop); err != nil {
+		return fmt.Errorf("failed to remove DDL capture from source: %v", err)
+	}
+	if _, err := tgtDB.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE;", ddlSchema)); err != nil {
+		return fmt.Errorf("failed to remove DDL queue from target: %v", err)
+	}
+
+	log.Println("DDL capture removed from source and target databases.")
+	return nil
+}
+
+// DDLCapturePosition returns the id of the last captured DDL statement on
+// the source, or 0 when nothing was captured or capture is not installed.
+// Reading it before a schema dump tells which entries the dump already covers.
+func (r *Replicator) DDLCapturePosition() (int64, error) {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	var installed bool
+	if err := srcDB.QueryRow("SELECT to_regclass('aiven_db_migrate.ddl_queue') IS NOT NULL;").Scan(&installed); err != nil {
+		return 0, fmt.Errorf("failed to check DDL capture on source: %v", err)
+	}
+	if !installed {
+		return 0, nil
+	}
+
+	var position int64
+	if err := srcDB.QueryRow("SELECT COALESCE(max(id), 0) FROM aiven_db_migrate.ddl_queue;").Scan(&position); err != nil {
+		return 0, fmt.Errorf("failed to read DDL queue position on source: %v", err)
+	}
+	return position, nil
+}
+
+// MarkDDLApplied records that the queue entries up to position are already
+// part of the target schema, e.g. because a schema restore included them
+func (r *Replicator) MarkDDLApplied(position int64) error {
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	// A schema restore drops the target copy of the queue, so recreate it
+	if _, err := tgtDB.Exec(ddlQueueTable + ddlAppliedTable); err != nil {
+		return fmt.Errorf("failed to create DDL queue on target: %v", err)
+	}
+	if position > 0 {
+		if _, err := tgtDB.Exec("INSERT INTO aiven_db_migrate.ddl_applied (id) VALUES ($1) ON CONFLICT DO NOTHING;", position); err != nil {
+			return fmt.Errorf("failed to record DDL position on target: %v", err)
+		}
+	}
+	return nil
+}
+
+// ApplyDDL replays the DDL captured on the source on the target, polling the
+// queue every interval until ctx is cancelled. After applying a batch it
+// refreshes the subscription so new tables start replicating. It stops at
+// the first statement that fails on the target.
+func (r *Replicator) ApplyDDL(ctx context.Context, interval time.Duration) error {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	if _, err := tgtDB.Exec(ddlQueueTable + ddlAppliedTable); err != nil {
+		return fmt.Errorf("failed to create DDL queue on target: %v", err)
+	}
+
+	backend, err := r.backend(srcDB, tgtDB)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Applying captured DDL every %s, press Ctrl+C to stop...", interval)
+	for {
+		applied, err := applyPendingDDL(ctx, srcDB, tgtDB)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			if err := backend.RefreshSubscription(srcDB, tgtDB, r.names); err != nil {
+				return err
+			}
+			log.Printf("Applied %d DDL statements and refreshed subscription '%s'.", applied, r.names.Subscription)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Stopped applying DDL.")
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// applyPendingDDL applies the queue entries after the last applied one and
+// returns how many were applied
+func applyPendingDDL(ctx context.Context, srcDB, tgtDB *sql.DB) (int, error) {
+	var position int64
+	if err := tgtDB.QueryRow("SELECT COALESCE(max(id), 0) FROM aiven_db_migrate.ddl_applied;").Scan(&position); err != nil {
+		return 0, fmt.Errorf("failed to read applied DDL position on target: %v", err)
+	}
+
+	rows, err := srcDB.QueryContext(ctx, `
+		SELECT id, captured_at, command_tag, search_path, ddl
+		FROM aiven_db_migrate.ddl_queue
+		WHERE id > $1
+		ORDER BY id;
+	`, position)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read DDL queue on source (is DDL capture enabled?): %v", err)
+	}
+	var entries []ddlEntry
+	for rows.Next() {
+		var e ddlEntry
+		if err := rows.Scan(&e.id, &e.capturedAt, &e.commandTag, &e.searchPath, &e.ddl); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, e := range entries {
+		if reason := reviewDDL(e.ddl); reason != "" {
+			return i, fmt.Errorf("DDL %d needs manual review: %s\n%s\nApply its schema changes on the target by hand, then mark the statement as applied with: INSERT INTO aiven_db_migrate.ddl_applied (id) VALUES (%d);",
+				e.id, reason, e.ddl, e.id)
+		}
+		log.Printf("Applying DDL %d (%s) captured at %s", e.id, e.commandTag, e.capturedAt.Format(time.RFC3339))
+		if err := applyDDLEntry(tgtDB, e); err != nil {
+			return i, fmt.Errorf("failed to apply DDL %d on target: %v\n%s\nFix the target manually, then mark the statement as applied with: INSERT INTO aiven_db_migrate.ddl_applied (id) VALUES (%d);",
+				e.id, err, e.ddl, e.id)
+		}
+	}
+	return len(entries), nil
+}
+
+// applyDDLEntry runs one captured statement with the source search_path and
+// records it as applied in the same transaction. Statements that cannot run
+// in a transaction block (e.g. CREATE INDEX CONCURRENTLY) are retried outside
+// of one.
+func applyDDLEntry(tgtDB *sql.DB, e ddlEntry) error {
+	ctx := context.Background()
+	conn, err := tgtDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("SELECT set_config('search_path', $1, true);", e.searchPath); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(e.ddl); err != nil {
+		tx.Rollback()
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "25001" { // active_sql_transaction
+			return applyDDLOutsideTransaction(ctx, conn, e)
+		}
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO aiven_db_migrate.ddl_applied (id) VALUES ($1);", e.id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyDDLOutsideTransaction runs a statement that refuses transaction blocks
+func applyDDLOutsideTransaction(ctx context.Context, conn *sql.Conn, e ddlEntry) error {
+	if _, err := conn.ExecContext(ctx, "SELECT set_config('search_path', $1, false);", e.searchPath); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "RESET search_path;")
+
+	if _, err := conn.ExecContext(ctx, e.ddl); err != nil {
+		return err
+	}
+	_, err := conn.ExecContext(ctx, "INSERT INTO aiven_db_migrate.ddl_applied (id) VALUES ($1);", e.id)
+	return err
+}
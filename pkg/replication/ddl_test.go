@@ -0,0 +1,34 @@
+package replication
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReviewDDL(t *testing.T) {
+	tests := []struct {
+		name string
+		ddl  string
+		want string // Part of the reason, or "" when the statement can be replayed
+	}{
+		{name: "create table", ddl: "CREATE TABLE public.a (id int GENERATED ALWAYS AS IDENTITY, b int GENERATED ALWAYS AS (id * 2) STORED);"},
+		{name: "alter table", ddl: "-- add a column\nALTER TABLE public.a ADD COLUMN note text;"},
+		{name: "create table as", ddl: "CREATE TABLE public.b AS SELECT * FROM public.a;", want: "CREATE TABLE ... AS"},
+		{name: "create table as with column names", ddl: "CREATE UNLOGGED TABLE IF NOT EXISTS b (x, y) AS VALUES (1, 2);", want: "CREATE TABLE ... AS"},
+		{name: "create table as with no data", ddl: "CREATE TABLE public.b AS SELECT * FROM public.a WITH NO DATA;"},
+		{name: "create materialized view", ddl: "CREATE MATERIALIZED VIEW public.mv AS SELECT id FROM public.a;", want: "CREATE MATERIALIZED VIEW"},
+		{name: "create materialized view with no data", ddl: "CREATE MATERIALIZED VIEW public.mv AS SELECT id FROM public.a WITH NO DATA;"},
+		{name: "select into", ddl: "SELECT * INTO public.b FROM public.a;", want: "SELECT ... INTO"},
+		{name: "data change", ddl: "UPDATE public.a SET note = 'as';", want: "UPDATE"},
+		{name: "several statements", ddl: "ALTER TABLE a ADD COLUMN x int; DROP TABLE b;", want: "2 statements"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := reviewDDL(tt.ddl)
+			if (got == "") != (tt.want == "") || !strings.Contains(got, tt.want) {
+				t.Errorf("reviewDDL(%q) = %q, want %q", tt.ddl, got, tt.want)
+			}
+		})
+	}
+}
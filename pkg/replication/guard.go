@@ -0,0 +1,125 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// GuardOptions control GuardWAL
+type GuardOptions struct {
+	Interval  time.Duration
+	SoftLimit int64 // Warn once a slot retains this many bytes of WAL
+	HardLimit int64 // Past this many bytes, warn loudly or protect the source; 0 for none
+	Protect   bool  // Past HardLimit, disable the subscription and drop the slot
+}
+
+// guardedSlots returns the slots of the migration to watch: the slot the
+// subscription records, or the migration slot when the target cannot be
+// asked, and the default export slot. Missing slots are skipped when read.
+func (r *Replicator) guardedSlots(srcDB, tgtDB *sql.DB) (Backend, []string) {
+	slot := r.names.Slot
+	var backend Backend
+	if tgtDB.Ping() == nil {
+		if b, err := r.backend(srcDB, tgtDB); err == nil {
+			backend = b
+			if status, err := b.Status(tgtDB, r.names); err == nil && status.SlotName != "" {
+				slot = status.SlotName
+			}
+		}
+	}
+	return backend, []string{slot, cdcSlotName(r.names.Slot)}
+}
+
+// protectSource disables the subscription, if the target can be reached, and
+// drops the slot. A walsender still holding the slot, e.g. of a subscriber
+// that cannot be reached to disable it, is terminated first.
+func (r *Replicator) protectSource(srcDB, tgtDB *sql.DB, backend Backend, slot *SlotStatus) error {
+	if backend != nil && slot.Name != cdcSlotName(r.names.Slot) {
+		if err := backend.DisableSubscription(tgtDB, r.names); err != nil {
+			log.Printf("Warning: %v; dropping the slot anyway", err)
+		}
+	}
+	if slot.Active && slot.ActivePID != 0 {
+		if _, err := srcDB.Exec("SELECT pg_terminate_backend($1);", slot.ActivePID); err != nil {
+			return fmt.Errorf("failed to terminate walsender %d of replication slot '%s': %v", slot.ActivePID, slot.Name, err)
+		}
+	}
+	return dropSlot(srcDB, slot.Name, 30*time.Second)
+}
+
+// GuardWAL watches how much WAL the migration's replication slots retain on
+// the source, every opts.Interval until ctx is cancelled. A stuck subscriber
+// makes its slot retain WAL until the source disk fills. Past the soft
+// limit a warning is logged; past the hard limit the subscription is
+// disabled and the slot dropped when opts.Protect is set, which ends the
+// migration, and GuardWAL returns an error saying so. Slots whose WAL the
+// server already removed (wal_status lost, PostgreSQL 13+) are reported too.
+func (r *Replicator) GuardWAL(ctx context.Context, opts GuardOptions) error {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	backend, slots := r.guardedSlots(srcDB, tgtDB)
+	limits := fmt.Sprintf("soft limit %s", formatBytes(opts.SoftLimit))
+	if opts.HardLimit > 0 {
+		limits += fmt.Sprintf(", hard limit %s", formatBytes(opts.HardLimit))
+		if opts.Protect {
+			limits += " (drops the slot)"
+		}
+	}
+	log.Printf("Watching WAL retained by slots %v every %s, %s; press Ctrl+C to stop...", slots, opts.Interval, limits)
+
+	for {
+		for _, name := range slots {
+			slot, err := slotStatus(srcDB, name)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+				continue
+			}
+			if !slot.Exists {
+				continue
+			}
+
+			state := ""
+			if slot.WALStatus != "" {
+				state = fmt.Sprintf(" (wal_status %s)", slot.WALStatus)
+			}
+			switch {
+			case slot.WALStatus == "lost":
+				log.Printf("Error: replication slot '%s' has lost WAL it needs; replication from it cannot continue, tear the migration down and start over.", name)
+			case opts.HardLimit > 0 && slot.RetainedBytes >= opts.HardLimit:
+				log.Printf("Error: replication slot '%s' retains %s of WAL%s, past the hard limit of %s.", name, formatBytes(slot.RetainedBytes), state, formatBytes(opts.HardLimit))
+				if opts.Protect {
+					if err := r.protectSource(srcDB, tgtDB, backend, slot); err != nil {
+						return err
+					}
+					return fmt.Errorf("replication slot '%s' was dropped to protect the source after retaining %s of WAL; the migration has to be set up again", name, formatBytes(slot.RetainedBytes))
+				}
+			case slot.RetainedBytes >= opts.SoftLimit:
+				log.Printf("Warning: replication slot '%s' retains %s of WAL%s, past the soft limit of %s; check the subscriber.", name, formatBytes(slot.RetainedBytes), state, formatBytes(opts.SoftLimit))
+			case slot.WALStatus == "unreserved":
+				log.Printf("Warning: replication slot '%s' is past max_slot_wal_keep_size; its WAL is removed at the next checkpoint unless the subscriber catches up.", name)
+			default:
+				log.Printf("Replication slot '%s' retains %s of WAL%s.", name, formatBytes(slot.RetainedBytes), state)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Stopped watching WAL retention.")
+			return nil
+		case <-time.After(opts.Interval):
+		}
+	}
+}
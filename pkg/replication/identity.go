@@ -0,0 +1,197 @@
+package replication
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Replica identity fix modes for tables that cannot replicate UPDATE/DELETE
+const (
+	IdentityFixNone        = ""              // Only report the tables
+	IdentityFixIndex       = "index"         // REPLICA IDENTITY USING INDEX where a suitable index exists
+	IdentityFixFull        = "full"          // REPLICA IDENTITY FULL
+	IdentityFixIndexOrFull = "index-or-full" // USING INDEX where possible, FULL otherwise
+)
+
+// IdentityIssue is a table whose UPDATE and DELETE statements cannot be
+// published because it has neither a primary key nor a replica identity
+type IdentityIssue struct {
+	Schema          string
+	Table           string
+	ReplicaIdentity string // pg_class.relreplident: d, n, f or i
+	CandidateIndex  string // Unique index usable as replica identity, if any
+}
+
+// QualifiedName returns the quoted schema-qualified table name
+func (i IdentityIssue) QualifiedName() string {
+	return pq.QuoteIdentifier(i.Schema) + "." + pq.QuoteIdentifier(i.Table)
+}
+
+// Suggestion returns the statement that would fix the table
+func (i IdentityIssue) Suggestion() string {
+	if i.CandidateIndex != "" {
+		return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY USING INDEX %s;", i.QualifiedName(), pq.QuoteIdentifier(i.CandidateIndex))
+	}
+	return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL; -- or add a primary key", i.QualifiedName())
+}
+
+// replicaIdentityQuery lists permanent user tables without a usable replica
+// identity, together with the narrowest unique index that could serve as
+// one: it must be unique, immediate, valid, non-partial, without expressions
+// and cover only NOT NULL columns.
+const replicaIdentityQuery = `
+SELECT n.nspname, c.relname, c.relreplident,
+       COALESCE((
+           SELECT i.relname
+           FROM pg_index x
+           JOIN pg_class i ON i.oid = x.indexrelid
+           WHERE x.indrelid = c.oid
+             AND x.indisunique AND x.indimmediate AND x.indisvalid
+             AND x.indpred IS NULL AND x.indexprs IS NULL
+             AND NOT EXISTS (
+                 SELECT 1 FROM pg_attribute a
+                 WHERE a.attrelid = c.oid
+                   AND a.attnum = ANY (x.indkey)
+                   AND NOT a.attnotnull
+             )
+           ORDER BY x.indnatts, i.relname
+           LIMIT 1
+       ), '') AS candidate
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r'
+  AND c.relpersistence = 'p'
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+  AND n.nspname NOT LIKE 'pg_temp%'
+  AND NOT EXISTS (
+      SELECT 1 FROM pg_depend d
+      WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'
+  )
+  AND (
+      c.relreplident = 'n'
+      OR (c.relreplident = 'd' AND NOT EXISTS (
+          SELECT 1 FROM pg_index x WHERE x.indrelid = c.oid AND x.indisprimary))
+      OR (c.relreplident = 'i' AND NOT EXISTS (
+          SELECT 1 FROM pg_index x WHERE x.indrelid = c.oid AND x.indisreplident))
+  )
+ORDER BY n.nspname, c.relname;
+`
+
+// findIdentityIssues lists the tables that cannot replicate UPDATE/DELETE
+func findIdentityIssues(db *sql.DB) ([]IdentityIssue, error) {
+	rows, err := db.Query(replicaIdentityQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var issues []IdentityIssue
+	for rows.Next() {
+		var issue IdentityIssue
+		if err := rows.Scan(&issue.Schema, &issue.Table, &issue.ReplicaIdentity, &issue.CandidateIndex); err != nil {
+			return nil, err
+		}
+		issues = append(issues, issue)
+	}
+	return issues, rows.Err()
+}
+
+// fixStatement returns the ALTER TABLE statement for the given fix mode, or
+// an empty string when the mode does not cover the table
+func fixStatement(issue IdentityIssue, mode string) string {
+	switch mode {
+	case IdentityFixIndex:
+		if issue.CandidateIndex == "" {
+			return ""
+		}
+		return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY USING INDEX %s;", issue.QualifiedName(), pq.QuoteIdentifier(issue.CandidateIndex))
+	case IdentityFixIndexOrFull:
+		if issue.CandidateIndex != "" {
+			return fixStatement(issue, IdentityFixIndex)
+		}
+		return fixStatement(issue, IdentityFixFull)
+	case IdentityFixFull:
+		return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL;", issue.QualifiedName())
+	}
+	return ""
+}
+
+// CheckReplicaIdentity lists the source tables without a primary key or
+// replica identity and, depending on the configured fix mode, sets one. The
+// same replica identity is applied on the target, which needs it to locate
+// the rows of replicated UPDATE and DELETE statements. It returns the
+// tables that still have no usable replica identity.
+func (r *Replicator) CheckReplicaIdentity() ([]IdentityIssue, error) {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	found, err := findIdentityIssues(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check replica identities on source: %v", err)
+	}
+
+	// With an explicit table list, unpublished tables are left alone
+	published, err := r.publishedTableSet(srcDB)
+	if err != nil {
+		return nil, err
+	}
+	var issues []IdentityIssue
+	for _, issue := range found {
+		if published == nil || published[issue.QualifiedName()] {
+			issues = append(issues, issue)
+		}
+	}
+	if len(issues) == 0 {
+		log.Println("All published source tables have a primary key or replica identity.")
+		return nil, nil
+	}
+
+	for _, issue := range issues {
+		log.Printf("Table %s has no primary key or replica identity; suggested fix: %s", issue.QualifiedName(), issue.Suggestion())
+	}
+
+	if r.identityFix == IdentityFixNone {
+		return issues, nil
+	}
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	var remaining []IdentityIssue
+	for _, issue := range issues {
+		stmt := fixStatement(issue, r.identityFix)
+		if stmt == "" {
+			remaining = append(remaining, issue)
+			continue
+		}
+		if _, err := srcDB.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("failed to set replica identity of %s on source: %v", issue.QualifiedName(), err)
+		}
+		if _, err := tgtDB.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("failed to set replica identity of %s on target: %v", issue.QualifiedName(), err)
+		}
+		log.Printf("Applied on source and target: %s", stmt)
+	}
+
+	return remaining, nil
+}
+
+// identityIssueNames formats the tables of the given issues for error messages
+func identityIssueNames(issues []IdentityIssue) string {
+	names := make([]string, len(issues))
+	for i, issue := range issues {
+		names[i] = issue.QualifiedName()
+	}
+	return strings.Join(names, ", ")
+}
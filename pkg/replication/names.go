@@ -0,0 +1,201 @@
+package replication
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+
+	"pg-migration/pkg/config"
+)
+
+// namePattern is what PostgreSQL accepts for replication slot names; the
+// same rule is applied to publication and subscription names
+var namePattern = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+// migrationIDPattern keeps derived names within the 63 byte identifier limit
+var migrationIDPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// Names are the replication objects belonging to one migration
+type Names struct {
+	Publication  string
+	Subscription string
+	Slot         string
+}
+
+// DefaultMigrationID derives a migration ID from the target host, port and
+// database, so migrations from one source to different targets do not share
+// replication objects
+func DefaultMigrationID(target *config.DBConfig) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d/%s", target.Host, target.Port, target.Database)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// legacyNames are the fixed object names of migrations started before the
+// names included a migration ID
+var legacyNames = Names{
+	Publication:  "aiven_db_migrate_pub",
+	Subscription: "aiven_db_migrate_sub",
+	Slot:         "aiven_db_migrate_slot",
+}
+
+// NamesForMigration returns the default object names for a migration ID
+func NamesForMigration(id string) Names {
+	prefix := "aiven_db_migrate_" + id
+	return Names{
+		Publication:  prefix + "_pub",
+		Subscription: prefix + "_sub",
+		Slot:         prefix + "_slot",
+	}
+}
+
+// SetMigrationID names the replication objects after the given migration ID.
+// Names set explicitly with SetNames are kept.
+func (r *Replicator) SetMigrationID(id string) error {
+	if !migrationIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid migration ID %q: use up to 32 lowercase letters, digits and underscores", id)
+	}
+	defaults := NamesForMigration(id)
+	current := NamesForMigration(r.migrationID)
+	if r.names.Publication == current.Publication {
+		r.names.Publication = defaults.Publication
+	}
+	if r.names.Subscription == current.Subscription {
+		r.names.Subscription = defaults.Subscription
+	}
+	if r.names.Slot == current.Slot {
+		r.names.Slot = defaults.Slot
+	}
+	r.migrationID = id
+	return nil
+}
+
+// SetNames overrides the publication, subscription and slot names. Empty
+// names keep the ones derived from the migration ID.
+func (r *Replicator) SetNames(publication, subscription, slot string) error {
+	for _, name := range []string{publication, subscription, slot} {
+		if name != "" && !namePattern.MatchString(name) {
+			return fmt.Errorf("invalid replication object name %q: use up to 63 lowercase letters, digits and underscores", name)
+		}
+	}
+	if publication != "" {
+		r.names.Publication = publication
+	}
+	if subscription != "" {
+		r.names.Subscription = subscription
+	}
+	if slot != "" {
+		r.names.Slot = slot
+	}
+	return nil
+}
+
+// MigrationID returns the ID the replication objects are named after
+func (r *Replicator) MigrationID() string {
+	return r.migrationID
+}
+
+// Names returns the replication object names of this migration
+func (r *Replicator) Names() Names {
+	return r.names
+}
+
+// Slots returns the source replication slots this migration creates: the
+// migration slot and the default export slot
+func (r *Replicator) Slots() []string {
+	return []string{r.names.Slot, cdcSlotName(r.names.Slot)}
+}
+
+// namesInUse reports whether a replication object of the given names exists:
+// the slot, publication or replication set on the source, or the
+// subscription on the target. A side that cannot be reached is skipped.
+func namesInUse(srcDB, tgtDB *sql.DB, names Names) (bool, error) {
+	type check struct {
+		db    *sql.DB
+		side  string
+		query string
+		name  string
+	}
+	var checks []check
+
+	if srcDB.Ping() == nil {
+		checks = append(checks, check{srcDB, "source", "SELECT EXISTS(SELECT 1 FROM pg_replication_slots WHERE slot_name = $1);", names.Slot})
+		version, err := serverVersion(srcDB)
+		if err != nil {
+			return false, fmt.Errorf("failed to check source server version: %v", err)
+		}
+		if version >= 100000 {
+			checks = append(checks, check{srcDB, "source", "SELECT EXISTS(SELECT 1 FROM pg_publication WHERE pubname = $1);", names.Publication})
+		}
+		pglogical, err := checkExtensionInstalled(srcDB, "pglogical")
+		if err != nil {
+			return false, fmt.Errorf("failed to check pglogical extension on source: %v", err)
+		}
+		if pglogical {
+			checks = append(checks, check{srcDB, "source", "SELECT EXISTS(SELECT 1 FROM pglogical.replication_set WHERE set_name = $1);", names.Publication})
+		}
+	}
+
+	if tgtDB.Ping() == nil {
+		version, err := serverVersion(tgtDB)
+		if err != nil {
+			return false, fmt.Errorf("failed to check target server version: %v", err)
+		}
+		if version >= 100000 {
+			checks = append(checks, check{tgtDB, "target", `
+				SELECT EXISTS(SELECT 1 FROM pg_subscription s JOIN pg_database d ON d.oid = s.subdbid
+				              WHERE s.subname = $1 AND d.datname = current_database());`, names.Subscription})
+		}
+		pglogical, err := checkExtensionInstalled(tgtDB, "pglogical")
+		if err != nil {
+			return false, fmt.Errorf("failed to check pglogical extension on target: %v", err)
+		}
+		if pglogical {
+			checks = append(checks, check{tgtDB, "target", "SELECT EXISTS(SELECT 1 FROM pglogical.subscription WHERE sub_name = $1);", names.Subscription})
+		}
+	}
+
+	for _, c := range checks {
+		var exists bool
+		if err := c.db.QueryRow(c.query, c.name).Scan(&exists); err != nil {
+			return false, fmt.Errorf("failed to look up '%s' on %s: %v", c.name, c.side, err)
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UseLegacyNames switches to the fixed object names of migrations started
+// before the names included a migration ID, when nothing exists under the
+// current names but something does under the legacy ones, so those
+// migrations can still be inspected, completed and torn down. It reports
+// whether the names were switched.
+func (r *Replicator) UseLegacyNames() (bool, error) {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	if current, err := namesInUse(srcDB, tgtDB, r.names); err != nil || current {
+		return false, err
+	}
+	legacy, err := namesInUse(srcDB, tgtDB, legacyNames)
+	if err != nil || !legacy {
+		return false, err
+	}
+	log.Printf("No replication objects found for migration %s, using those of the earlier migration: publication '%s', subscription '%s', slot '%s'",
+		r.migrationID, legacyNames.Publication, legacyNames.Subscription, legacyNames.Slot)
+	r.names = legacyNames
+	return true, nil
+}
@@ -0,0 +1,431 @@
+package replication
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// partitionedTable is the root of a partition hierarchy
+type partitionedTable struct {
+	Schema   string
+	Name     string
+	Strategy string     // pg_partitioned_table.partstrat: r (range), l (list) or h (hash)
+	Leaves   []leafInfo // Leaf partitions at any depth
+}
+
+// QualifiedName returns the quoted schema-qualified table name
+func (p *partitionedTable) QualifiedName() string {
+	return pq.QuoteIdentifier(p.Schema) + "." + pq.QuoteIdentifier(p.Name)
+}
+
+// leafInfo is a leaf partition with its full partition constraint
+type leafInfo struct {
+	name       string // Quoted schema-qualified name
+	constraint string // Empty when the leaf accepts every row
+}
+
+// keyColumn is a partition key column of a hierarchy
+type keyColumn struct {
+	name     string
+	typeName string
+}
+
+// PartitionIssue is a problem that would keep partitioned rows from being
+// applied on the target
+type PartitionIssue struct {
+	Table    string
+	Problem  string
+	Blocking bool // False for checks that could not be carried out
+}
+
+// partitionRootsQuery lists the roots of all partition hierarchies
+const partitionRootsQuery = `
+SELECT n.nspname, c.relname, p.partstrat
+FROM pg_partitioned_table p
+JOIN pg_class c ON c.oid = p.partrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE NOT c.relispartition
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+ORDER BY n.nspname, c.relname;
+`
+
+// partitionTree is a recursive query over pg_inherits for the relations of a
+// hierarchy, its root included. pg_partition_tree does the same but only
+// exists on PostgreSQL 12+.
+const partitionTree = `
+WITH RECURSIVE tree(relid) AS (
+    SELECT $1::regclass::oid
+    UNION ALL
+    SELECT i.inhrelid FROM pg_inherits i JOIN tree ON i.inhparent = tree.relid
+)`
+
+// partitionLeavesQuery lists the leaf partitions of a hierarchy
+const partitionLeavesQuery = partitionTree + `
+SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+       COALESCE(pg_get_partition_constraintdef(c.oid), '')
+FROM tree t
+JOIN pg_class c ON c.oid = t.relid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind <> 'p'
+ORDER BY 1;
+`
+
+// partitionKeysQuery lists the key columns used at any level of a hierarchy
+// and whether any level is partitioned by an expression
+const partitionKeysQuery = partitionTree + `
+SELECT COALESCE(a.attname, ''), COALESCE(format_type(a.atttypid, a.atttypmod), '')
+FROM tree t
+JOIN pg_partitioned_table p ON p.partrelid = t.relid
+CROSS JOIN LATERAL unnest(p.partattrs::int2[]) AS k(attnum)
+LEFT JOIN pg_attribute a ON a.attrelid = t.relid AND a.attnum = k.attnum
+GROUP BY 1, 2
+ORDER BY 1;
+`
+
+// listPartitionedTables returns the partition hierarchies of a database keyed
+// by their quoted schema-qualified root name
+func listPartitionedTables(db *sql.DB) (map[string]*partitionedTable, error) {
+	rows, err := db.Query(partitionRootsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := map[string]*partitionedTable{}
+	for rows.Next() {
+		table := &partitionedTable{}
+		if err := rows.Scan(&table.Schema, &table.Name, &table.Strategy); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables[table.QualifiedName()] = table
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, table := range tables {
+		leafRows, err := db.Query(partitionLeavesQuery, name)
+		if err != nil {
+			return nil, err
+		}
+		for leafRows.Next() {
+			var leaf leafInfo
+			if err := leafRows.Scan(&leaf.name, &leaf.constraint); err != nil {
+				leafRows.Close()
+				return nil, err
+			}
+			table.Leaves = append(table.Leaves, leaf)
+		}
+		leafRows.Close()
+		if err := leafRows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return tables, nil
+}
+
+// partitionKeys returns the key columns of a hierarchy. ok is false when a
+// level is partitioned by an expression, which cannot be sampled.
+func partitionKeys(db *sql.DB, root string) (keys []keyColumn, ok bool, err error) {
+	rows, err := db.Query(partitionKeysQuery, root)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	ok = true
+	for rows.Next() {
+		var key keyColumn
+		if err := rows.Scan(&key.name, &key.typeName); err != nil {
+			return nil, false, err
+		}
+		if key.name == "" {
+			ok = false
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, ok, rows.Err()
+}
+
+// sortedTableNames returns the keys of a hierarchy map in a stable order
+func sortedTableNames(tables map[string]*partitionedTable) []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tableExists reports whether a relation with the given quoted name exists
+func tableExists(db *sql.DB, name string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL;", name).Scan(&exists)
+	return exists, err
+}
+
+// CheckPartitions detects partitioned tables and validates that the rows
+// published for them can be applied on the target. Without
+// publish_via_partition_root changes are published under the leaf partition
+// names, so every source leaf must exist on the target. With it, changes are
+// published under the root name and routed by the target's own partition
+// layout, so sample partition keys from every source partition are checked
+// against the target's partition constraints.
+func (r *Replicator) CheckPartitions() ([]PartitionIssue, error) {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	// Declarative partitioning appeared in PostgreSQL 10; older sources
+	// replicate through pglogical and have no partitioned tables
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check source server version: %v", err)
+	}
+	if version < 100000 {
+		return nil, nil
+	}
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	srcTables, err := listPartitionedTables(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitioned tables on source: %v", err)
+	}
+	tgtTables, err := listPartitionedTables(tgtDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitioned tables on target: %v", err)
+	}
+	if len(srcTables) == 0 && len(tgtTables) == 0 {
+		return nil, nil
+	}
+	log.Printf("Found %d partitioned tables on source and %d on target", len(srcTables), len(tgtTables))
+
+	var issues []PartitionIssue
+	for _, name := range sortedTableNames(srcTables) {
+		table := srcTables[name]
+		if r.publishViaRoot {
+			exists, err := tableExists(tgtDB, name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up %s on target: %v", name, err)
+			}
+			if !exists {
+				issues = append(issues, PartitionIssue{Table: name, Blocking: true,
+					Problem: "published via the partition root, but the root table does not exist on target"})
+			}
+			continue
+		}
+
+		for _, leaf := range table.Leaves {
+			exists, err := tableExists(tgtDB, leaf.name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up %s on target: %v", leaf.name, err)
+			}
+			if !exists {
+				issues = append(issues, PartitionIssue{Table: leaf.name, Blocking: true,
+					Problem: fmt.Sprintf("partition of %s is published under its own name but does not exist on target; enable publish_via_partition_root", name)})
+			}
+		}
+	}
+
+	// Rows reach a partitioned target table under its own name when the
+	// source table is not partitioned or is published via its root
+	for _, name := range sortedTableNames(tgtTables) {
+		table := tgtTables[name]
+		srcTable, srcPartitioned := srcTables[name]
+		if srcPartitioned && !r.publishViaRoot {
+			continue
+		}
+
+		var sources []string
+		if srcPartitioned {
+			for _, leaf := range srcTable.Leaves {
+				sources = append(sources, leaf.name)
+			}
+		} else {
+			exists, err := tableExists(srcDB, name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up %s on source: %v", name, err)
+			}
+			if !exists {
+				continue
+			}
+			sources = []string{name}
+		}
+
+		tableIssues, err := validateRouting(srcDB, tgtDB, table, sources)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate partition layout of %s: %v", name, err)
+		}
+		issues = append(issues, tableIssues...)
+	}
+
+	return issues, nil
+}
+
+// validateRouting checks that sample partition keys read from the source
+// relations are accepted by at least one leaf of the target hierarchy
+func validateRouting(srcDB, tgtDB *sql.DB, target *partitionedTable, sources []string) ([]PartitionIssue, error) {
+	name := target.QualifiedName()
+
+	keys, ok, err := partitionKeys(tgtDB, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []PartitionIssue{{Table: name,
+			Problem: "target is partitioned by an expression; partition routing could not be validated"}}, nil
+	}
+	if len(target.Leaves) == 0 {
+		return []PartitionIssue{{Table: name, Blocking: true,
+			Problem: "target table is partitioned but has no partitions to accept rows"}}, nil
+	}
+
+	var accepts []string
+	for _, leaf := range target.Leaves {
+		if leaf.constraint == "" {
+			return nil, nil // This leaf accepts every row
+		}
+		accepts = append(accepts, "COALESCE(("+leaf.constraint+"), false)")
+	}
+
+	columns := make([]string, len(keys))
+	for i, key := range keys {
+		columns[i] = pq.QuoteIdentifier(key.name)
+	}
+
+	var issues []PartitionIssue
+	for _, source := range sources {
+		samples, err := sampleKeys(srcDB, source, columns, target.Strategy == "l")
+		if err != nil {
+			return nil, fmt.Errorf("failed to sample partition keys of %s on source: %v", source, err)
+		}
+		if len(samples) == 0 {
+			continue
+		}
+
+		values := make([]string, len(samples))
+		for i, sample := range samples {
+			literals := make([]string, len(keys))
+			for j, value := range sample {
+				literal := "NULL"
+				if value.Valid {
+					literal = pq.QuoteLiteral(value.String)
+				}
+				literals[j] = literal + "::" + keys[j].typeName
+			}
+			values[i] = "(" + strings.Join(literals, ", ") + ")"
+		}
+
+		query := fmt.Sprintf("SELECT count(*) FROM (VALUES %s) AS v(%s) WHERE NOT (%s);",
+			strings.Join(values, ", "), strings.Join(columns, ", "), strings.Join(accepts, " OR "))
+
+		var rejected int
+		if err := tgtDB.QueryRow(query).Scan(&rejected); err != nil {
+			return nil, err
+		}
+		if rejected > 0 {
+			issues = append(issues, PartitionIssue{Table: name, Blocking: true,
+				Problem: fmt.Sprintf("%d of %d sampled partition keys from %s have no matching partition on target; add the missing partitions or a DEFAULT partition",
+					rejected, len(samples), source)})
+		}
+	}
+	return issues, nil
+}
+
+// maxDistinctSamples bounds the distinct key values read from one relation
+const maxDistinctSamples = 1000
+
+// sampleKeys reads partition key values from a source relation. For list
+// partitioned targets every value matters, so all distinct values are read
+// when there are not too many of them. Otherwise the lowest and highest key
+// in key order are used, which covers the bounds of range partitions.
+func sampleKeys(db *sql.DB, relation string, columns []string, distinct bool) ([][]sql.NullString, error) {
+	asText := make([]string, len(columns))
+	descending := make([]string, len(columns))
+	for i, column := range columns {
+		asText[i] = column + "::text"
+		descending[i] = column + " DESC"
+	}
+	selectList := strings.Join(asText, ", ")
+
+	if distinct {
+		samples, err := queryKeys(db, fmt.Sprintf("SELECT DISTINCT %s FROM ONLY %s LIMIT %d;",
+			selectList, relation, maxDistinctSamples+1), len(columns))
+		if err != nil || len(samples) <= maxDistinctSamples {
+			return samples, err
+		}
+	}
+
+	first, err := queryKeys(db, fmt.Sprintf("SELECT %s FROM ONLY %s ORDER BY %s LIMIT 1;",
+		selectList, relation, strings.Join(columns, ", ")), len(columns))
+	if err != nil {
+		return nil, err
+	}
+	last, err := queryKeys(db, fmt.Sprintf("SELECT %s FROM ONLY %s ORDER BY %s LIMIT 1;",
+		selectList, relation, strings.Join(descending, ", ")), len(columns))
+	if err != nil {
+		return nil, err
+	}
+	return append(first, last...), nil
+}
+
+// queryKeys runs a query returning key tuples as text
+func queryKeys(db *sql.DB, query string, width int) ([][]sql.NullString, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result [][]sql.NullString
+	for rows.Next() {
+		tuple := make([]sql.NullString, width)
+		dest := make([]interface{}, width)
+		for i := range tuple {
+			dest[i] = &tuple[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result = append(result, tuple)
+	}
+	return result, rows.Err()
+}
+
+// PrintPartitionIssues writes the partition issues found by CheckPartitions
+func PrintPartitionIssues(w io.Writer, issues []PartitionIssue) {
+	for _, issue := range issues {
+		level := "WARN"
+		if issue.Blocking {
+			level = "FAIL"
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", level, issue.Table, issue.Problem)
+	}
+}
+
+// blockingPartitionIssues counts the issues that prevent replication
+func blockingPartitionIssues(issues []PartitionIssue) int {
+	count := 0
+	for _, issue := range issues {
+		if issue.Blocking {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,391 @@
+package replication
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// pglogical allows one local node per database, so migrations from the same
+// source share the provider node, and migrations to the same target share
+// the subscriber node. Existing nodes are reused whatever their name.
+const (
+	pglogicalProviderNode   = "aiven_db_migrate_provider"
+	pglogicalSubscriberNode = "aiven_db_migrate_subscriber"
+)
+
+// pglogicalSyncStates maps pglogical.local_sync_status.sync_status
+var pglogicalSyncStates = map[string]string{
+	"i": SyncInit,
+	"s": SyncCopy, // Structure
+	"d": SyncCopy, // Data
+	"c": SyncCopy, // Constraints
+	"w": SyncCatchup,
+	"u": SyncCatchup,
+	"y": SyncCatchup,
+	"r": SyncReady,
+}
+
+// pglogicalStates maps the status reported by pglogical.show_subscription_status
+var pglogicalStates = map[string]string{
+	"initializing": StateInitializing,
+	"replicating":  StateReplicating,
+	"down":         StateDown,
+	"disabled":     StateDisabled,
+}
+
+// pglogicalUnsetTablesQuery lists the source tables that are not yet in the
+// replication set. Partitioned parents are skipped, their partitions are
+// replicated as regular tables.
+const pglogicalUnsetTablesQuery = `
+SELECT c.oid::regclass::text
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r'
+  AND c.relpersistence = 'p'
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema', 'pglogical')
+  AND n.nspname NOT LIKE 'pg_toast%'
+  AND NOT EXISTS (
+      SELECT 1
+      FROM pglogical.replication_set_table rt
+      JOIN pglogical.replication_set rs ON rs.set_id = rt.set_id
+      WHERE rs.set_name = $1 AND rt.set_reloid = c.oid)
+ORDER BY 1;
+`
+
+// pglogicalBackend replicates with the pglogical extension, for sources
+// older than PostgreSQL 10. The publication name is used for the
+// replication set. pglogical names the replication slot itself, so the
+// configured slot name is not used.
+type pglogicalBackend struct {
+	sourceDSN string           // Used for the provider node
+	targetDSN string           // Used for the subscriber node
+	tables    []PublishedTable // Explicit table list; refreshes add no other tables
+}
+
+func (pglogicalBackend) Name() string { return BackendPglogical }
+
+// Prepare installs pglogical on both databases. The provider and subscriber
+// nodes are created along with the replication set and the subscription.
+func (pglogicalBackend) Prepare(srcDB, tgtDB *sql.DB, _ PublicationConfig) error {
+	for _, side := range []struct {
+		name string
+		db   *sql.DB
+	}{{"source", srcDB}, {"target", tgtDB}} {
+		installed, err := checkExtensionInstalled(side.db, "pglogical")
+		if err != nil {
+			return fmt.Errorf("failed to check pglogical extension on %s: %v", side.name, err)
+		}
+		if !installed {
+			log.Printf("pglogical extension not found on %s database, attempting to install it...", side.name)
+			if err := installExtension(side.db, "pglogical"); err != nil {
+				return fmt.Errorf("failed to install pglogical extension on %s (it must be in shared_preload_libraries): %v", side.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ensureNode creates the local pglogical node unless one exists
+func ensureNode(db queryer, side, name, dsn string) error {
+	var existing sql.NullString
+	err := db.QueryRow("SELECT n.node_name FROM pglogical.local_node l JOIN pglogical.node n ON n.node_id = l.node_id;").Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read pglogical node on %s: %v", side, err)
+	}
+	if existing.Valid {
+		log.Printf("Using existing pglogical node '%s' on %s database.", existing.String, side)
+		return nil
+	}
+
+	if _, err := db.Exec("SELECT pglogical.create_node(node_name := $1, dsn := $2);", name, dsn); err != nil {
+		return fmt.Errorf("failed to create pglogical node on %s: %v", side, err)
+	}
+	log.Printf("Created pglogical node '%s' on %s database.", name, side)
+	return nil
+}
+
+// addTablesToSet adds the tables missing from the replication set: those of
+// an explicit table list, or else all source tables. With synchronize,
+// subscribers copy their existing rows.
+func addTablesToSet(srcDB queryer, set string, tables []PublishedTable, synchronize bool) ([]string, error) {
+	rows, err := srcDB.Query(pglogicalUnsetTablesQuery, set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables for replication set: %v", err)
+	}
+	unset := map[string]bool{}
+	var all []PublishedTable
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		unset[table] = true
+		all = append(all, PublishedTable{Table: table})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(tables) == 0 {
+		tables = all
+	}
+
+	var added []string
+	for _, t := range tables {
+		var oid string
+		if err := srcDB.QueryRow("SELECT $1::regclass::text;", t.Table).Scan(&oid); err != nil {
+			return nil, fmt.Errorf("failed to look up %s: %v", t.Table, err)
+		}
+		if !unset[oid] {
+			continue
+		}
+
+		// NULL columns and row_filter replicate whole tables
+		var columns interface{}
+		if len(t.Columns) > 0 {
+			columns = pq.Array(t.Columns)
+		}
+		rowFilter := sql.NullString{String: t.Where, Valid: t.Where != ""}
+		if _, err := srcDB.Exec(`SELECT pglogical.replication_set_add_table(set_name := $1, relation := $2::regclass,
+			synchronize_data := $3, columns := $4::text[], row_filter := $5);`,
+			set, t.Table, synchronize, columns, rowFilter); err != nil {
+			return nil, fmt.Errorf("failed to add %s to replication set: %v", t.Table, err)
+		}
+		added = append(added, oid)
+	}
+	return added, nil
+}
+
+// CreatePublication (re)creates the replication set with the published
+// tables. pglogical supports column lists and row filters itself, whatever
+// the server version, but has no equivalent of publish_via_partition_root.
+func (b pglogicalBackend) CreatePublication(srcDB queryer, names Names, pub PublicationConfig, publishViaRoot bool) error {
+	if publishViaRoot {
+		return fmt.Errorf("the pglogical backend cannot publish partitions via the partition root")
+	}
+	if err := ensureNode(srcDB, "source", pglogicalProviderNode, b.sourceDSN); err != nil {
+		return err
+	}
+
+	if _, err := srcDB.Exec("SELECT pglogical.drop_replication_set(set_name := $1, ifexists := true);", names.Publication); err != nil {
+		return fmt.Errorf("failed to drop existing replication set: %v", err)
+	}
+	if _, err := srcDB.Exec(`SELECT pglogical.create_replication_set(set_name := $1, replicate_insert := true,
+		replicate_update := true, replicate_delete := true, replicate_truncate := $2);`, names.Publication, pub.Truncate); err != nil {
+		return fmt.Errorf("failed to create replication set on source: %v", err)
+	}
+
+	// The subscription copies the initial data of the whole set
+	added, err := addTablesToSet(srcDB, names.Publication, pub.Tables, false)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replication set '%s' created with %d tables.", names.Publication, len(added))
+	return nil
+}
+
+// CreateSubscription (re)creates the pglogical subscription to the
+// replication set. The schema is restored separately, so pglogical only
+// copies the data.
+func (b pglogicalBackend) CreateSubscription(tgtDB *sql.DB, names Names, sourceConnStr string) error {
+	if err := ensureNode(tgtDB, "target", pglogicalSubscriberNode, b.targetDSN); err != nil {
+		return err
+	}
+
+	if _, err := tgtDB.Exec("SELECT pglogical.drop_subscription(subscription_name := $1, ifexists := true);", names.Subscription); err != nil {
+		return fmt.Errorf("failed to drop existing subscription: %v", err)
+	}
+	log.Printf("Dropped existing subscription '%s' (if any) on target database.", names.Subscription)
+
+	createSubQuery := `
+		SELECT pglogical.create_subscription(subscription_name := $1, provider_dsn := $2,
+			replication_sets := ARRAY[$3::text], synchronize_structure := false, synchronize_data := true);
+	`
+	if _, err := tgtDB.Exec(createSubQuery, names.Subscription, sourceConnStr, names.Publication); err != nil {
+		return fmt.Errorf("failed to create subscription on target: %v", err)
+	}
+	return nil
+}
+
+// RefreshSubscription adds tables created since setup to the replication set;
+// pglogical then copies them to the subscribers
+func (b pglogicalBackend) RefreshSubscription(srcDB, tgtDB *sql.DB, names Names) error {
+	added, err := addTablesToSet(srcDB, names.Publication, b.tables, true)
+	if err != nil {
+		return err
+	}
+	if len(added) > 0 {
+		log.Printf("Added %d tables to replication set '%s'.", len(added), names.Publication)
+	}
+	return nil
+}
+
+// ReconcilePublication removes the tables no longer listed from the
+// replication set, adds the missing ones, which pglogical then copies to the
+// subscribers, and updates whether TRUNCATE is replicated
+func (pglogicalBackend) ReconcilePublication(srcDB *sql.DB, names Names, pub PublicationConfig, publishViaRoot bool) ([]string, []string, error) {
+	if publishViaRoot {
+		return nil, nil, fmt.Errorf("the pglogical backend cannot publish partitions via the partition root")
+	}
+	var exists bool
+	if err := srcDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pglogical.replication_set WHERE set_name = $1);", names.Publication).Scan(&exists); err != nil {
+		return nil, nil, fmt.Errorf("failed to read replication set '%s': %v", names.Publication, err)
+	}
+	if !exists {
+		return nil, nil, errPublicationMissing
+	}
+
+	var removed []string
+	if len(pub.Tables) > 0 {
+		desired := map[string]bool{}
+		for _, t := range pub.Tables {
+			var table string
+			if err := srcDB.QueryRow("SELECT $1::regclass::text;", t.Table).Scan(&table); err != nil {
+				return nil, nil, fmt.Errorf("failed to look up %s: %v", t.Table, err)
+			}
+			desired[table] = true
+		}
+
+		rows, err := srcDB.Query(`
+			SELECT rt.set_reloid::regclass::text
+			FROM pglogical.replication_set_table rt
+			JOIN pglogical.replication_set rs ON rs.set_id = rt.set_id
+			WHERE rs.set_name = $1
+			ORDER BY 1;
+		`, names.Publication)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list tables of replication set '%s': %v", names.Publication, err)
+		}
+		for rows.Next() {
+			var table string
+			if err := rows.Scan(&table); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			if !desired[table] {
+				removed = append(removed, table)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		for _, table := range removed {
+			if _, err := srcDB.Exec("SELECT pglogical.replication_set_remove_table(set_name := $1, relation := $2::regclass);", names.Publication, table); err != nil {
+				return nil, nil, fmt.Errorf("failed to remove %s from replication set: %v", table, err)
+			}
+		}
+	}
+
+	added, err := addTablesToSet(srcDB, names.Publication, pub.Tables, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := srcDB.Exec("SELECT pglogical.alter_replication_set(set_name := $1, replicate_truncate := $2);", names.Publication, pub.Truncate); err != nil {
+		return nil, nil, fmt.Errorf("failed to update replication set '%s': %v", names.Publication, err)
+	}
+	return added, removed, nil
+}
+
+// Status maps pglogical's subscription and table sync status to the common model
+func (pglogicalBackend) Status(tgtDB *sql.DB, names Names) (*Status, error) {
+	status := &Status{Backend: BackendPglogical, Subscription: names.Subscription}
+
+	var subID int64
+	err := tgtDB.QueryRow("SELECT sub_id, sub_slot_name FROM pglogical.subscription WHERE sub_name = $1;", names.Subscription).Scan(&subID, &status.SlotName)
+	if err == sql.ErrNoRows {
+		status.State = StateMissing
+		return status, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscription '%s': %v", names.Subscription, err)
+	}
+
+	var raw string
+	if err := tgtDB.QueryRow("SELECT status FROM pglogical.show_subscription_status($1);", names.Subscription).Scan(&raw); err != nil {
+		return nil, fmt.Errorf("failed to read status of subscription '%s': %v", names.Subscription, err)
+	}
+
+	rows, err := tgtDB.Query(`
+		SELECT quote_ident(sync_nspname) || '.' || quote_ident(sync_relname), sync_status,
+		       COALESCE(sync_statuslsn::text, '')
+		FROM pglogical.local_sync_status
+		WHERE sync_subid = $1 AND sync_relname IS NOT NULL
+		ORDER BY 1;
+	`, subID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscription tables: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t TableSync
+		if err := rows.Scan(&t.Table, &t.Raw, &t.LSN); err != nil {
+			return nil, err
+		}
+		t.State = mapSyncState(pglogicalSyncStates, t.Raw)
+		status.Tables = append(status.Tables, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// pglogical reports "replicating" while tables are still copying
+	state, ok := pglogicalStates[raw]
+	if !ok {
+		state = StateDown
+	}
+	if state == StateReplicating {
+		state = subscriptionState(true, true, status.Tables)
+	}
+	status.State = state
+	return status, nil
+}
+
+func (pglogicalBackend) DisableSubscription(tgtDB *sql.DB, names Names) error {
+	var exists bool
+	if err := tgtDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pglogical.subscription WHERE sub_name = $1);", names.Subscription).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up subscription '%s': %v", names.Subscription, err)
+	}
+	if !exists {
+		return nil
+	}
+	if _, err := tgtDB.Exec("SELECT pglogical.alter_subscription_disable(subscription_name := $1, immediate := true);", names.Subscription); err != nil {
+		return fmt.Errorf("failed to disable subscription '%s': %v", names.Subscription, err)
+	}
+	log.Printf("Disabled subscription '%s' on target database.", names.Subscription)
+	return nil
+}
+
+// DropSubscription disables and drops the pglogical subscription. pglogical
+// drops the slot on the provider when it is reachable.
+func (pglogicalBackend) DropSubscription(tgtDB *sql.DB, names Names) error {
+	var exists bool
+	if err := tgtDB.QueryRow("SELECT EXISTS(SELECT 1 FROM pglogical.subscription WHERE sub_name = $1);", names.Subscription).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up subscription '%s': %v", names.Subscription, err)
+	}
+	if !exists {
+		return nil
+	}
+	if _, err := tgtDB.Exec("SELECT pglogical.alter_subscription_disable(subscription_name := $1, immediate := true);", names.Subscription); err != nil {
+		return fmt.Errorf("failed to disable subscription '%s': %v", names.Subscription, err)
+	}
+	if _, err := tgtDB.Exec("SELECT pglogical.drop_subscription(subscription_name := $1, ifexists := true);", names.Subscription); err != nil {
+		return fmt.Errorf("failed to drop subscription '%s': %v", names.Subscription, err)
+	}
+	log.Printf("Dropped subscription '%s' on target database.", names.Subscription)
+	return nil
+}
+
+// DropPublication drops the replication set used as publication
+func (pglogicalBackend) DropPublication(srcDB *sql.DB, names Names) error {
+	if _, err := srcDB.Exec("SELECT pglogical.drop_replication_set(set_name := $1, ifexists := true);", names.Publication); err != nil {
+		return fmt.Errorf("failed to drop replication set '%s': %v", names.Publication, err)
+	}
+	log.Printf("Dropped replication set '%s' (if any) on source database.", names.Publication)
+	return nil
+}
@@ -0,0 +1,186 @@
+package replication
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// PublishedTable is a table of an explicit publication table list
+type PublishedTable struct {
+	Table   string   `json:"table"`   // Table name, schema-qualified unless in public
+	Columns []string `json:"columns"` // Column list (PostgreSQL 15+), all columns if empty
+	Where   string   `json:"where"`   // Row filter expression (PostgreSQL 15+)
+}
+
+// Filtered reports whether the table has a column list or row filter
+func (t PublishedTable) Filtered() bool {
+	return len(t.Columns) > 0 || t.Where != ""
+}
+
+// PublicationConfig selects the tables and operations the publication carries
+type PublicationConfig struct {
+	Tables   []PublishedTable `json:"tables"`   // All tables when empty
+	Truncate bool             `json:"truncate"` // Also publish TRUNCATE (PostgreSQL 11+)
+}
+
+// LoadPublicationConfig reads a publication config from a JSON file
+func LoadPublicationConfig(path string) (*PublicationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read publication config: %v", err)
+	}
+
+	var cfg PublicationConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse publication config %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// SetPublication sets the tables and operations to publish. Without tables,
+// all tables are published.
+func (r *Replicator) SetPublication(cfg PublicationConfig) error {
+	seen := map[string]bool{}
+	for _, t := range cfg.Tables {
+		if t.Table == "" {
+			return fmt.Errorf("publication table without a name")
+		}
+		if seen[t.Table] {
+			return fmt.Errorf("table %s is listed twice in the publication", t.Table)
+		}
+		seen[t.Table] = true
+	}
+	r.publication = cfg
+	return nil
+}
+
+// resolvePublishedTables replaces the table names with their quoted
+// schema-qualified form, failing for tables missing on the source
+func resolvePublishedTables(srcDB *sql.DB, tables []PublishedTable) ([]PublishedTable, error) {
+	resolved := make([]PublishedTable, len(tables))
+	for i, t := range tables {
+		var schema, name string
+		err := srcDB.QueryRow(`
+			SELECT n.nspname, c.relname
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.oid = to_regclass($1);
+		`, t.Table).Scan(&schema, &name)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("published table %s does not exist on the source", t.Table)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up published table %s: %v", t.Table, err)
+		}
+		t.Table = pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+		resolved[i] = t
+	}
+	return resolved, nil
+}
+
+// checkPublicationSupport fails for options the source version lacks
+func checkPublicationSupport(srcDB *sql.DB, pub PublicationConfig) error {
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return fmt.Errorf("failed to check source server version: %v", err)
+	}
+	if pub.Truncate && version < 110000 {
+		return fmt.Errorf("publishing TRUNCATE requires PostgreSQL 11 or later on the source, found %d", version)
+	}
+	for _, t := range pub.Tables {
+		if t.Filtered() && version < 150000 {
+			return fmt.Errorf("column lists and row filters (table %s) require PostgreSQL 15 or later on the source, found %d", t.Table, version)
+		}
+	}
+	return nil
+}
+
+// publishedOperations returns the publish parameter of the publication
+func publishedOperations(pub PublicationConfig) string {
+	if pub.Truncate {
+		return "insert, update, delete, truncate"
+	}
+	return "insert, update, delete"
+}
+
+// publicationTableSpec formats one table of a TABLE list, with its column
+// list and row filter
+func publicationTableSpec(t PublishedTable) string {
+	spec := t.Table
+	if len(t.Columns) > 0 {
+		columns := make([]string, len(t.Columns))
+		for i, column := range t.Columns {
+			columns[i] = pq.QuoteIdentifier(column)
+		}
+		spec += " (" + strings.Join(columns, ", ") + ")"
+	}
+	if t.Where != "" {
+		spec += " WHERE (" + t.Where + ")"
+	}
+	return spec
+}
+
+// publicationTableList formats a TABLE list for CREATE and ALTER
+// PUBLICATION. The TABLE keyword is not repeated, which servers older than
+// PostgreSQL 15 do not accept.
+func publicationTableList(tables []PublishedTable) string {
+	specs := make([]string, len(tables))
+	for i, t := range tables {
+		specs[i] = publicationTableSpec(t)
+	}
+	return "TABLE " + strings.Join(specs, ", ")
+}
+
+// publicationTarget returns the FOR clause of CREATE PUBLICATION
+func publicationTarget(pub PublicationConfig) string {
+	if len(pub.Tables) == 0 {
+		return "FOR ALL TABLES"
+	}
+	return "FOR " + publicationTableList(pub.Tables)
+}
+
+// validatePublishedIdentity checks that UPDATE and DELETE on the filtered
+// tables still work on the source. PostgreSQL rejects them when a row filter
+// or column list does not cover the replica identity, which is only checked
+// when a statement runs; EXPLAIN runs the same check without touching rows.
+// The publication is dropped again when the check fails.
+func validatePublishedIdentity(srcDB queryer, names Names, pub PublicationConfig) error {
+	for _, t := range pub.Tables {
+		if !t.Filtered() {
+			continue
+		}
+		if _, err := srcDB.Exec(fmt.Sprintf("EXPLAIN DELETE FROM %s;", t.Table)); err != nil {
+			// A transaction is rolled back by the caller instead
+			if _, inTx := srcDB.(*sql.Tx); !inTx {
+				if dropErr := dropPublication(srcDB, names.Publication); dropErr != nil {
+					log.Printf("Warning: %v", dropErr)
+				}
+			}
+			return fmt.Errorf("the filters of %s would make UPDATE and DELETE on it fail on the source (the column list and row filter must cover the replica identity): %v", t.Table, err)
+		}
+	}
+	return nil
+}
+
+// publishedTableSet returns the quoted names of the published tables, or nil
+// when all tables are published
+func (r *Replicator) publishedTableSet(srcDB *sql.DB) (map[string]bool, error) {
+	if len(r.publication.Tables) == 0 {
+		return nil, nil
+	}
+	tables, err := resolvePublishedTables(srcDB, r.publication.Tables)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, t := range tables {
+		set[t.Table] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,320 @@
+package replication
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// errPublicationMissing is returned by ReconcilePublication when there
+	// is no publication to reconcile
+	errPublicationMissing = errors.New("publication does not exist")
+	// errPublicationMode is returned by ReconcilePublication when the
+	// publication would have to switch between all tables and a table list,
+	// which ALTER PUBLICATION cannot do
+	errPublicationMode = errors.New("publication cannot switch between all tables and a table list")
+)
+
+// SetRecreatePublication allows ReconcileReplication to drop and recreate a
+// publication that has to switch between all tables and a table list while
+// the subscription is using it
+func (r *Replicator) SetRecreatePublication(enabled bool) {
+	r.recreatePublication = enabled
+}
+
+// ReconcileResult lists the changes made by ReconcileReplication
+type ReconcileResult struct {
+	Added     []string // Tables added to the publication
+	Removed   []string // Tables removed from the publication
+	Recreated bool     // The publication or subscription had to be created anew
+}
+
+// publicationMembers returns the quoted names of the tables explicitly
+// added to a publication. pg_publication_rel is used rather than
+// pg_publication_tables, which lists partitions instead of their roots.
+func publicationMembers(srcDB *sql.DB, publication string) (map[string]bool, error) {
+	rows, err := srcDB.Query(`
+		SELECT n.nspname, c.relname
+		FROM pg_publication_rel pr
+		JOIN pg_publication p ON p.oid = pr.prpubid
+		JOIN pg_class c ON c.oid = pr.prrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE p.pubname = $1;
+	`, publication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables of publication '%s': %v", publication, err)
+	}
+	defer rows.Close()
+
+	members := map[string]bool{}
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			return nil, err
+		}
+		members[pq.QuoteIdentifier(schema)+"."+pq.QuoteIdentifier(table)] = true
+	}
+	return members, rows.Err()
+}
+
+// publicationFilters returns the column list and row filter of each table
+// explicitly added to a publication, keyed by its quoted name. Both exist
+// from PostgreSQL 15.
+func publicationFilters(tx *sql.Tx, publication string) (map[string]string, error) {
+	rows, err := tx.Query(`
+		SELECT n.nspname, c.relname,
+		       COALESCE((SELECT string_agg(quote_ident(a.attname), ', ' ORDER BY a.attnum)
+		                 FROM pg_attribute a
+		                 WHERE a.attrelid = pr.prrelid AND a.attnum = ANY(pr.prattrs::int2[])), ''),
+		       COALESCE(pg_get_expr(pr.prqual, pr.prrelid), '')
+		FROM pg_publication_rel pr
+		JOIN pg_publication p ON p.oid = pr.prpubid
+		JOIN pg_class c ON c.oid = pr.prrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE p.pubname = $1;
+	`, publication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read filters of publication '%s': %v", publication, err)
+	}
+	defer rows.Close()
+
+	filters := map[string]string{}
+	for rows.Next() {
+		var schema, table, columns, where string
+		if err := rows.Scan(&schema, &table, &columns, &where); err != nil {
+			return nil, err
+		}
+		filters[pq.QuoteIdentifier(schema)+"."+pq.QuoteIdentifier(table)] = "(" + columns + ") WHERE " + where
+	}
+	return filters, rows.Err()
+}
+
+// updatePublicationFilters sets the column lists and row filters of the
+// published tables with ALTER PUBLICATION ... SET TABLE and returns the
+// tables whose filters changed. The server normalizes filter expressions, so
+// the change is compared on what it stores, and rolled back when nothing
+// changed. Rows already copied are not re-copied under the new filters.
+func updatePublicationFilters(srcDB *sql.DB, publication string, tables []PublishedTable) ([]string, error) {
+	tx, err := srcDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // No-op once the transaction is committed
+
+	before, err := publicationFilters(tx, publication)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("ALTER PUBLICATION %s SET %s;", pq.QuoteIdentifier(publication), publicationTableList(tables))); err != nil {
+		return nil, fmt.Errorf("failed to set column lists and row filters of publication '%s': %v", publication, err)
+	}
+	after, err := publicationFilters(tx, publication)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, t := range tables {
+		if before[t.Table] == after[t.Table] {
+			continue
+		}
+		// As on creation, filters that do not cover the replica identity
+		// would break UPDATE and DELETE on the source
+		if t.Filtered() {
+			if _, err := tx.Exec(fmt.Sprintf("EXPLAIN DELETE FROM %s;", t.Table)); err != nil {
+				return nil, fmt.Errorf("the new filters of %s would make UPDATE and DELETE on it fail on the source (the column list and row filter must cover the replica identity), so they were not applied: %v", t.Table, err)
+			}
+		}
+		changed = append(changed, t.Table)
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit publication filters: %v", err)
+	}
+	return changed, nil
+}
+
+// reconcilePublication brings a publication in line with pub using ALTER
+// PUBLICATION, for the backends that use publications
+func reconcilePublication(srcDB *sql.DB, names Names, pub PublicationConfig, publishViaRoot bool) (added, removed []string, err error) {
+	var allTables bool
+	err = srcDB.QueryRow("SELECT puballtables FROM pg_publication WHERE pubname = $1;", names.Publication).Scan(&allTables)
+	if err == sql.ErrNoRows {
+		return nil, nil, errPublicationMissing
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read publication '%s': %v", names.Publication, err)
+	}
+	if allTables != (len(pub.Tables) == 0) {
+		return nil, nil, errPublicationMode
+	}
+	publication := pq.QuoteIdentifier(names.Publication)
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check source server version: %v", err)
+	}
+
+	if !allTables {
+		members, err := publicationMembers(srcDB, names.Publication)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var toAdd []PublishedTable
+		desired := map[string]bool{}
+		for _, t := range pub.Tables {
+			desired[t.Table] = true
+			if !members[t.Table] {
+				toAdd = append(toAdd, t)
+				added = append(added, t.Table)
+			}
+		}
+		for table := range members {
+			if !desired[table] {
+				removed = append(removed, table)
+			}
+		}
+
+		if len(removed) > 0 {
+			if _, err := srcDB.Exec(fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s;", publication, strings.Join(removed, ", "))); err != nil {
+				return nil, nil, fmt.Errorf("failed to remove tables from publication: %v", err)
+			}
+		}
+		if len(toAdd) > 0 {
+			if _, err := srcDB.Exec(fmt.Sprintf("ALTER PUBLICATION %s ADD %s;", publication, publicationTableList(toAdd))); err != nil {
+				return nil, nil, fmt.Errorf("failed to add tables to publication: %v", err)
+			}
+		}
+
+		// As on creation, filters that do not cover the replica identity
+		// would break UPDATE and DELETE on the source
+		for _, t := range toAdd {
+			if !t.Filtered() {
+				continue
+			}
+			if _, err := srcDB.Exec(fmt.Sprintf("EXPLAIN DELETE FROM %s;", t.Table)); err != nil {
+				if _, dropErr := srcDB.Exec(fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s;", publication, t.Table)); dropErr != nil {
+					log.Printf("Warning: failed to remove %s from publication again: %v", t.Table, dropErr)
+				}
+				return nil, nil, fmt.Errorf("the filters of %s would make UPDATE and DELETE on it fail on the source (the column list and row filter must cover the replica identity), so it was not added: %v", t.Table, err)
+			}
+		}
+
+		// Tables that stay may have a new column list or row filter
+		if version >= 150000 {
+			changed, err := updatePublicationFilters(srcDB, names.Publication, pub.Tables)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, table := range changed {
+				log.Printf("Updated the column list and row filter of %s; rows already copied are not copied again.", table)
+			}
+		}
+	}
+
+	options := fmt.Sprintf("publish = '%s'", publishedOperations(pub))
+	if version >= 130000 {
+		options += fmt.Sprintf(", publish_via_partition_root = %t", publishViaRoot)
+	}
+	if _, err := srcDB.Exec(fmt.Sprintf("ALTER PUBLICATION %s SET (%s);", publication, options)); err != nil {
+		return nil, nil, fmt.Errorf("failed to set options of publication '%s': %v", names.Publication, err)
+	}
+	return added, removed, nil
+}
+
+// recreatePublication drops and creates the publication in one source
+// transaction, so the walsender decoding for the subscription never finds
+// it missing, which would stop replication with an error
+func recreatePublication(srcDB *sql.DB, backend Backend, names Names, pub PublicationConfig, publishViaRoot bool) error {
+	tx, err := srcDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // No-op once the transaction is committed
+
+	if err := backend.CreatePublication(tx, names, pub, publishViaRoot); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit recreated publication '%s': %v", names.Publication, err)
+	}
+	return nil
+}
+
+// ReconcileReplication updates the publication of an existing migration to
+// the configured tables and options instead of recreating it: tables are
+// added and removed, and their filters updated, with ALTER PUBLICATION and
+// the subscription is
+// refreshed, which copies the rows of the added tables only. Tables that
+// stay keep their sync state. Without an existing subscription, replication
+// is set up from scratch.
+func (r *Replicator) ReconcileReplication() (*ReconcileResult, error) {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	backend, err := r.backend(srcDB, tgtDB)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := backend.Status(tgtDB, r.names)
+	if err != nil {
+		return nil, err
+	}
+	if status.State == StateMissing {
+		log.Printf("Subscription '%s' does not exist, setting up replication from scratch.", r.names.Subscription)
+		if err := r.SetupReplication(); err != nil {
+			return nil, err
+		}
+		return &ReconcileResult{Recreated: true}, nil
+	}
+
+	pub := r.publication
+	if pub.Tables, err = resolvePublishedTables(srcDB, pub.Tables); err != nil {
+		return nil, err
+	}
+	if backend.Name() != BackendPglogical {
+		if err := checkPublicationSupport(srcDB, pub); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ReconcileResult{}
+	result.Added, result.Removed, err = backend.ReconcilePublication(srcDB, r.names, pub, r.publishViaRoot)
+	if errors.Is(err, errPublicationMode) && !r.recreatePublication {
+		return nil, fmt.Errorf("%v; the subscription is using publication '%s', pass --recreate-publication to drop and recreate it anyway", err, r.names.Publication)
+	}
+	if errors.Is(err, errPublicationMissing) || errors.Is(err, errPublicationMode) {
+		// The subscription finds the recreated publication by name, and
+		// keeps the sync state of the tables that stay in it
+		log.Printf("Recreating publication '%s': %v", r.names.Publication, err)
+		if err := recreatePublication(srcDB, backend, r.names, pub, r.publishViaRoot); err != nil {
+			return nil, err
+		}
+		result.Recreated = true
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := backend.RefreshSubscription(srcDB, tgtDB, r.names); err != nil {
+		return nil, err
+	}
+	log.Printf("Publication '%s' reconciled: %d tables added, %d removed.", r.names.Publication, len(result.Added), len(result.Removed))
+	return result, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"pg-migration/pkg/config"
+	"pg-migration/pkg/preflight"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
@@ -13,16 +14,55 @@ import (
 type Replicator struct {
 	source *config.DBConfig
 	target *config.DBConfig
+
+	migrationID    string
+	names          Names
+	backendName    string
+	identityFix    string
+	publishViaRoot bool
+	publication    PublicationConfig
+
+	recreatePublication bool
 }
 
-// NewReplicator creates a new Replicator instance.
+// NewReplicator creates a new Replicator instance. Its replication objects
+// are named after the default migration ID of the target (see SetMigrationID).
 func NewReplicator(source, target *config.DBConfig) *Replicator {
+	id := DefaultMigrationID(target)
 	return &Replicator{
-		source: source,
-		target: target,
+		source:      source,
+		target:      target,
+		migrationID: id,
+		names:       NamesForMigration(id),
+		backendName: BackendAuto,
 	}
 }
 
+// SetReplicaIdentityFix sets how tables without a primary key or replica
+// identity are fixed before the publication is created (see IdentityFix*)
+func (r *Replicator) SetReplicaIdentityFix(mode string) error {
+	switch mode {
+	case IdentityFixNone, IdentityFixIndex, IdentityFixFull, IdentityFixIndexOrFull:
+		r.identityFix = mode
+		return nil
+	}
+	return fmt.Errorf("unknown replica identity fix mode %q (expected %s, %s or %s)",
+		mode, IdentityFixIndex, IdentityFixFull, IdentityFixIndexOrFull)
+}
+
+// SetPublishViaPartitionRoot publishes changes to partitions under the name of
+// their partition root, so the target may use a different partition layout
+func (r *Replicator) SetPublishViaPartitionRoot(enabled bool) {
+	r.publishViaRoot = enabled
+}
+
+// serverVersion returns the server_version_num of the connected server
+func serverVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT current_setting('server_version_num')::int;").Scan(&version)
+	return version, err
+}
+
 // checkExtensionInstalled verifies if a given extension (e.g., aiven_extras) is installed.
 func checkExtensionInstalled(db *sql.DB, extName string) (bool, error) {
 	var exists bool
@@ -41,25 +81,29 @@ func installExtension(db *sql.DB, extName string) error {
 	return err
 }
 
-// checkWalLevel verifies if wal_level is set to 'logical'
-func checkWalLevel(db *sql.DB) (bool, error) {
-	var walLevel string
-	query := "SHOW wal_level;"
-	err := db.QueryRow(query).Scan(&walLevel)
-	if err != nil {
-		return false, err
-	}
-	return walLevel == "logical", nil
-}
-
-
 // SetupReplication sets up logical replication between the source and target
-// databases using the Aiven Extras extension. It creates a publication on the
-// source and a subscription on the target.
+// databases. It creates a publication on the source and a subscription on the
+// target through the configured backend (see SetBackend).
 //
 // NOTE: We have now modified the logic so that if a publication or subscription
 // already exists, it is dropped first. This is important for applying schema changes.
 func (r *Replicator) SetupReplication() error {
+	log.Printf("Migration ID %s: publication '%s', subscription '%s', slot '%s'",
+		r.migrationID, r.names.Publication, r.names.Subscription, r.names.Slot)
+
+	// Check the server settings before anything is created. The slots of
+	// an earlier attempt are replaced, so they do not count as used.
+	checker := preflight.NewChecker(r.source, r.target)
+	checker.SetMigrationSlots(r.Slots()...)
+	report, err := checker.RunReplication()
+	if err != nil {
+		return err
+	}
+	report.Print(log.Writer())
+	if report.Failed() {
+		return fmt.Errorf("replication preflight failed, nothing was created; fix the problems above")
+	}
+
 	// Connect to source database.
 	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
 	if err != nil {
@@ -67,44 +111,6 @@ func (r *Replicator) SetupReplication() error {
 	}
 	defer srcDB.Close()
 
-	// Check if the aiven_extras extension is installed on the source.
-	installed, err := checkExtensionInstalled(srcDB, "aiven_extras")
-	if err != nil {
-		return fmt.Errorf("failed to check aiven_extras extension on source: %v", err)
-	}
-
-	// Install aiven_extras if not found.
-	if !installed {
-		log.Println("aiven_extras extension not found on source database, attempting to install it...")
-		if err := installExtension(srcDB, "aiven_extras"); err != nil {
-			return fmt.Errorf("failed to install aiven_extras extension on source: %v", err)
-		}
-		log.Println("Successfully installed aiven_extras extension on source database.")
-	}
-
-
-
-
-	// Define the publication name.
-	pubName := "aiven_db_migrate_pub"
-
-	// FIX: Instead of skipping creation if the publication exists,
-	// we drop any existing publication to account for schema changes.
-	dropPubQuery := fmt.Sprintf("DROP PUBLICATION IF EXISTS %s;", pubName)
-	if _, err := srcDB.Exec(dropPubQuery); err != nil {
-		return fmt.Errorf("failed to drop existing publication: %v", err)
-	}
-	log.Printf("Dropped existing publication '%s' (if any) on source database.", pubName)
-
-	// Create publication on the source using the Aiven Extras function.
-	createPubQuery := `
-		SELECT * FROM aiven_extras.pg_create_publication_for_all_tables($1, 'INSERT,UPDATE,DELETE');
-	`
-	if _, err := srcDB.Exec(createPubQuery, pubName); err != nil {
-		return fmt.Errorf("failed to create publication on source: %v", err)
-	}
-	log.Printf("Publication '%s' created on source database.", pubName)
-
 	// Connect to target database.
 	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
 	if err != nil {
@@ -112,50 +118,75 @@ func (r *Replicator) SetupReplication() error {
 	}
 	defer tgtDB.Close()
 
-	// Check if the aiven_extras extension is installed on the target.
-	installed, err = checkExtensionInstalled(tgtDB, "aiven_extras")
+	backend, err := r.backend(srcDB, tgtDB)
 	if err != nil {
-		return fmt.Errorf("failed to check aiven_extras extension on target: %v", err)
+		return err
 	}
-
-	// Install aiven_extras on target if not found.
-	if !installed {
-		log.Println("aiven_extras extension not found on target database, attempting to install it...")
-		if err := installExtension(tgtDB, "aiven_extras"); err != nil {
-			return fmt.Errorf("failed to install aiven_extras extension on target: %v", err)
-		}
-		log.Println("Successfully installed aiven_extras extension on target database.")
+	if err := backend.Prepare(srcDB, tgtDB, r.publication); err != nil {
+		return err
 	}
 
-	// Check if wal_level is set to 'logical' on target.
-	_, err = checkWalLevel(tgtDB)
+	// Tables without a replica identity would reject UPDATE and DELETE on the
+	// source as soon as they are published, so check them first.
+	remaining, err := r.CheckReplicaIdentity()
 	if err != nil {
-		return fmt.Errorf("failed to check wal_level on target: %v", err)
+		return err
+	}
+	if len(remaining) > 0 {
+		return fmt.Errorf("tables without primary key or replica identity would reject UPDATE/DELETE once published: %s; set a replica identity (see the suggestions above) before setting up replication",
+			identityIssueNames(remaining))
 	}
 
-	
+	if r.publishViaRoot {
+		version, err := serverVersion(srcDB)
+		if err != nil {
+			return fmt.Errorf("failed to check source server version: %v", err)
+		}
+		if version < 130000 {
+			return fmt.Errorf("publish_via_partition_root requires PostgreSQL 13 or later on the source, found %d", version)
+		}
+	}
 
-	// Define the subscription and slot names.
-	subName := "aiven_db_migrate_sub"
-	slotName := "aiven_db_migrate_slot"
+	// Partitions that the target cannot accept would make the apply fail
+	// after the initial copy has started
+	partitionIssues, err := r.CheckPartitions()
+	if err != nil {
+		return err
+	}
+	if len(partitionIssues) > 0 {
+		PrintPartitionIssues(log.Writer(), partitionIssues)
+		if blocking := blockingPartitionIssues(partitionIssues); blocking > 0 {
+			return fmt.Errorf("%d partitioned tables cannot be replicated to the target layout (see above)", blocking)
+		}
+	}
 
-	// FIX: Instead of skipping subscription creation if one exists,
-	// we drop any existing subscription to apply the new schema changes.
-	dropSubQuery := fmt.Sprintf("DROP SUBSCRIPTION IF EXISTS %s;", subName)
-	if _, err := tgtDB.Exec(dropSubQuery); err != nil {
-		return fmt.Errorf("failed to drop existing subscription: %v", err)
+	pub := r.publication
+	if pub.Tables, err = resolvePublishedTables(srcDB, pub.Tables); err != nil {
+		return err
+	}
+	if backend.Name() != BackendPglogical {
+		if err := checkPublicationSupport(srcDB, pub); err != nil {
+			return err
+		}
+	}
+	if err := backend.CreatePublication(srcDB, r.names, pub, r.publishViaRoot); err != nil {
+		return err
+	}
+	if len(pub.Tables) > 0 {
+		log.Printf("Publication '%s' covers %d tables.", r.names.Publication, len(pub.Tables))
+	}
+	if pub.Truncate {
+		log.Printf("Publication '%s' publishes TRUNCATE.", r.names.Publication)
+	}
+	if r.publishViaRoot {
+		log.Printf("Publication '%s' publishes partition changes via the partition root.", r.names.Publication)
 	}
-	log.Printf("Dropped existing subscription '%s' (if any) on target database.", subName)
+	log.Printf("Publication '%s' created on source database.", r.names.Publication)
 
-	// Create subscription on the target using the Aiven Extras function.
-	sourceConnStrForSub := r.source.ConnectionString() // Source connection string for subscription.
-	createSubQuery := `
-		SELECT * FROM aiven_extras.pg_create_subscription($1, $2, $3, $4, true, true);
-	`
-	if _, err := tgtDB.Exec(createSubQuery, subName, sourceConnStrForSub, pubName, slotName); err != nil {
-		return fmt.Errorf("failed to create subscription on target: %v", err)
+	if err := backend.CreateSubscription(tgtDB, r.names, r.source.ConnectionString()); err != nil {
+		return err
 	}
 
-	log.Printf("Subscription '%s' created on target database. Initial data copy should now be in progress.\n", subName)
+	log.Printf("Subscription '%s' created on target database. Initial data copy should now be in progress.\n", r.names.Subscription)
 	return nil
 }
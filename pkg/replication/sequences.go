@@ -0,0 +1,264 @@
+package replication
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math"
+
+	"github.com/lib/pq"
+)
+
+// SequenceSync records the values of one sequence before and after it was
+// synchronized from the source to the target
+type SequenceSync struct {
+	Schema         string
+	Name           string
+	SourceValue    int64
+	SourceIsCalled bool
+	TargetBefore   int64
+	TargetAfter    int64
+	Skipped        string // Reason the sequence was not synchronized, if any
+}
+
+// QualifiedName returns the quoted schema-qualified sequence name
+func (s SequenceSync) QualifiedName() string {
+	return pq.QuoteIdentifier(s.Schema) + "." + pq.QuoteIdentifier(s.Name)
+}
+
+// sequencesQuery lists the user sequences with their increments and bounds.
+// pg_sequence is PostgreSQL 10+; older servers keep these in the sequence
+// relation itself, see listSequences.
+const sequencesQuery = `
+SELECT n.nspname, c.relname, s.seqincrement, s.seqmin, s.seqmax
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_sequence s ON s.seqrelid = c.oid
+WHERE c.relkind = 'S'
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+  AND n.nspname NOT LIKE 'pg_temp%'
+ORDER BY n.nspname, c.relname;
+`
+
+// legacySequencesQuery lists the user sequences on servers older than 10
+const legacySequencesQuery = `
+SELECT n.nspname, c.relname
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'S'
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+  AND n.nspname NOT LIKE 'pg_temp%'
+ORDER BY n.nspname, c.relname;
+`
+
+// sequence is a user sequence with its increment and bounds
+type sequence struct {
+	schema, name string
+	increment    int64
+	min, max     int64
+}
+
+// listSequences returns the user sequences of a database
+func listSequences(db *sql.DB) ([]sequence, error) {
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check server version: %v", err)
+	}
+	query := sequencesQuery
+	if version < 100000 {
+		query = legacySequencesQuery
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sequences: %v", err)
+	}
+	var sequences []sequence
+	for rows.Next() {
+		var seq sequence
+		dest := []interface{}{&seq.schema, &seq.name}
+		if version >= 100000 {
+			dest = append(dest, &seq.increment, &seq.min, &seq.max)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read sequence list: %v", err)
+		}
+		sequences = append(sequences, seq)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sequence list: %v", err)
+	}
+
+	if version < 100000 {
+		for i := range sequences {
+			name := pq.QuoteIdentifier(sequences[i].schema) + "." + pq.QuoteIdentifier(sequences[i].name)
+			query := fmt.Sprintf("SELECT increment_by, min_value, max_value FROM %s;", name)
+			if err := db.QueryRow(query).Scan(&sequences[i].increment, &sequences[i].min, &sequences[i].max); err != nil {
+				return nil, fmt.Errorf("failed to read increment of sequence %s: %v", name, err)
+			}
+		}
+	}
+	return sequences, nil
+}
+
+// readSequence returns the current last_value and is_called of a sequence
+func readSequence(db *sql.DB, qualifiedName string) (int64, bool, error) {
+	var lastValue int64
+	var isCalled bool
+	query := fmt.Sprintf("SELECT last_value, is_called FROM %s;", qualifiedName)
+	if err := db.QueryRow(query).Scan(&lastValue, &isCalled); err != nil {
+		return 0, false, err
+	}
+	return lastValue, isCalled, nil
+}
+
+// withMargin returns value advanced by margin increments of seq, and false
+// when that would pass the sequence's maximum (or minimum, for a descending
+// sequence) or overflow, in which case the bound is returned instead
+func withMargin(value, margin int64, seq sequence) (int64, bool) {
+	bound := seq.max
+	if seq.increment < 0 {
+		bound = seq.min
+	}
+	step := seq.increment
+	if step < 0 {
+		step = -step
+	}
+	if step != 0 && margin > math.MaxInt64/step {
+		return bound, false
+	}
+	step *= margin
+
+	// The distance to the bound fits in a uint64 as value lies within the range
+	room := uint64(seq.max) - uint64(value)
+	if seq.increment < 0 {
+		room = uint64(value) - uint64(seq.min)
+	}
+	if uint64(step) > room {
+		return bound, false
+	}
+	if seq.increment < 0 {
+		return value - step, true
+	}
+	return value + step, true
+}
+
+// SyncSequences copies the current value of every source sequence to the
+// target, since logical replication does not carry sequence values. A
+// positive margin advances each target sequence by that many increments
+// beyond the source value, leaving room for values the source hands out
+// while the synchronization is running. A sequence the margin would carry
+// past its bound is set to the bound.
+func (r *Replicator) SyncSequences(margin int64) ([]SequenceSync, error) {
+	if margin < 0 {
+		return nil, fmt.Errorf("sequence margin must not be negative, got %d", margin)
+	}
+
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	sequences, err := listSequences(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sequences on source: %v", err)
+	}
+
+	var syncs []SequenceSync
+	for _, seq := range sequences {
+		sync := SequenceSync{Schema: seq.schema, Name: seq.name}
+		name := sync.QualifiedName()
+
+		sync.SourceValue, sync.SourceIsCalled, err = readSequence(srcDB, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sequence %s on source: %v", name, err)
+		}
+
+		var exists bool
+		if err := tgtDB.QueryRow("SELECT to_regclass($1) IS NOT NULL;", name).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to look up sequence %s on target: %v", name, err)
+		}
+		if !exists {
+			sync.Skipped = "missing on target"
+			log.Printf("Sequence %s does not exist on target, skipping", name)
+			syncs = append(syncs, sync)
+			continue
+		}
+
+		sync.TargetBefore, _, err = readSequence(tgtDB, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sequence %s on target: %v", name, err)
+		}
+
+		// setval(..., false) makes nextval return the value itself, which is
+		// what an uncalled source sequence would do
+		value, isCalled := sync.SourceValue, sync.SourceIsCalled
+		if margin > 0 {
+			var ok bool
+			if value, ok = withMargin(value, margin, seq); !ok {
+				log.Printf("Warning: a margin of %d increments would carry sequence %s past its bound, setting it to %d", margin, name, value)
+			}
+			isCalled = true
+		}
+
+		if err := tgtDB.QueryRow("SELECT setval($1::regclass, $2, $3);", name, value, isCalled).Scan(&sync.TargetAfter); err != nil {
+			return nil, fmt.Errorf("failed to set sequence %s on target to %d: %v", name, value, err)
+		}
+		syncs = append(syncs, sync)
+	}
+
+	skipped := 0
+	for _, sync := range syncs {
+		if sync.Skipped != "" {
+			skipped++
+		}
+	}
+	log.Printf("Synchronized %d sequences from source to target, skipped %d", len(syncs)-skipped, skipped)
+	return syncs, nil
+}
+
+// checkSequences reads every source sequence once, so a cutover finds out
+// that sequences cannot be synchronized, or that the margin would carry
+// them past their bounds, before it freezes the source
+func checkSequences(srcDB *sql.DB, margin int64) error {
+	sequences, err := listSequences(srcDB)
+	if err != nil {
+		return fmt.Errorf("failed to list sequences on source: %v", err)
+	}
+	for _, seq := range sequences {
+		name := pq.QuoteIdentifier(seq.schema) + "." + pq.QuoteIdentifier(seq.name)
+		value, _, err := readSequence(srcDB, name)
+		if err != nil {
+			return fmt.Errorf("failed to read sequence %s on source: %v", name, err)
+		}
+		if _, ok := withMargin(value, margin, seq); !ok {
+			return fmt.Errorf("a sequence margin of %d increments would carry sequence %s (at %d, increment %d, range %d to %d) past its bound; lower --sequence-margin",
+				margin, name, value, seq.increment, seq.min, seq.max)
+		}
+	}
+	return nil
+}
+
+// PrintSequenceReport writes the before and after values of synchronized sequences
+func PrintSequenceReport(w io.Writer, syncs []SequenceSync) {
+	fmt.Fprintf(w, "%-50s %20s %20s %20s\n", "SEQUENCE", "SOURCE", "TARGET BEFORE", "TARGET AFTER")
+	for _, sync := range syncs {
+		if sync.Skipped != "" {
+			fmt.Fprintf(w, "%-50s %20d %20s %20s\n", sync.QualifiedName(), sync.SourceValue, "-", sync.Skipped)
+			continue
+		}
+		fmt.Fprintf(w, "%-50s %20d %20d %20d\n", sync.QualifiedName(), sync.SourceValue, sync.TargetBefore, sync.TargetAfter)
+	}
+}
@@ -0,0 +1,41 @@
+package replication
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWithMargin(t *testing.T) {
+	ascending := sequence{increment: 1, min: 1, max: math.MaxInt64}
+	descending := sequence{increment: -1, min: math.MinInt64, max: -1}
+
+	tests := []struct {
+		name   string
+		value  int64
+		margin int64
+		seq    sequence
+		want   int64
+		wantOK bool
+	}{
+		{name: "no margin", value: 42, seq: ascending, want: 42, wantOK: true},
+		{name: "ascending", value: 42, margin: 1000, seq: ascending, want: 1042, wantOK: true},
+		{name: "descending", value: -42, margin: 1000, seq: descending, want: -1042, wantOK: true},
+		{name: "larger increment", value: 10, margin: 5, seq: sequence{increment: 10, min: 1, max: 1000}, want: 60, wantOK: true},
+		{name: "up to the maximum", value: 990, margin: 1, seq: sequence{increment: 10, min: 1, max: 1000}, want: 1000, wantOK: true},
+		{name: "past the maximum", value: 995, margin: 1, seq: sequence{increment: 10, min: 1, max: 1000}, want: 1000},
+		{name: "past the minimum", value: -5, margin: 10, seq: sequence{increment: -1, min: -10, max: -1}, want: -10},
+		{name: "smallint maximum", value: 32000, margin: 1000, seq: sequence{increment: 1, min: 1, max: math.MaxInt16}, want: math.MaxInt16},
+		{name: "step overflows", value: 1, margin: math.MaxInt64, seq: sequence{increment: 2, min: 1, max: math.MaxInt64}, want: math.MaxInt64},
+		{name: "sum overflows", value: math.MaxInt64 - 5, margin: 10, seq: ascending, want: math.MaxInt64},
+		{name: "negative start", value: -100, margin: 50, seq: sequence{increment: 1, min: math.MinInt64, max: math.MaxInt64}, want: -50, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := withMargin(tt.value, tt.margin, tt.seq)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("withMargin(%d, %d, %+v) = %d, %t, want %d, %t", tt.value, tt.margin, tt.seq, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"pg-migration/pkg/pgoutput"
+
+	"github.com/lib/pq"
+)
+
+// Operations of a decoded change
+const (
+	opInsert   = "insert"
+	opUpdate   = "update"
+	opDelete   = "delete"
+	opTruncate = "truncate"
+)
+
+// change is one row change, or a truncate, of a source transaction
+type change struct {
+	Op       string
+	Relation *pgoutput.Relation // nil for truncate
+	Old      pgoutput.Tuple     // Key or full old row, for update and delete
+	OldIsKey bool
+	New      pgoutput.Tuple // For insert and update
+
+	Truncated       []*pgoutput.Relation
+	Cascade         bool
+	RestartIdentity bool
+}
+
+// transaction is a decoded source transaction
+type transaction struct {
+	XID        uint32
+	CommitLSN  pgoutput.LSN
+	EndLSN     pgoutput.LSN // Decoding resumes here once the transaction is done
+	CommitTime time.Time
+	Changes    []change
+}
+
+// decoder assembles pgoutput messages into transactions, keeping the
+// relation descriptions the stream announced
+type decoder struct {
+	relations map[uint32]*pgoutput.Relation
+	current   *transaction
+}
+
+func newDecoder() *decoder {
+	return &decoder{relations: map[uint32]*pgoutput.Relation{}}
+}
+
+// decode handles one pgoutput message and returns the transaction it
+// completes, if any
+func (d *decoder) decode(data []byte) (*transaction, error) {
+	msg, err := pgoutput.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var c change
+	switch m := msg.(type) {
+	case *pgoutput.Begin:
+		d.current = &transaction{XID: m.XID, CommitTime: m.CommitTime}
+		return nil, nil
+	case *pgoutput.Commit:
+		if d.current == nil {
+			return nil, fmt.Errorf("commit at %s without a transaction", m.CommitLSN)
+		}
+		txn := d.current
+		txn.CommitLSN, txn.EndLSN = m.CommitLSN, m.EndLSN
+		d.current = nil
+		return txn, nil
+	case *pgoutput.Relation:
+		d.relations[m.ID] = m
+		return nil, nil
+	case *pgoutput.Insert:
+		rel, err := d.relation(m.RelationID)
+		if err != nil {
+			return nil, err
+		}
+		c = change{Op: opInsert, Relation: rel, New: m.New}
+	case *pgoutput.Update:
+		rel, err := d.relation(m.RelationID)
+		if err != nil {
+			return nil, err
+		}
+		c = change{Op: opUpdate, Relation: rel, Old: m.Old, OldIsKey: m.OldIsKey, New: m.New}
+	case *pgoutput.Delete:
+		rel, err := d.relation(m.RelationID)
+		if err != nil {
+			return nil, err
+		}
+		c = change{Op: opDelete, Relation: rel, Old: m.Old, OldIsKey: m.OldIsKey}
+	case *pgoutput.Truncate:
+		c = change{Op: opTruncate, Cascade: m.Cascade, RestartIdentity: m.RestartIdentity}
+		for _, id := range m.RelationIDs {
+			rel, err := d.relation(id)
+			if err != nil {
+				return nil, err
+			}
+			c.Truncated = append(c.Truncated, rel)
+		}
+	default:
+		return nil, nil
+	}
+
+	if d.current == nil {
+		return nil, fmt.Errorf("%s outside of a transaction", c.Op)
+	}
+	d.current.Changes = append(d.current.Changes, c)
+	return nil, nil
+}
+
+// relation returns a relation announced earlier in the stream
+func (d *decoder) relation(id uint32) (*pgoutput.Relation, error) {
+	rel, ok := d.relations[id]
+	if !ok {
+		return nil, fmt.Errorf("change to relation %d before its description", id)
+	}
+	return rel, nil
+}
+
+// slotReader fetches the changes of a pgoutput slot through the SQL slot
+// functions, which lib/pq supports, rather than a streaming replication
+// connection. The slot only moves forward when advance is called, so
+// changes are fetched again until they have been dealt with.
+type slotReader struct {
+	db          *sql.DB
+	slot        string
+	publication string
+	version     int
+	decoder     *decoder
+}
+
+// newSlotReader returns a reader for a slot using the pgoutput plugin
+func newSlotReader(srcDB *sql.DB, slot, publication string) (*slotReader, error) {
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check source server version: %v", err)
+	}
+	if version < 100000 {
+		return nil, fmt.Errorf("the pgoutput plugin requires PostgreSQL 10 or later on the source, found %d", version)
+	}
+	return &slotReader{
+		db:          srcDB,
+		slot:        slot,
+		publication: publication,
+		version:     version,
+	}, nil
+}
+
+// checkSlot reports whether a slot exists. An existing slot must use
+// pgoutput and not be in use by a walsender, such as the apply worker of a
+// subscription.
+func checkSlot(db *sql.DB, slot string) (bool, error) {
+	var plugin sql.NullString
+	var active bool
+	err := db.QueryRow("SELECT plugin, active FROM pg_replication_slots WHERE slot_name = $1;", slot).Scan(&plugin, &active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up replication slot '%s': %v", slot, err)
+	}
+	if plugin.String != "pgoutput" {
+		return false, fmt.Errorf("replication slot '%s' uses plugin %q, pgoutput is needed", slot, plugin.String)
+	}
+	if active {
+		return false, fmt.Errorf("replication slot '%s' is in use by a walsender; drop the subscription consuming it first", slot)
+	}
+	return true, nil
+}
+
+// ensureSlot creates the slot if it does not exist and reports whether it
+// did
+func (s *slotReader) ensureSlot() (bool, error) {
+	exists, err := checkSlot(s.db, s.slot)
+	if err != nil || exists {
+		return false, err
+	}
+	if _, err := s.db.Exec("SELECT pg_create_logical_replication_slot($1, 'pgoutput');", s.slot); err != nil {
+		return false, fmt.Errorf("failed to create replication slot '%s': %v", s.slot, err)
+	}
+	return true, nil
+}
+
+// peek decodes the next complete transactions of the slot without consuming
+// them. maxChanges bounds the number of messages read; the server still
+// finishes the transaction it is in, so a large transaction is returned
+// whole.
+func (s *slotReader) peek(ctx context.Context, maxChanges int) ([]*transaction, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data
+		FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, 'proto_version', '1', 'publication_names', $3);
+	`, s.slot, maxChanges, pq.QuoteIdentifier(s.publication))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read changes from replication slot '%s': %v", s.slot, err)
+	}
+	defer rows.Close()
+
+	// Every peek decodes from the slot's position again, so relations are
+	// announced again as well
+	s.decoder = newDecoder()
+	var txns []*transaction
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		txn, err := s.decoder.decode(data)
+		if err != nil {
+			return nil, err
+		}
+		if txn != nil {
+			txns = append(txns, txn)
+		}
+	}
+	return txns, rows.Err()
+}
+
+// advance confirms the slot up to lsn, the end of the last transaction dealt
+// with, so the source can release the WAL before it.
+// pg_replication_slot_advance is PostgreSQL 11+; on 10 the changes are
+// consumed and discarded instead.
+func (s *slotReader) advance(lsn pgoutput.LSN) error {
+	var err error
+	if s.version >= 110000 {
+		_, err = s.db.Exec("SELECT pg_replication_slot_advance($1, $2::pg_lsn);", s.slot, lsn.String())
+	} else {
+		_, err = s.db.Exec(`
+			SELECT count(*)
+			FROM pg_logical_slot_get_binary_changes($1, $2::pg_lsn, NULL, 'proto_version', '1', 'publication_names', $3);
+		`, s.slot, lsn.String(), pq.QuoteIdentifier(s.publication))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to advance replication slot '%s' to %s: %v", s.slot, lsn, err)
+	}
+	return nil
+}
+
+// qualifiedName returns the quoted schema-qualified name of a relation
+func qualifiedName(rel *pgoutput.Relation) string {
+	return pq.QuoteIdentifier(rel.Namespace) + "." + pq.QuoteIdentifier(rel.Name)
+}
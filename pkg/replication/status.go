@@ -0,0 +1,345 @@
+package replication
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// Subscription states, common to all backends
+const (
+	StateReplicating  = "replicating"  // Apply worker running, all tables synchronized
+	StateInitializing = "initializing" // Apply worker running, some tables still copying
+	StateDown         = "down"         // Enabled, but no worker is running
+	StateDisabled     = "disabled"
+	StateMissing      = "missing" // The subscription does not exist
+)
+
+// Table synchronization states, common to all backends
+const (
+	SyncInit    = "init"    // Waiting for the initial copy
+	SyncCopy    = "copy"    // Copying the existing rows
+	SyncCatchup = "catchup" // Copy done, catching up with changes made meanwhile
+	SyncReady   = "ready"   // Replicating changes
+	SyncUnknown = "unknown"
+)
+
+// TableSync is the synchronization state of one subscribed table
+type TableSync struct {
+	Table string `json:"table"`
+	State string `json:"state"`     // One of the Sync* constants
+	Raw   string `json:"raw_state"` // The backend's own state code
+	LSN   string `json:"lsn,omitempty"`
+}
+
+// WorkerStatus is the apply worker of a subscription, from pg_stat_subscription
+type WorkerStatus struct {
+	PID                int        `json:"pid"`
+	ReceivedLSN        string     `json:"received_lsn,omitempty"`
+	LatestEndLSN       string     `json:"latest_end_lsn,omitempty"`
+	LastMessageReceipt *time.Time `json:"last_msg_receipt_time,omitempty"`
+	LatestEndTime      *time.Time `json:"latest_end_time,omitempty"`
+}
+
+// SlotStatus is the replication slot of a subscription on the source, from
+// pg_replication_slots
+type SlotStatus struct {
+	Name              string   `json:"name"`
+	Exists            bool     `json:"exists"`
+	Active            bool     `json:"active"`
+	ActivePID         int      `json:"active_pid,omitempty"`
+	RestartLSN        string   `json:"restart_lsn,omitempty"`
+	ConfirmedFlushLSN string   `json:"confirmed_flush_lsn,omitempty"`
+	RetainedBytes     int64    `json:"retained_wal_bytes"` // WAL kept on the source for the slot
+	LagBytes          int64    `json:"lag_bytes"`          // WAL not yet confirmed by the subscriber
+	LagSeconds        *float64 `json:"lag_seconds,omitempty"`
+	WALStatus         string   `json:"wal_status,omitempty"`    // reserved, extended, unreserved or lost (PostgreSQL 13+)
+	SafeWALBytes      *int64   `json:"safe_wal_size,omitempty"` // WAL that can still be written before the slot is lost (PostgreSQL 13+)
+}
+
+// Status describes a subscription in terms common to all backends
+type Status struct {
+	Backend      string        `json:"backend"`
+	Subscription string        `json:"subscription"`
+	State        string        `json:"state"` // One of the State* constants
+	SlotName     string        `json:"-"`     // Slot as recorded by the subscription
+	Worker       *WorkerStatus `json:"worker,omitempty"`
+	Slot         *SlotStatus   `json:"slot,omitempty"`
+	Tables       []TableSync   `json:"tables"`
+}
+
+// nativeSyncStates maps pg_subscription_rel.srsubstate
+var nativeSyncStates = map[string]string{
+	"i": SyncInit,
+	"d": SyncCopy,
+	"f": SyncCatchup, // Finished table copy (PostgreSQL 14+)
+	"s": SyncCatchup,
+	"r": SyncReady,
+}
+
+// subscriptionState derives the overall state from the subscription flags
+// and the table states
+func subscriptionState(enabled, workerRunning bool, tables []TableSync) string {
+	switch {
+	case !enabled:
+		return StateDisabled
+	case !workerRunning:
+		return StateDown
+	}
+	for _, t := range tables {
+		if t.State != SyncReady {
+			return StateInitializing
+		}
+	}
+	return StateReplicating
+}
+
+// nativeStatus reads the status of a built-in subscription, as created by
+// the native and aiven_extras backends
+func nativeStatus(tgtDB *sql.DB, backend string, names Names) (*Status, error) {
+	status := &Status{Backend: backend, Subscription: names.Subscription}
+
+	var enabled bool
+	var slot sql.NullString
+	err := tgtDB.QueryRow(`
+		SELECT subenabled, subslotname FROM pg_subscription
+		WHERE subname = $1 AND subdbid = (SELECT oid FROM pg_database WHERE datname = current_database());
+	`, names.Subscription).Scan(&enabled, &slot)
+	if err == sql.ErrNoRows {
+		status.State = StateMissing
+		return status, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscription '%s': %v", names.Subscription, err)
+	}
+	status.SlotName = slot.String
+
+	worker := &WorkerStatus{}
+	var pid sql.NullInt64
+	var receivedLSN, latestEndLSN sql.NullString
+	var receipt, latestEnd sql.NullTime
+	err = tgtDB.QueryRow(`
+		SELECT pid, received_lsn::text, latest_end_lsn::text, last_msg_receipt_time, latest_end_time
+		FROM pg_stat_subscription
+		WHERE subname = $1 AND relid IS NULL;
+	`, names.Subscription).Scan(&pid, &receivedLSN, &latestEndLSN, &receipt, &latestEnd)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read subscription workers: %v", err)
+	}
+	if pid.Valid {
+		worker.PID = int(pid.Int64)
+		worker.ReceivedLSN = receivedLSN.String
+		worker.LatestEndLSN = latestEndLSN.String
+		if receipt.Valid {
+			worker.LastMessageReceipt = &receipt.Time
+		}
+		if latestEnd.Valid {
+			worker.LatestEndTime = &latestEnd.Time
+		}
+		status.Worker = worker
+	}
+
+	rows, err := tgtDB.Query(`
+		SELECT r.srrelid::regclass::text, r.srsubstate, COALESCE(r.srsublsn::text, '')
+		FROM pg_subscription_rel r
+		JOIN pg_subscription s ON s.oid = r.srsubid
+		WHERE s.subname = $1 AND s.subdbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+		ORDER BY 1;
+	`, names.Subscription)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscription tables: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t TableSync
+		if err := rows.Scan(&t.Table, &t.Raw, &t.LSN); err != nil {
+			return nil, err
+		}
+		t.State = mapSyncState(nativeSyncStates, t.Raw)
+		status.Tables = append(status.Tables, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status.State = subscriptionState(enabled, status.Worker != nil, status.Tables)
+	return status, nil
+}
+
+func mapSyncState(states map[string]string, raw string) string {
+	if state, ok := states[raw]; ok {
+		return state
+	}
+	return SyncUnknown
+}
+
+// slotStatus reads a replication slot on the source and how much WAL it
+// retains and lags behind. The WAL functions were renamed in PostgreSQL 10.
+func slotStatus(srcDB *sql.DB, name string) (*SlotStatus, error) {
+	slot := &SlotStatus{Name: name}
+
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check source server version: %v", err)
+	}
+	current, diff := "pg_current_wal_lsn()", "pg_wal_lsn_diff"
+	if version < 100000 {
+		current, diff = "pg_current_xlog_location()", "pg_xlog_location_diff"
+	}
+
+	// row_to_json reads columns that older servers lack as NULL
+	query := fmt.Sprintf(`
+		SELECT s.active,
+		       COALESCE((row_to_json(s) ->> 'active_pid')::int, 0),
+		       COALESCE(s.restart_lsn::text, ''),
+		       COALESCE(row_to_json(s) ->> 'confirmed_flush_lsn', ''),
+		       COALESCE(%[2]s(%[1]s, s.restart_lsn), 0)::bigint,
+		       COALESCE(%[2]s(%[1]s, (row_to_json(s) ->> 'confirmed_flush_lsn')::pg_lsn), 0)::bigint,
+		       COALESCE(row_to_json(s) ->> 'wal_status', ''),
+		       (row_to_json(s) ->> 'safe_wal_size')::bigint
+		FROM pg_replication_slots s
+		WHERE s.slot_name = $1;
+	`, current, diff)
+	var safeWAL sql.NullInt64
+	err = srcDB.QueryRow(query, name).Scan(&slot.Active, &slot.ActivePID, &slot.RestartLSN,
+		&slot.ConfirmedFlushLSN, &slot.RetainedBytes, &slot.LagBytes, &slot.WALStatus, &safeWAL)
+	if err == sql.ErrNoRows {
+		return slot, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replication slot '%s' on source: %v", name, err)
+	}
+	slot.Exists = true
+	if safeWAL.Valid {
+		slot.SafeWALBytes = &safeWAL.Int64
+	}
+
+	// replay_lag is measured by the walsender serving the slot (PostgreSQL 10+)
+	if slot.ActivePID != 0 && version >= 100000 {
+		var lag sql.NullFloat64
+		err := srcDB.QueryRow("SELECT EXTRACT(EPOCH FROM replay_lag)::float8 FROM pg_stat_replication WHERE pid = $1;", slot.ActivePID).Scan(&lag)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to read replication lag on source: %v", err)
+		}
+		if lag.Valid {
+			slot.LagSeconds = &lag.Float64
+		}
+	}
+	return slot, nil
+}
+
+// SubscriptionStatus returns the state of the subscription, its apply worker
+// and tables on the target, and of its replication slot on the source
+func (r *Replicator) SubscriptionStatus() (*Status, error) {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	backend, err := r.backend(srcDB, tgtDB)
+	if err != nil {
+		return nil, err
+	}
+	status, err := backend.Status(tgtDB, r.names)
+	if err != nil {
+		return nil, err
+	}
+
+	slotName := status.SlotName
+	if slotName == "" {
+		slotName = r.names.Slot
+	}
+	if status.Slot, err = slotStatus(srcDB, slotName); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// WriteJSON writes the status as indented JSON
+func (s *Status) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// Print writes the status as a human-readable report with one line per table
+func (s *Status) Print(w io.Writer) {
+	fmt.Fprintf(w, "Subscription %s (%s backend): %s\n", s.Subscription, s.Backend, s.State)
+
+	if s.Worker != nil {
+		fmt.Fprintf(w, "  Apply worker: pid %d, received up to %s", s.Worker.PID, orNone(s.Worker.ReceivedLSN))
+		if s.Worker.LastMessageReceipt != nil {
+			fmt.Fprintf(w, ", last message %s ago", time.Since(*s.Worker.LastMessageReceipt).Round(time.Second))
+		}
+		fmt.Fprintln(w)
+	} else if s.State != StateMissing {
+		fmt.Fprintln(w, "  Apply worker: not running")
+	}
+
+	if slot := s.Slot; slot != nil {
+		switch {
+		case !slot.Exists:
+			fmt.Fprintf(w, "  Slot %s on source: missing\n", slot.Name)
+		default:
+			activity := "inactive"
+			if slot.Active {
+				activity = fmt.Sprintf("active (pid %d)", slot.ActivePID)
+			}
+			fmt.Fprintf(w, "  Slot %s on source: %s, retaining %s of WAL", slot.Name, activity, formatBytes(slot.RetainedBytes))
+			if slot.WALStatus != "" {
+				fmt.Fprintf(w, " (wal_status %s)", slot.WALStatus)
+			}
+			fmt.Fprintln(w)
+			fmt.Fprintf(w, "  Lag: %s", formatBytes(slot.LagBytes))
+			if slot.LagSeconds != nil {
+				fmt.Fprintf(w, ", %s", time.Duration(*slot.LagSeconds*float64(time.Second)).Round(time.Millisecond))
+			}
+			fmt.Fprintf(w, " (confirmed up to %s)\n", orNone(slot.ConfirmedFlushLSN))
+		}
+	}
+
+	if len(s.Tables) == 0 {
+		return
+	}
+	counts := map[string]int{}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  TABLE\tSTATE\tRAW\tLSN")
+	for _, t := range s.Tables {
+		counts[t.State]++
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", t.Table, t.State, t.Raw, orNone(t.LSN))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "  Tables: %d ready, %d catching up, %d copying, %d waiting, %d unknown\n",
+		counts[SyncReady], counts[SyncCatchup], counts[SyncCopy], counts[SyncInit], counts[SyncUnknown])
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatBytes formats a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
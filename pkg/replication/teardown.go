@@ -0,0 +1,216 @@
+package replication
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// TeardownResult lists what a teardown could not remove
+type TeardownResult struct {
+	Errors        []string      // Steps that failed, with the side they ran on
+	LeftoverSlots []*SlotStatus // Migration slots still on the source
+}
+
+// leftoverSlotsQuery lists the replication slots created by this tool, under
+// any migration ID, and by pglogical
+const leftoverSlotsQuery = `
+SELECT slot_name
+FROM pg_replication_slots
+WHERE database = current_database()
+  AND (slot_name LIKE 'aiven\_db\_migrate%' OR plugin LIKE 'pglogical%')
+ORDER BY 1;
+`
+
+// teardownTarget drops the subscription of the migration on the target and
+// returns the name of its slot, if it was a pglogical subscription. It
+// neither needs nor contacts the source.
+func (r *Replicator) teardownTarget(tgtDB *sql.DB) (string, error) {
+	if err := tgtDB.Ping(); err != nil {
+		return "", fmt.Errorf("failed to connect to target database: %v", err)
+	}
+
+	var backend Backend
+	switch r.backendName {
+	case BackendNative:
+		backend = nativeBackend{}
+	case BackendAivenExtras:
+		backend = aivenExtrasBackend{}
+	case BackendPglogical:
+		backend = pglogicalBackend{}
+	default:
+		// Subscriptions created through aiven_extras are owned by a
+		// superuser, so drop them the same way when it is installed
+		installed, err := checkExtensionInstalled(tgtDB, "aiven_extras")
+		if err != nil {
+			return "", fmt.Errorf("failed to check aiven_extras extension on target: %v", err)
+		}
+		backend = nativeBackend{}
+		if installed {
+			backend = aivenExtrasBackend{}
+		}
+	}
+
+	// A pglogical subscription may exist next to a native one of the same name
+	pglogical, err := checkExtensionInstalled(tgtDB, "pglogical")
+	if err != nil {
+		return "", fmt.Errorf("failed to check pglogical extension on target: %v", err)
+	}
+	var slot string
+	if pglogical {
+		err := tgtDB.QueryRow("SELECT sub_slot_name FROM pglogical.subscription WHERE sub_name = $1;", r.names.Subscription).Scan(&slot)
+		if err != nil && err != sql.ErrNoRows {
+			return "", fmt.Errorf("failed to read subscription '%s': %v", r.names.Subscription, err)
+		}
+		if err := (pglogicalBackend{}).DropSubscription(tgtDB, r.names); err != nil {
+			return slot, err
+		}
+	}
+	version, err := serverVersion(tgtDB)
+	if err != nil {
+		return slot, fmt.Errorf("failed to check target server version: %v", err)
+	}
+	if backend.Name() == BackendPglogical || version < 100000 {
+		return slot, nil
+	}
+	return slot, backend.DropSubscription(tgtDB, r.names)
+}
+
+// teardownSource drops the publication or replication set of the migration
+// and its replication slots on the source
+func (r *Replicator) teardownSource(srcDB *sql.DB, slots []string) []string {
+	if err := srcDB.Ping(); err != nil {
+		return []string{fmt.Sprintf("source: failed to connect to source database: %v", err)}
+	}
+
+	var errs []string
+	version, err := serverVersion(srcDB)
+	if err != nil {
+		return []string{fmt.Sprintf("source: failed to check server version: %v", err)}
+	}
+	if version >= 100000 {
+		if err := dropPublication(srcDB, r.names.Publication); err != nil {
+			errs = append(errs, "source: "+err.Error())
+		}
+	}
+	pglogical, err := checkExtensionInstalled(srcDB, "pglogical")
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("source: failed to check pglogical extension: %v", err))
+	} else if pglogical {
+		if err := (pglogicalBackend{}).DropPublication(srcDB, r.names); err != nil {
+			errs = append(errs, "source: "+err.Error())
+		}
+	}
+
+	for _, slot := range slots {
+		if err := dropSlot(srcDB, slot, 10*time.Second); err != nil {
+			errs = append(errs, "source: "+err.Error())
+		}
+	}
+	return errs
+}
+
+// Teardown removes the replication objects of the migration, e.g. after it
+// was abandoned. The subscription on the target is detached from its slot
+// and dropped without contacting the source, and the publication and slot
+// on the source are dropped without relying on the target, so each side is
+// cleaned up even when the other is unreachable. Afterwards the migration
+// slots still on the source, of any migration ID, are listed.
+func (r *Replicator) Teardown() (*TeardownResult, error) {
+	log.Printf("Tearing down migration %s: publication '%s', subscription '%s', slot '%s'",
+		r.migrationID, r.names.Publication, r.names.Subscription, r.names.Slot)
+
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	result := &TeardownResult{}
+	slots := r.Slots()
+	pglogicalSlot, err := r.teardownTarget(tgtDB)
+	if err != nil {
+		result.Errors = append(result.Errors, "target: "+err.Error())
+	}
+	if pglogicalSlot != "" {
+		slots = append(slots, pglogicalSlot)
+	}
+
+	result.Errors = append(result.Errors, r.teardownSource(srcDB, slots)...)
+
+	if srcDB.Ping() == nil {
+		leftover, err := leftoverSlots(srcDB)
+		if err != nil {
+			result.Errors = append(result.Errors, "source: "+err.Error())
+		}
+		result.LeftoverSlots = leftover
+	}
+
+	if len(result.Errors) > 0 {
+		return result, fmt.Errorf("teardown incomplete: %s", strings.Join(result.Errors, "; "))
+	}
+	return result, nil
+}
+
+// leftoverSlots returns the migration-related slots on the source
+func leftoverSlots(srcDB *sql.DB) ([]*SlotStatus, error) {
+	rows, err := srcDB.Query(leftoverSlotsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list replication slots: %v", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var slots []*SlotStatus
+	for _, name := range names {
+		slot, err := slotStatus(srcDB, name)
+		if err != nil {
+			return nil, err
+		}
+		if slot.Exists {
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+// PrintLeftoverSlots writes the migration slots remaining on the source
+func PrintLeftoverSlots(w io.Writer, slots []*SlotStatus) {
+	if len(slots) == 0 {
+		fmt.Fprintln(w, "No migration replication slots left on the source.")
+		return
+	}
+	fmt.Fprintf(w, "%d migration replication slots left on the source:\n", len(slots))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  SLOT\tACTIVE\tRETAINED WAL")
+	for _, slot := range slots {
+		active := "no"
+		if slot.Active {
+			active = fmt.Sprintf("yes (pid %d)", slot.ActivePID)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", slot.Name, active, formatBytes(slot.RetainedBytes))
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "Drop a slot of another migration with --teardown and its --migration-id, or --slot-name.")
+}
@@ -0,0 +1,200 @@
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// WaitOptions control WaitForInitialSync
+type WaitOptions struct {
+	Timeout       time.Duration // Zero waits indefinitely
+	PollInterval  time.Duration
+	MaxSyncErrors int64 // Table sync failures tolerated before giving up
+}
+
+// maxDownPolls is how many consecutive polls may find no apply worker
+// before waiting is abandoned; the launcher restarts a crashed worker within
+// a few seconds
+const maxDownPolls = 6
+
+// copyProgress is one running COPY from pg_stat_progress_copy
+type copyProgress struct {
+	bytesProcessed int64
+	bytesTotal     int64
+	tuples         int64
+}
+
+// readCopyProgress returns the running COPY FROM commands on the target by
+// table. pg_stat_progress_copy exists from PostgreSQL 14.
+func readCopyProgress(tgtDB *sql.DB) (map[string]copyProgress, error) {
+	version, err := serverVersion(tgtDB)
+	if err != nil || version < 140000 {
+		return nil, err
+	}
+
+	rows, err := tgtDB.Query(`
+		SELECT relid::regclass::text, bytes_processed, bytes_total, tuples_processed
+		FROM pg_stat_progress_copy
+		WHERE command = 'COPY FROM' AND datname = current_database();
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	progress := map[string]copyProgress{}
+	for rows.Next() {
+		var table string
+		var p copyProgress
+		if err := rows.Scan(&table, &p.bytesProcessed, &p.bytesTotal, &p.tuples); err != nil {
+			return nil, err
+		}
+		progress[table] = p
+	}
+	return progress, rows.Err()
+}
+
+// readSyncErrors returns how often the table sync workers of a subscription
+// failed, from pg_stat_subscription_stats (PostgreSQL 15+). The second
+// result is false when the count is not available.
+func readSyncErrors(tgtDB *sql.DB, subscription string) (int64, bool, error) {
+	version, err := serverVersion(tgtDB)
+	if err != nil || version < 150000 {
+		return 0, false, err
+	}
+
+	var count int64
+	err = tgtDB.QueryRow("SELECT sync_error_count FROM pg_stat_subscription_stats WHERE subname = $1;", subscription).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return count, true, nil
+}
+
+// WaitForInitialSync polls the subscription until every table has finished
+// its initial copy and is in the ready state, logging the progress of the
+// tables still copying. It fails when the timeout expires, when the
+// subscription is missing or disabled, when its apply worker stays down, or
+// when table sync workers fail more than opts.MaxSyncErrors times.
+func (r *Replicator) WaitForInitialSync(ctx context.Context, opts WaitOptions) error {
+	srcDB, err := sql.Open("postgres", r.source.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", r.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	backend, err := r.backend(srcDB, tgtDB)
+	if err != nil {
+		return err
+	}
+
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 10 * time.Second
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	baseErrors, errorsKnown, err := readSyncErrors(tgtDB, r.names.Subscription)
+	if err != nil {
+		return fmt.Errorf("failed to read subscription error statistics: %v", err)
+	}
+
+	start := time.Now()
+	downPolls := 0
+	ready, total := 0, 0
+	for {
+		status, err := backend.Status(tgtDB, r.names)
+		if err != nil {
+			return err
+		}
+
+		switch status.State {
+		case StateMissing:
+			return fmt.Errorf("subscription '%s' does not exist on the target", r.names.Subscription)
+		case StateDisabled:
+			return fmt.Errorf("subscription '%s' is disabled", r.names.Subscription)
+		case StateDown:
+			downPolls++
+			if downPolls >= maxDownPolls {
+				return fmt.Errorf("the apply worker of subscription '%s' has not been running for %d polls; check the target server log",
+					r.names.Subscription, downPolls)
+			}
+		default:
+			downPolls = 0
+		}
+
+		ready, total = 0, len(status.Tables)
+		var pending []TableSync
+		for _, t := range status.Tables {
+			if t.State == SyncReady {
+				ready++
+			} else {
+				pending = append(pending, t)
+			}
+		}
+		if len(pending) == 0 && status.State != StateDown {
+			log.Printf("Initial sync completed: %d tables ready after %s.", total, time.Since(start).Round(time.Second))
+			return nil
+		}
+
+		progress, err := readCopyProgress(tgtDB)
+		if err != nil {
+			return fmt.Errorf("failed to read copy progress: %v", err)
+		}
+		log.Printf("Initial sync: %d/%d tables ready (%s elapsed)", ready, total, time.Since(start).Round(time.Second))
+		for _, t := range pending {
+			line := fmt.Sprintf("  %s: %s", t.Table, t.State)
+			if p, ok := progress[t.Table]; ok {
+				line += fmt.Sprintf(", %s and %d rows copied", formatBytes(p.bytesProcessed), p.tuples)
+				if p.bytesTotal > 0 {
+					line += fmt.Sprintf(" (%.0f%%)", 100*float64(p.bytesProcessed)/float64(p.bytesTotal))
+				}
+			}
+			log.Println(line)
+		}
+
+		if errorsKnown {
+			count, _, err := readSyncErrors(tgtDB, r.names.Subscription)
+			if err != nil {
+				return fmt.Errorf("failed to read subscription error statistics: %v", err)
+			}
+			if failures := count - baseErrors; failures > opts.MaxSyncErrors {
+				return fmt.Errorf("table sync workers of subscription '%s' failed %d times while copying %s; check the target server log for the cause",
+					r.names.Subscription, failures, pendingNames(pending))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timed out after %s waiting for the initial sync: %d/%d tables ready", opts.Timeout, ready, total)
+			}
+			return fmt.Errorf("stopped waiting for the initial sync: %d/%d tables ready", ready, total)
+		case <-time.After(opts.PollInterval):
+		}
+	}
+}
+
+func pendingNames(tables []TableSync) string {
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = t.Table
+	}
+	return strings.Join(names, ", ")
+}
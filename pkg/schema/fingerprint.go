@@ -0,0 +1,380 @@
+package schema
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// toolingExtensions are installed by the replication backends on either
+// side, e.g. pglogical on the target only once replication is prepared, so
+// they are not part of the migrated schema. pglogical keeps its objects in a
+// schema of the same name.
+const toolingExtensions = `'aiven_extras', 'pglogical'`
+
+// Filters shared by the fingerprint queries: user schemas only, and no
+// objects that belong to an extension
+const (
+	userNamespace = `n.nspname NOT IN ('pg_catalog', 'information_schema', '` + toolingSchema + `', 'pglogical')
+  AND n.nspname NOT LIKE 'pg_toast%' AND n.nspname NOT LIKE 'pg_temp%'`
+	notExtensionMember = `NOT EXISTS (SELECT 1 FROM pg_depend d
+  WHERE d.classid = '%s'::regclass AND d.objid = %s AND d.deptype = 'e')`
+)
+
+// partitionDefinition describes table partitioning, which PostgreSQL 10
+// introduced along with pg_get_partkeydef and relpartbound
+const partitionDefinition = `
+	            'partition by ' || pg_get_partkeydef(c.oid),
+	            'partition of ' || (
+	                SELECT quote_ident(pn.nspname) || '.' || quote_ident(p.relname)
+	                FROM pg_inherits ih
+	                JOIN pg_class p ON p.oid = ih.inhparent
+	                JOIN pg_namespace pn ON pn.oid = p.relnamespace
+	                WHERE ih.inhrelid = c.oid
+	                LIMIT 1) || ' ' || pg_get_expr(c.relpartbound, c.oid),`
+
+// Catalog columns that older servers lack: row level security exists from
+// PostgreSQL 9.5, restrictive policies from 10
+const (
+	rowSecurity       = `CASE WHEN c.relrowsecurity THEN 'row level security' END,`
+	policyPermissive  = `CASE WHEN pol.polpermissive THEN 'permissive' ELSE 'restrictive' END`
+	policyTableSource = `FROM pg_policy pol`
+)
+
+// legacySequenceQuery describes sequences on servers older than 10, which
+// have no pg_sequence catalog. pg_sequence_parameters lacks the data type
+// and cache size there; newer servers still provide it.
+var legacySequenceQuery = `SELECT 'SEQUENCE', quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+	        concat_ws(' ', 'start', s.start_value, 'increment', s.increment,
+	                  'min', s.minimum_value, 'max', s.maximum_value, CASE WHEN s.cycle_option THEN 'cycle' END)
+	 FROM pg_class c
+	 JOIN pg_namespace n ON n.oid = c.relnamespace
+	 CROSS JOIN LATERAL pg_sequence_parameters(c.oid) s
+	 WHERE c.relkind = 'S'
+	   AND ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")
+
+// fingerprintQueries describe each kind of schema object canonically as
+// (kind, identity, definition). Definitions come from the pg_get_*def
+// functions and catalog columns that do not depend on OIDs, physical layout,
+// ownership or privileges, so equal schemas produce equal descriptions.
+var fingerprintQueries = []string{
+	// Schemas
+	`SELECT 'SCHEMA', quote_ident(n.nspname), ''
+	 FROM pg_namespace n
+	 WHERE ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_namespace", "n.oid"),
+
+	// Extensions, except those of the migration tooling
+	`SELECT 'EXTENSION', quote_ident(e.extname), 'version ' || e.extversion || ' schema ' || quote_ident(n.nspname)
+	 FROM pg_extension e
+	 JOIN pg_namespace n ON n.oid = e.extnamespace
+	 WHERE e.extname NOT IN ('plpgsql', ` + toolingExtensions + `)`,
+
+	// Tables with their columns in order
+	`SELECT CASE c.relkind WHEN 'p' THEN 'PARTITIONED TABLE' WHEN 'f' THEN 'FOREIGN TABLE' ELSE 'TABLE' END,
+	        quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+	        concat_ws(E'\n',
+	            'persistence ' || c.relpersistence,
+	            ` + rowSecurity + partitionDefinition + `
+	            (SELECT string_agg(concat_ws(' ',
+	                        quote_ident(a.attname),
+	                        format_type(a.atttypid, a.atttypmod),
+	                        CASE WHEN a.attnotnull THEN 'not null' END,
+	                        'default ' || pg_get_expr(ad.adbin, ad.adrelid),
+	                        CASE WHEN a.attcollation <> t.typcollation THEN 'collate ' || quote_ident(co.collname) END,
+	                        'identity ' || NULLIF(to_jsonb(a) ->> 'attidentity', ''),
+	                        'generated ' || NULLIF(to_jsonb(a) ->> 'attgenerated', '')),
+	                    E'\n' ORDER BY a.attnum)
+	             FROM pg_attribute a
+	             JOIN pg_type t ON t.oid = a.atttypid
+	             LEFT JOIN pg_attrdef ad ON ad.adrelid = a.attrelid AND ad.adnum = a.attnum
+	             LEFT JOIN pg_collation co ON co.oid = a.attcollation
+	             WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped))
+	 FROM pg_class c
+	 JOIN pg_namespace n ON n.oid = c.relnamespace
+	 WHERE c.relkind IN ('r', 'p', 'f')
+	   AND ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid"),
+
+	// Table constraints
+	`SELECT 'CONSTRAINT',
+	        quote_ident(n.nspname) || '.' || quote_ident(c.relname) || '.' || quote_ident(con.conname),
+	        pg_get_constraintdef(con.oid, true)
+	 FROM pg_constraint con
+	 JOIN pg_class c ON c.oid = con.conrelid
+	 JOIN pg_namespace n ON n.oid = c.relnamespace
+	 WHERE ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid"),
+
+	// Indexes
+	`SELECT 'INDEX', quote_ident(n.nspname) || '.' || quote_ident(i.relname), pg_get_indexdef(i.oid)
+	 FROM pg_index x
+	 JOIN pg_class i ON i.oid = x.indexrelid
+	 JOIN pg_namespace n ON n.oid = i.relnamespace
+	 WHERE ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "x.indrelid"),
+
+	// Views and materialized views
+	`SELECT CASE c.relkind WHEN 'm' THEN 'MATERIALIZED VIEW' ELSE 'VIEW' END,
+	        quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+	        pg_get_viewdef(c.oid, true)
+	 FROM pg_class c
+	 JOIN pg_namespace n ON n.oid = c.relnamespace
+	 WHERE c.relkind IN ('v', 'm')
+	   AND ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid"),
+
+	// Sequence definitions, not their current values
+	`SELECT 'SEQUENCE', quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+	        concat_ws(' ', format_type(s.seqtypid, NULL), 'start', s.seqstart, 'increment', s.seqincrement,
+	                  'min', s.seqmin, 'max', s.seqmax, 'cache', s.seqcache, CASE WHEN s.seqcycle THEN 'cycle' END)
+	 FROM pg_sequence s
+	 JOIN pg_class c ON c.oid = s.seqrelid
+	 JOIN pg_namespace n ON n.oid = c.relnamespace
+	 WHERE ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid"),
+
+	// Functions, procedures and aggregates
+	`SELECT CASE f.kind WHEN 'p' THEN 'PROCEDURE' WHEN 'a' THEN 'AGGREGATE' ELSE 'FUNCTION' END,
+	        quote_ident(n.nspname) || '.' || quote_ident(p.proname) || '(' || pg_get_function_identity_arguments(p.oid) || ')',
+	        CASE WHEN f.kind = 'a' THEN 'returns ' || pg_get_function_result(p.oid) ELSE pg_get_functiondef(p.oid) END
+	 FROM pg_proc p
+	 JOIN pg_namespace n ON n.oid = p.pronamespace
+	 CROSS JOIN LATERAL (SELECT COALESCE(to_jsonb(p) ->> 'prokind',
+	     CASE WHEN (to_jsonb(p) ->> 'proisagg')::boolean THEN 'a' ELSE 'f' END) AS kind) f
+	 WHERE ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_proc", "p.oid"),
+
+	// Enum, composite, domain and range types
+	`SELECT 'TYPE', quote_ident(n.nspname) || '.' || quote_ident(t.typname),
+	        CASE t.typtype
+	            WHEN 'e' THEN 'enum ' || (
+	                SELECT string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder)
+	                FROM pg_enum e WHERE e.enumtypid = t.oid)
+	            WHEN 'c' THEN 'composite ' || (
+	                SELECT string_agg(quote_ident(a.attname) || ' ' || format_type(a.atttypid, a.atttypmod), ', ' ORDER BY a.attnum)
+	                FROM pg_attribute a WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped)
+	            WHEN 'd' THEN concat_ws(' ', 'domain', format_type(t.typbasetype, t.typtypmod),
+	                CASE WHEN t.typnotnull THEN 'not null' END,
+	                'default ' || t.typdefault,
+	                (SELECT string_agg(pg_get_constraintdef(con.oid, true), ' ' ORDER BY con.conname)
+	                 FROM pg_constraint con WHERE con.contypid = t.oid))
+	            WHEN 'r' THEN 'range ' || (
+	                SELECT format_type(r.rngsubtype, NULL) FROM pg_range r WHERE r.rngtypid = t.oid)
+	        END
+	 FROM pg_type t
+	 JOIN pg_namespace n ON n.oid = t.typnamespace
+	 WHERE t.typtype IN ('e', 'c', 'd', 'r')
+	   AND (t.typtype <> 'c' OR (SELECT c.relkind FROM pg_class c WHERE c.oid = t.typrelid) = 'c')
+	   AND ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_type", "t.oid"),
+
+	// Triggers
+	`SELECT 'TRIGGER', quote_ident(n.nspname) || '.' || quote_ident(c.relname) || '.' || quote_ident(tg.tgname),
+	        pg_get_triggerdef(tg.oid, true)
+	 FROM pg_trigger tg
+	 JOIN pg_class c ON c.oid = tg.tgrelid
+	 JOIN pg_namespace n ON n.oid = c.relnamespace
+	 WHERE NOT tg.tgisinternal
+	   AND ` + userNamespace + ` AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid"),
+
+	// Row level security policies
+	`SELECT 'POLICY', quote_ident(n.nspname) || '.' || quote_ident(c.relname) || '.' || quote_ident(pol.polname),
+	        concat_ws(' ', pol.polcmd, ` + policyPermissive + `,
+	            (SELECT string_agg(CASE WHEN r = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(r)) END, ',' ORDER BY 1)
+	             FROM unnest(pol.polroles) AS r),
+	            'using ' || pg_get_expr(pol.polqual, pol.polrelid),
+	            'check ' || pg_get_expr(pol.polwithcheck, pol.polrelid))
+	 ` + policyTableSource + `
+	 JOIN pg_class c ON c.oid = pol.polrelid
+	 JOIN pg_namespace n ON n.oid = c.relnamespace
+	 WHERE ` + userNamespace,
+}
+
+// Fingerprint is a hash of every schema object and of the schema as a whole
+type Fingerprint struct {
+	Objects map[string]string // "KIND identity" to the hash of its definition
+	Overall string
+}
+
+// queriesForVersion returns the fingerprint queries for a server version.
+// Before PostgreSQL 10 there is no partitioning to describe, every policy is
+// permissive and sequences are read with legacySequenceQuery. Before 9.5
+// there is no row level security and no to_jsonb, so optional columns are
+// read through row_to_json.
+func queriesForVersion(version int) []string {
+	if version >= 100000 {
+		return fingerprintQueries
+	}
+	queries := make([]string, 0, len(fingerprintQueries))
+	for _, query := range fingerprintQueries {
+		switch {
+		case strings.Contains(query, "FROM pg_sequence s"):
+			query = legacySequenceQuery
+		case strings.Contains(query, partitionDefinition):
+			query = strings.Replace(query, partitionDefinition, "", 1)
+		case strings.Contains(query, policyTableSource):
+			if version < 90500 {
+				continue
+			}
+			query = strings.Replace(query, policyPermissive, "'permissive'", 1)
+		}
+		if version < 90500 {
+			query = strings.Replace(query, rowSecurity, "", 1)
+			query = strings.ReplaceAll(query, "to_jsonb(", "row_to_json(")
+		}
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+// fingerprintVersion returns the lower server_version_num of two databases,
+// so both are described the same way
+func fingerprintVersion(srcDB, tgtDB *sql.DB) (int, error) {
+	version := 0
+	for _, db := range []*sql.DB{srcDB, tgtDB} {
+		var num int
+		if err := db.QueryRow("SELECT current_setting('server_version_num')::int;").Scan(&num); err != nil {
+			return 0, fmt.Errorf("failed to check server version: %v", err)
+		}
+		if version == 0 || num < version {
+			version = num
+		}
+	}
+	return version, nil
+}
+
+// computeFingerprint hashes the canonical description of every object.
+// Whitespace in definitions is normalized; the overall hash covers the sorted
+// list of object keys and hashes.
+func computeFingerprint(db *sql.DB, version int) (*Fingerprint, error) {
+	fp := &Fingerprint{Objects: map[string]string{}}
+
+	for _, query := range queriesForVersion(version) {
+		rows, err := db.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var kind, identity string
+			var definition sql.NullString
+			if err := rows.Scan(&kind, &identity, &definition); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			normalized := strings.Join(strings.Fields(definition.String), " ")
+			sum := sha256.Sum256([]byte(normalized))
+			fp.Objects[kind+" "+identity] = hex.EncodeToString(sum[:])
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	overall := sha256.New()
+	for _, key := range sortedKeys(fp.Objects) {
+		fmt.Fprintf(overall, "%s %s\n", key, fp.Objects[key])
+	}
+	fp.Overall = hex.EncodeToString(overall.Sum(nil))
+	return fp, nil
+}
+
+// FingerprintComparison is the result of comparing source and target fingerprints
+type FingerprintComparison struct {
+	Source          *Fingerprint
+	Target          *Fingerprint
+	Matching        []string
+	Mismatched      []string
+	MissingOnTarget []string
+	ExtraOnTarget   []string
+}
+
+// Equal reports whether both schemas have the same fingerprint
+func (c *FingerprintComparison) Equal() bool {
+	return c.Source.Overall == c.Target.Overall
+}
+
+// Print writes the overall hashes and the status of every object
+func (c *FingerprintComparison) Print(w io.Writer) {
+	fmt.Fprintf(w, "Source schema fingerprint: %s (%d objects)\n", c.Source.Overall, len(c.Source.Objects))
+	fmt.Fprintf(w, "Target schema fingerprint: %s (%d objects)\n", c.Target.Overall, len(c.Target.Objects))
+
+	status := map[string]string{}
+	for _, key := range c.Matching {
+		status[key] = "MATCH"
+	}
+	for _, key := range c.Mismatched {
+		status[key] = "DIFF"
+	}
+	for _, key := range c.MissingOnTarget {
+		status[key] = "MISSING ON TARGET"
+	}
+	for _, key := range c.ExtraOnTarget {
+		status[key] = "ONLY ON TARGET"
+	}
+	for _, key := range sortedKeys(status) {
+		hash := c.Source.Objects[key]
+		if hash == "" {
+			hash = c.Target.Objects[key]
+		}
+		fmt.Fprintf(w, "[%s] %s %s\n", status[key], hash[:16], key)
+	}
+
+	fmt.Fprintf(w, "%d matching, %d different, %d missing on target, %d only on target\n",
+		len(c.Matching), len(c.Mismatched), len(c.MissingOnTarget), len(c.ExtraOnTarget))
+}
+
+// CompareFingerprints computes the schema fingerprint on the source and the
+// target and compares them object by object. Ownership and privileges are
+// not part of the fingerprint, matching the --no-owner --no-privileges dump.
+func (s *SchemaHandler) CompareFingerprints() (*FingerprintComparison, error) {
+	srcDB, err := sql.Open("postgres", s.source.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to source database: %v", err)
+	}
+	defer srcDB.Close()
+
+	tgtDB, err := sql.Open("postgres", s.target.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer tgtDB.Close()
+
+	version, err := fingerprintVersion(srcDB, tgtDB)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &FingerprintComparison{}
+	if result.Source, err = computeFingerprint(srcDB, version); err != nil {
+		return nil, fmt.Errorf("failed to fingerprint source schema: %v", err)
+	}
+	if result.Target, err = computeFingerprint(tgtDB, version); err != nil {
+		return nil, fmt.Errorf("failed to fingerprint target schema: %v", err)
+	}
+
+	for _, key := range sortedKeys(result.Source.Objects) {
+		targetHash, exists := result.Target.Objects[key]
+		switch {
+		case !exists:
+			result.MissingOnTarget = append(result.MissingOnTarget, key)
+		case targetHash != result.Source.Objects[key]:
+			result.Mismatched = append(result.Mismatched, key)
+		default:
+			result.Matching = append(result.Matching, key)
+		}
+	}
+	for _, key := range sortedKeys(result.Target.Objects) {
+		if _, exists := result.Source.Objects[key]; !exists {
+			result.ExtraOnTarget = append(result.ExtraOnTarget, key)
+		}
+	}
+
+	return result, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
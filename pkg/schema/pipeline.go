@@ -0,0 +1,186 @@
+package schema
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"pg-migration/pkg/config"
+)
+
+// toolingSchema holds the DDL capture queue and trigger function that the
+// replication package installs on the source. It is not part of the
+// migrated schema.
+const toolingSchema = "aiven_db_migrate"
+
+// pgDumpCommand builds a schema-only pg_dump command for the source database
+func (s *SchemaHandler) pgDumpCommand(extraArgs ...string) *exec.Cmd {
+	args := []string{
+		"-h", s.source.Host,
+		"-p", fmt.Sprintf("%d", s.source.Port),
+		"-U", s.source.User,
+		"-d", s.source.Database,
+		"--schema-only",   // Only dump the schema, not the data
+		"--no-owner",      // Don't output commands to set ownership
+		"--no-privileges", // Don't output privileges (GRANT/REVOKE)
+		"--exclude-schema=" + toolingSchema,
+	}
+
+	cmd := exec.Command("pg_dump", append(args, extraArgs...)...)
+	cmd.Env = commandEnv(s.source)
+	return cmd
+}
+
+// psqlCommand builds a psql command connected to the target database
+func (s *SchemaHandler) psqlCommand(extraArgs ...string) *exec.Cmd {
+	args := []string{
+		"-h", s.target.Host,
+		"-p", fmt.Sprintf("%d", s.target.Port),
+		"-U", s.target.User,
+		"-d", s.target.Database,
+	}
+
+	cmd := exec.Command("psql", append(args, extraArgs...)...)
+	cmd.Env = commandEnv(s.target)
+	return cmd
+}
+
+// commandEnv passes the password and SSL mode to the client tools
+func commandEnv(cfg *config.DBConfig) []string {
+	// Set the PGPASSWORD environment variable
+	env := append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", cfg.Password))
+
+	// Set the PGSSLMODE environment variable if SSL mode is specified
+	if cfg.SSLMode != "" {
+		env = append(env, fmt.Sprintf("PGSSLMODE=%s", cfg.SSLMode))
+	}
+	return env
+}
+
+// dumpStream is the standard output of a running pg_dump. Reading it to the
+// end waits for pg_dump, and a failed exit is reported in place of io.EOF, so
+// consumers never mistake a truncated dump for a complete one.
+type dumpStream struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+	err    error
+}
+
+// startDump starts pg_dump and returns its output as a stream
+func (s *SchemaHandler) startDump() (*dumpStream, error) {
+	cmd := s.pgDumpCommand()
+
+	stream := &dumpStream{cmd: cmd}
+	cmd.Stderr = &stream.stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pg_dump pipe: %v", err)
+	}
+	stream.stdout = stdout
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start pg_dump: %v", err)
+	}
+	return stream, nil
+}
+
+// Read implements io.Reader
+func (d *dumpStream) Read(p []byte) (int, error) {
+	if d.done {
+		return 0, d.err
+	}
+
+	n, err := d.stdout.Read(p)
+	if err == nil {
+		return n, nil
+	}
+
+	d.done = true
+	if err != io.EOF {
+		d.cmd.Process.Kill()
+	}
+	if waitErr := d.cmd.Wait(); waitErr != nil {
+		d.err = fmt.Errorf("pg_dump failed: %v, stderr: %s", waitErr, d.stderr.String())
+	} else if err != io.EOF {
+		d.err = fmt.Errorf("failed to read pg_dump output: %v", err)
+	} else {
+		d.err = io.EOF
+	}
+	return n, d.err
+}
+
+// Close stops pg_dump if it is still running
+func (d *dumpStream) Close() error {
+	if d.done {
+		return nil
+	}
+	d.done = true
+	d.err = errors.New("pg_dump output closed")
+	d.cmd.Process.Kill()
+	d.cmd.Wait()
+	return nil
+}
+
+// errorRecorder remembers the first non-EOF error returned by a reader
+type errorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+// Read implements io.Reader
+func (e *errorRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// restoreStream pipes the dump read from r through the statement rewrites into
+// psql. The pipes provide backpressure in both directions. If the input fails
+// part way, psql is killed before it sees end of input, so an incomplete dump
+// is never applied as if it were complete.
+func (s *SchemaHandler) restoreStream(r io.Reader) error {
+	cmd := s.psqlCommand("-v", "ON_ERROR_STOP=1") // Stop execution if there's an error
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create psql pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start psql: %v", err)
+	}
+
+	input := &errorRecorder{r: r}
+	streamDone := make(chan error, 1)
+	go func() {
+		err := processSchemaFile(input, stdin, s.rules)
+		if input.err != nil {
+			cmd.Process.Kill()
+		}
+		stdin.Close()
+		streamDone <- err
+	}()
+
+	waitErr := cmd.Wait()
+	streamErr := <-streamDone
+
+	switch {
+	case input.err != nil:
+		return fmt.Errorf("schema stream failed, restore aborted: %v", input.err)
+	case waitErr != nil:
+		return fmt.Errorf("psql restore failed: %v, stderr: %s", waitErr, stderr.String())
+	case streamErr != nil:
+		return fmt.Errorf("failed to process schema stream: %v", streamErr)
+	}
+	return nil
+}
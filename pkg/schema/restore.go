@@ -0,0 +1,113 @@
+package schema
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/lib/pq" // PostgreSQL driver
+)
+
+// RestoreError describes the dump statement that made a transactional restore fail
+type RestoreError struct {
+	Line      int        // Line of the statement in the original dump
+	Statement string     // Statement as sent to the server
+	Object    ObjectInfo // Object the statement belongs to
+	SQLState  string     // SQLSTATE reported by the server, if any
+	Err       error
+}
+
+// Error implements the error interface
+func (e *RestoreError) Error() string {
+	state := e.SQLState
+	if state == "" {
+		state = "unknown"
+	}
+	return fmt.Sprintf("statement at line %d for %s failed (SQLSTATE %s): %v\n%s",
+		e.Line, e.Object, state, e.Err, truncateStatement(e.Statement, 1000))
+}
+
+// Unwrap returns the underlying database error
+func (e *RestoreError) Unwrap() error {
+	return e.Err
+}
+
+// newRestoreError wraps a statement failure, extracting the SQLSTATE when the
+// server reported one
+func newRestoreError(stmt Statement, sqlText string, err error) *RestoreError {
+	restoreErr := &RestoreError{
+		Line:      stmt.Line,
+		Statement: sqlText,
+		Object:    stmt.Object,
+		Err:       err,
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		restoreErr.SQLState = string(pqErr.Code)
+	}
+	return restoreErr
+}
+
+// restoreInTransaction drops the existing objects and applies the dump read
+// from r statement by statement inside a single transaction. On failure the
+// transaction is rolled back and a *RestoreError is returned.
+func (s *SchemaHandler) restoreInTransaction(r io.Reader) error {
+	db, err := sql.Open("postgres", s.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin restore transaction: %v", err)
+	}
+	defer tx.Rollback() // No-op once the transaction is committed
+
+	if _, err := tx.Exec(dropObjectsScript); err != nil {
+		return fmt.Errorf("failed to drop existing objects: %v", err)
+	}
+
+	count := 0
+	scanner := NewStatementScanner(r)
+	for scanner.Scan() {
+		stmt := scanner.Statement()
+		if stmt.Meta {
+			// psql meta-commands (e.g. \restrict) have no meaning over a plain connection
+			log.Printf("Skipping psql meta-command at line %d: %s", stmt.Line, stmt.SQL)
+			continue
+		}
+
+		sqlText, keep := s.rules.Apply(stmt)
+		if !keep {
+			continue
+		}
+		if _, err := tx.Exec(sqlText); err != nil {
+			return newRestoreError(stmt, sqlText, err)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read schema dump: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit restore transaction: %v", err)
+	}
+
+	log.Printf("Restored %d statements in a single transaction\n", count)
+	return nil
+}
+
+// truncateStatement shortens long statements for error messages
+func truncateStatement(stmt string, max int) string {
+	stmt = strings.TrimSpace(stmt)
+	if len(stmt) <= max {
+		return stmt
+	}
+	return stmt[:max] + " ..."
+}
@@ -0,0 +1,332 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Rule rewrites or drops dump statements of the given types
+type Rule struct {
+	Name        string `json:"name"`
+	Match       string `json:"match"`       // Comma-separated statement types (e.g. "CREATE TABLE"), "*" or empty for all
+	Pattern     string `json:"pattern"`     // Regular expression; empty matches every statement of the types
+	Replacement string `json:"replacement"` // Replacement for Pattern, may use $1 style references
+	Drop        bool   `json:"drop"`        // Drop matching statements instead of rewriting them
+
+	types         []string
+	pattern       *regexp.Regexp
+	beforeVersion int  // Only applied to targets older than this server_version_num, if set
+	builtin       bool // Only counted, not recorded per statement
+}
+
+// TransformConfig configures the dump transformations applied on restore
+type TransformConfig struct {
+	StripTablespaces bool              `json:"strip_tablespaces"` // Remove TABLESPACE clauses
+	CollationMap     map[string]string `json:"collation_map"`     // Collation renames, source to target
+	DropExtensions   []string          `json:"drop_extensions"`   // Extensions the target does not support
+	Owner            string            `json:"owner"`             // Role to use in OWNER TO clauses
+	Rules            []Rule            `json:"rules"`             // Additional user-defined rules
+}
+
+// LoadTransformConfig reads a transformation config from a JSON file
+func LoadTransformConfig(path string) (*TransformConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %v", err)
+	}
+
+	var cfg TransformConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// idempotencyRules make the statements of a dump safe to apply to a target
+// that already has some of the objects
+var idempotencyRules = []Rule{
+	{Name: "create-schema-if-not-exists", Match: "CREATE SCHEMA", Pattern: `^CREATE SCHEMA `, Replacement: "CREATE SCHEMA IF NOT EXISTS "},
+	{Name: "create-or-replace-function", Match: "CREATE FUNCTION", Pattern: `^CREATE FUNCTION `, Replacement: "CREATE OR REPLACE FUNCTION "},
+	{Name: "create-table-if-not-exists", Match: "CREATE TABLE", Pattern: `^CREATE TABLE `, Replacement: "CREATE TABLE IF NOT EXISTS "},
+	{Name: "create-index-if-not-exists", Match: "CREATE INDEX", Pattern: `^CREATE INDEX `, Replacement: "CREATE INDEX IF NOT EXISTS "},
+	{Name: "create-sequence-if-not-exists", Match: "CREATE SEQUENCE", Pattern: `^CREATE SEQUENCE `, Replacement: "CREATE SEQUENCE IF NOT EXISTS "},
+	{Name: "create-or-replace-view", Match: "CREATE VIEW", Pattern: `^CREATE VIEW `, Replacement: "CREATE OR REPLACE VIEW "},
+}
+
+// toolingRules drop the parts of the migration tooling that pg_dump includes
+// despite the excluded schema
+var toolingRules = []Rule{
+	{Name: "drop-ddl-capture-trigger", Match: "CREATE EVENT TRIGGER", Pattern: `^CREATE EVENT TRIGGER "?aiven_db_migrate_ddl_capture"?\s`, Drop: true},
+}
+
+// compatibilityRules drop what newer pg_dump versions emit for settings that
+// older targets do not know
+var compatibilityRules = []Rule{
+	{Name: "drop-default-table-access-method", Match: "SET", Pattern: `(?i)^SET\s+default_table_access_method\b`, Drop: true, beforeVersion: 120000},
+}
+
+// identifierPattern matches a plain or double-quoted SQL identifier
+const identifierPattern = `(?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)`
+
+// plainIdentifier matches the names pg_dump leaves unquoted
+var plainIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// collationPattern matches a reference to the named collation, quoted or
+// not and optionally schema-qualified, and captures what follows it
+func collationPattern(name string) string {
+	names := `"` + regexp.QuoteMeta(strings.ReplaceAll(name, `"`, `""`)) + `"`
+	if plainIdentifier.MatchString(name) {
+		names += `|(?i:` + regexp.QuoteMeta(name) + `)`
+	}
+	return `COLLATE\s+(?:` + identifierPattern + `\.)?(?:` + names + `)([^A-Za-z0-9_$"]|$)`
+}
+
+// rules expands the config into the rules it enables, in application order
+func (c *TransformConfig) rules() []Rule {
+	var rules []Rule
+
+	if c.StripTablespaces {
+		rules = append(rules,
+			Rule{
+				Name:    "strip-tablespace",
+				Match:   "CREATE TABLE,CREATE INDEX,CREATE MATERIALIZED VIEW,ALTER TABLE",
+				Pattern: `(?i)\s+(?:USING\s+INDEX\s+)?TABLESPACE\s+` + identifierPattern,
+			},
+			Rule{Name: "drop-default-tablespace", Match: "SET", Pattern: `(?i)^SET\s+default_tablespace\b`, Drop: true},
+		)
+	}
+
+	// Sorted so the rule order does not depend on map iteration
+	var collations []string
+	for from := range c.CollationMap {
+		collations = append(collations, from)
+	}
+	sort.Strings(collations)
+	for _, from := range collations {
+		to := c.CollationMap[from]
+		rules = append(rules,
+			Rule{
+				Name:        "map-collation:" + from,
+				Pattern:     collationPattern(from),
+				Replacement: "COLLATE " + strings.ReplaceAll(pq.QuoteIdentifier(to), "$", "$$") + "${1}",
+			},
+			Rule{
+				Name:        "map-collation-locale:" + from,
+				Match:       "CREATE COLLATION",
+				Pattern:     `(?i)\b(locale|lc_collate|lc_ctype)\s*=\s*'` + regexp.QuoteMeta(from) + `'`,
+				Replacement: "$1 = " + strings.ReplaceAll(pq.QuoteLiteral(to), "$", "$$"),
+			},
+		)
+	}
+
+	for _, ext := range c.DropExtensions {
+		rules = append(rules, Rule{
+			Name:    "drop-extension:" + ext,
+			Match:   "CREATE EXTENSION,COMMENT",
+			Pattern: `(?i)^(?:CREATE EXTENSION(?: IF NOT EXISTS)?|COMMENT ON EXTENSION)\s+"?` + regexp.QuoteMeta(ext) + `"?(?:\s|;|$)`,
+			Drop:    true,
+		})
+	}
+
+	if c.Owner != "" {
+		rules = append(rules, Rule{
+			Name:        "owner-to",
+			Pattern:     `(?i)\bOWNER TO\s+` + identifierPattern,
+			Replacement: "OWNER TO " + strings.ReplaceAll(pq.QuoteIdentifier(c.Owner), "$", "$$"),
+		})
+	}
+
+	return append(rules, c.Rules...)
+}
+
+// RuleHit records that a rule changed or dropped a statement
+type RuleHit struct {
+	Rule    string
+	Line    int
+	Object  ObjectInfo
+	Dropped bool
+}
+
+// RuleEngine applies rewrite rules to dump statements. It counts how often
+// each rule fired and records which statements the configured rules fired
+// on; the built-in rules fire on most of a dump, so they are only counted.
+type RuleEngine struct {
+	rules         []*Rule
+	hits          []RuleHit
+	counts        map[string]int
+	targetVersion int
+}
+
+// builtinRules are applied before any configured rule
+func builtinRules() []Rule {
+	rules := append([]Rule{}, toolingRules...)
+	rules = append(rules, compatibilityRules...)
+	return append(rules, idempotencyRules...)
+}
+
+// NewRuleEngine compiles the given rules. The built-in tooling and
+// idempotency rules are always applied first.
+func NewRuleEngine(rules []Rule) (*RuleEngine, error) {
+	engine := &RuleEngine{counts: map[string]int{}}
+	builtin := builtinRules()
+	for i, rule := range append(builtin, rules...) {
+		rule := rule
+		rule.builtin = i < len(builtin)
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule without a name (match %q, pattern %q)", rule.Match, rule.Pattern)
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern in rule %s: %v", rule.Name, err)
+			}
+			rule.pattern = re
+		} else if !rule.Drop {
+			return nil, fmt.Errorf("rule %s needs a pattern unless it drops statements", rule.Name)
+		}
+		for _, t := range strings.Split(rule.Match, ",") {
+			if t = strings.ToUpper(strings.Join(strings.Fields(t), " ")); t != "" && t != "*" {
+				rule.types = append(rule.types, t)
+			}
+		}
+		engine.rules = append(engine.rules, &rule)
+	}
+	return engine, nil
+}
+
+// SetTargetVersion sets the server_version_num of the target, which enables
+// the compatibility rules for older servers. Without it they are not applied.
+func (e *RuleEngine) SetTargetVersion(version int) {
+	e.targetVersion = version
+}
+
+// Apply runs the rules over a statement. It returns the rewritten statement,
+// or false when a rule dropped it. psql meta-commands are passed through.
+func (e *RuleEngine) Apply(stmt Statement) (string, bool) {
+	if stmt.Meta {
+		return stmt.SQL, true
+	}
+
+	sqlText := stmt.SQL
+	stmtType := StatementType(sqlText)
+	for _, rule := range e.rules {
+		if !rule.matchesType(stmtType) {
+			continue
+		}
+		if rule.beforeVersion > 0 && (e.targetVersion == 0 || e.targetVersion >= rule.beforeVersion) {
+			continue
+		}
+		if rule.pattern != nil && !rule.pattern.MatchString(sqlText) {
+			continue
+		}
+
+		e.counts[rule.Name]++
+		if !rule.builtin {
+			e.hits = append(e.hits, RuleHit{Rule: rule.Name, Line: stmt.Line, Object: stmt.Object, Dropped: rule.Drop})
+		}
+		if rule.Drop {
+			return "", false
+		}
+		sqlText = rule.pattern.ReplaceAllString(sqlText, rule.Replacement)
+	}
+	return sqlText, true
+}
+
+// Hits returns the applications of configured rules recorded so far
+func (e *RuleEngine) Hits() []RuleHit {
+	return e.hits
+}
+
+// Counts returns how often each rule fired so far, by rule name
+func (e *RuleEngine) Counts() map[string]int {
+	return e.counts
+}
+
+// PrintReport writes how often each rule fired and, for every rule that is
+// not a built-in rule, the statements it fired on
+func (e *RuleEngine) PrintReport(w io.Writer) {
+	for _, rule := range e.rules {
+		fmt.Fprintf(w, "%-40s fired %d times\n", rule.Name, e.counts[rule.Name])
+	}
+
+	for _, hit := range e.hits {
+		action := "rewrote"
+		if hit.Dropped {
+			action = "dropped"
+		}
+		fmt.Fprintf(w, "  %s %s statement at line %d (%s)\n", hit.Rule, action, hit.Line, hit.Object)
+	}
+}
+
+func (r *Rule) matchesType(stmtType string) bool {
+	if len(r.types) == 0 {
+		return true
+	}
+	for _, t := range r.types {
+		if t == stmtType {
+			return true
+		}
+	}
+	return false
+}
+
+// createModifiers are keywords between CREATE and the object type that do not
+// change the statement type
+var createModifiers = map[string]bool{
+	"OR": true, "REPLACE": true, "UNIQUE": true, "UNLOGGED": true, "TEMP": true,
+	"TEMPORARY": true, "GLOBAL": true, "LOCAL": true, "TRUSTED": true,
+	"PROCEDURAL": true, "CONSTRAINT": true, "DEFAULT": true, "RECURSIVE": true,
+}
+
+// twoWordTypes are object types spelled with two keywords
+var twoWordTypes = map[string]bool{
+	"MATERIALIZED": true, "FOREIGN": true, "EVENT": true, "TEXT": true,
+	"ACCESS": true, "USER": true, "OPERATOR": true, "DEFAULT": true,
+}
+
+// StatementType returns the command of a statement the way PostgreSQL names
+// it in command tags, e.g. "CREATE TABLE" for "CREATE UNLOGGED TABLE ...",
+// "CREATE INDEX" for "CREATE UNIQUE INDEX ..." or "SET"
+func StatementType(sqlText string) string {
+	var words []string
+	for _, field := range strings.Fields(sqlText) {
+		word := strings.ToUpper(strings.TrimRight(field, ";("))
+		if word == "" || strings.IndexFunc(word, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+			break
+		}
+		words = append(words, word)
+		if len(words) == 6 {
+			break
+		}
+	}
+	if len(words) == 0 {
+		return ""
+	}
+
+	command := words[0]
+	if command != "CREATE" && command != "ALTER" && command != "DROP" {
+		return command
+	}
+
+	rest := words[1:]
+	if command == "CREATE" {
+		for len(rest) > 0 && createModifiers[rest[0]] {
+			rest = rest[1:]
+		}
+	}
+	switch {
+	case len(rest) == 0:
+		return command
+	case len(rest) >= 2 && twoWordTypes[rest[0]]:
+		return command + " " + rest[0] + " " + rest[1]
+	default:
+		return command + " " + rest[0]
+	}
+}
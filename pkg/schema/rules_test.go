@@ -0,0 +1,199 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleEngineApply(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        TransformConfig
+		targetVersion int
+		stmt          Statement
+		want          string
+		wantKeep      bool
+		wantHits      []string
+	}{
+		{
+			name:     "built-in idempotency rule",
+			stmt:     Statement{SQL: "CREATE TABLE public.a (id int);"},
+			want:     "CREATE TABLE IF NOT EXISTS public.a (id int);",
+			wantKeep: true,
+			wantHits: []string{"create-table-if-not-exists"},
+		},
+		{
+			name:     "unique index keeps its type",
+			stmt:     Statement{SQL: "CREATE UNIQUE INDEX a_idx ON public.a (id);"},
+			want:     "CREATE UNIQUE INDEX a_idx ON public.a (id);",
+			wantKeep: true,
+		},
+		{
+			name:     "ddl capture trigger is dropped",
+			stmt:     Statement{SQL: "CREATE EVENT TRIGGER aiven_db_migrate_ddl_capture ON ddl_command_end EXECUTE FUNCTION f();"},
+			wantHits: []string{"drop-ddl-capture-trigger"},
+		},
+		{
+			name:     "meta-commands pass through",
+			config:   TransformConfig{Rules: []Rule{{Name: "drop-all", Drop: true}}},
+			stmt:     Statement{SQL: "\\connect db", Meta: true},
+			want:     "\\connect db",
+			wantKeep: true,
+		},
+		{
+			name:     "strip tablespace",
+			config:   TransformConfig{StripTablespaces: true},
+			stmt:     Statement{SQL: "CREATE INDEX a_idx ON public.a USING btree (id) TABLESPACE \"fast disk\";"},
+			want:     "CREATE INDEX IF NOT EXISTS a_idx ON public.a USING btree (id);",
+			wantKeep: true,
+			wantHits: []string{"create-index-if-not-exists", "strip-tablespace"},
+		},
+		{
+			name:     "drop default tablespace",
+			config:   TransformConfig{StripTablespaces: true},
+			stmt:     Statement{SQL: "SET default_tablespace = '';"},
+			wantHits: []string{"drop-default-tablespace"},
+		},
+		{
+			name:          "access method setting dropped for older targets",
+			targetVersion: 110000,
+			stmt:          Statement{SQL: "SET default_table_access_method = heap;"},
+			wantHits:      []string{"drop-default-table-access-method"},
+		},
+		{
+			name:          "access method setting kept for newer targets",
+			targetVersion: 120000,
+			stmt:          Statement{SQL: "SET default_table_access_method = heap;"},
+			want:          "SET default_table_access_method = heap;",
+			wantKeep:      true,
+		},
+		{
+			name:     "map collation",
+			config:   TransformConfig{CollationMap: map[string]string{"en_US": "en-US-x-icu"}},
+			stmt:     Statement{SQL: "ALTER TABLE a ALTER COLUMN name TYPE text COLLATE pg_catalog.\"en_US\";"},
+			want:     "ALTER TABLE a ALTER COLUMN name TYPE text COLLATE \"en-US-x-icu\";",
+			wantKeep: true,
+			wantHits: []string{"map-collation:en_US"},
+		},
+		{
+			name:     "map schema-qualified plain collation",
+			config:   TransformConfig{CollationMap: map[string]string{"mycoll": "othercoll"}},
+			stmt:     Statement{SQL: "CREATE TABLE public.a (name text COLLATE public.mycoll, note text COLLATE public.mycoll2);"},
+			want:     "CREATE TABLE IF NOT EXISTS public.a (name text COLLATE \"othercoll\", note text COLLATE public.mycoll2);",
+			wantKeep: true,
+			wantHits: []string{"create-table-if-not-exists", "map-collation:mycoll"},
+		},
+		{
+			name:     "drop extension",
+			config:   TransformConfig{DropExtensions: []string{"pg_cron"}},
+			stmt:     Statement{SQL: "COMMENT ON EXTENSION pg_cron IS 'Job scheduler';"},
+			wantHits: []string{"drop-extension:pg_cron"},
+		},
+		{
+			name:     "other extensions are kept",
+			config:   TransformConfig{DropExtensions: []string{"pg_cron"}},
+			stmt:     Statement{SQL: "CREATE EXTENSION IF NOT EXISTS pg_cron_helper;"},
+			want:     "CREATE EXTENSION IF NOT EXISTS pg_cron_helper;",
+			wantKeep: true,
+		},
+		{
+			name:     "owner",
+			config:   TransformConfig{Owner: "app$owner"},
+			stmt:     Statement{SQL: "ALTER TABLE public.a OWNER TO \"old owner\";"},
+			want:     "ALTER TABLE public.a OWNER TO \"app$owner\";",
+			wantKeep: true,
+			wantHits: []string{"owner-to"},
+		},
+		{
+			name: "user rule limited to statement types",
+			config: TransformConfig{Rules: []Rule{
+				{Name: "no-comments", Match: "comment", Drop: true},
+			}},
+			stmt:     Statement{SQL: "SELECT 'COMMENT';"},
+			want:     "SELECT 'COMMENT';",
+			wantKeep: true,
+		},
+		{
+			name: "user rule with references",
+			config: TransformConfig{Rules: []Rule{
+				{Name: "rename-schema", Match: "CREATE VIEW", Pattern: `\bold_(\w+)\.`, Replacement: "new_$1."},
+			}},
+			stmt:     Statement{SQL: "CREATE VIEW old_app.v AS SELECT * FROM old_app.t;"},
+			want:     "CREATE OR REPLACE VIEW new_app.v AS SELECT * FROM new_app.t;",
+			wantKeep: true,
+			wantHits: []string{"create-or-replace-view", "rename-schema"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, err := NewRuleEngine(tt.config.rules())
+			if err != nil {
+				t.Fatalf("NewRuleEngine() error = %v", err)
+			}
+			engine.SetTargetVersion(tt.targetVersion)
+			got, keep := engine.Apply(tt.stmt)
+			if got != tt.want || keep != tt.wantKeep {
+				t.Errorf("Apply() = %q, %t, want %q, %t", got, keep, tt.want, tt.wantKeep)
+			}
+			var hits []string
+			for _, rule := range engine.rules {
+				if engine.Counts()[rule.Name] > 0 {
+					hits = append(hits, rule.Name)
+				}
+			}
+			if !reflect.DeepEqual(hits, tt.wantHits) {
+				t.Errorf("Counts() = %v, want hits of %v", engine.Counts(), tt.wantHits)
+			}
+			// Only configured rules are recorded per statement
+			for _, hit := range engine.Hits() {
+				for _, rule := range builtinRules() {
+					if hit.Rule == rule.Name {
+						t.Errorf("Hits() records built-in rule %s", hit.Rule)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNewRuleEngineErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "missing name", rule: Rule{Pattern: "x", Replacement: "y"}},
+		{name: "invalid pattern", rule: Rule{Name: "bad", Pattern: "("}},
+		{name: "rewrite without pattern", rule: Rule{Name: "empty", Replacement: "y"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRuleEngine([]Rule{tt.rule}); err == nil {
+				t.Errorf("NewRuleEngine() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestStatementType(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{"CREATE UNLOGGED TABLE a (id int);", "CREATE TABLE"},
+		{"CREATE OR REPLACE FUNCTION f() RETURNS int", "CREATE FUNCTION"},
+		{"CREATE MATERIALIZED VIEW mv AS SELECT 1;", "CREATE MATERIALIZED VIEW"},
+		{"ALTER TABLE ONLY a ADD CONSTRAINT c CHECK (true);", "ALTER TABLE"},
+		{"ALTER DEFAULT PRIVILEGES GRANT SELECT ON TABLES TO r;", "ALTER DEFAULT PRIVILEGES"},
+		{"set search_path = '';", "SET"},
+		{"SELECT pg_catalog.set_config('search_path', '', false);", "SELECT"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := StatementType(tt.sql); got != tt.want {
+			t.Errorf("StatementType(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
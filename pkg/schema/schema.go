@@ -1,15 +1,14 @@
 package schema
 
 import (
+	"bufio"
 	"bytes"
+	"database/sql"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
-	"time"
 
 	"pg-migration/pkg/config"
 )
@@ -18,42 +17,91 @@ import (
 type SchemaHandler struct {
 	source *config.DBConfig
 	target *config.DBConfig
+
+	singleTransaction bool
+	rules             *RuleEngine
 }
 
 // NewSchemaHandler creates a new SchemaHandler instance
-func NewSchemaHandler(source, target *config.DBConfig) *SchemaHandler {
+func NewSchemaHandler(source, target *config.DBConfig) (*SchemaHandler, error) {
+	rules, err := NewRuleEngine(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile built-in rules: %v", err)
+	}
+
 	return &SchemaHandler{
 		source: source,
 		target: target,
+		rules:  rules,
+	}, nil
+}
+
+// SetSingleTransaction makes restores from a file drop the existing objects
+// and apply the dump inside one transaction, so a failure leaves the target
+// untouched. Streamed restores always do.
+func (s *SchemaHandler) SetSingleTransaction(enabled bool) {
+	s.singleTransaction = enabled
+}
+
+// SetTransformConfig adds the rules enabled by the config to the built-in
+// rewrites applied to every restored statement
+func (s *SchemaHandler) SetTransformConfig(cfg *TransformConfig) error {
+	rules, err := NewRuleEngine(cfg.rules())
+	if err != nil {
+		return err
+	}
+	s.rules = rules
+	return nil
+}
+
+// detectTargetVersion passes the target server version to the rule engine,
+// which drops settings older targets do not know
+func (s *SchemaHandler) detectTargetVersion() error {
+	db, err := sql.Open("postgres", s.target.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRow("SELECT current_setting('server_version_num')::int;").Scan(&version); err != nil {
+		return fmt.Errorf("failed to check target server version: %v", err)
 	}
+	s.rules.SetTargetVersion(version)
+	return nil
+}
+
+// Rules returns the rule engine, which records the rules fired so far
+func (s *SchemaHandler) Rules() *RuleEngine {
+	return s.rules
 }
 
 // DumpAndRestoreSchema performs a schema-only dump from the source database
-// and restores it to the target database
+// and restores it to the target database. The dump is streamed from pg_dump
+// through the statement rewrites into the restore without temporary files.
+// The restore always runs in a single transaction: pg_dump can fail after
+// the existing objects were dropped and part of the dump was applied, which
+// would otherwise leave the target half restored.
 func (s *SchemaHandler) DumpAndRestoreSchema() error {
-	// Create a temporary directory for the dump file
-	tempDir, err := os.MkdirTemp("", "pg-migration-*")
+	dump, err := s.startDump()
 	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %v", err)
+		return fmt.Errorf("failed to dump schema: %v", err)
 	}
-	defer os.RemoveAll(tempDir) // Clean up temp directory when done
+	defer dump.Close() // Stops pg_dump if the restore gives up early
 
-	timestamp := time.Now().Format("20060102-150405")
-	dumpFilePath := filepath.Join(tempDir, fmt.Sprintf("schema-dump-%s.sql", timestamp))
-
-	// Dump schema from source with clean options
-	if err := s.dumpSchema(dumpFilePath); err != nil {
+	// Wait for the first bytes of the dump before touching the target, so
+	// connection or permission errors on the source leave it intact
+	input := bufio.NewReaderSize(dump, 64*1024)
+	if _, err := input.Peek(1); err != nil && err != io.EOF {
 		return fmt.Errorf("failed to dump schema: %v", err)
 	}
-	log.Printf("Schema dumped successfully to: %s\n", dumpFilePath)
 
-	// First drop existing objects in target database
-	if err := s.dropExistingObjects(); err != nil {
-		return fmt.Errorf("failed to drop existing objects: %v", err)
+	if err := s.detectTargetVersion(); err != nil {
+		return err
 	}
 
-	// Restore schema to target
-	if err := s.restoreSchema(dumpFilePath); err != nil {
+	// Restore schema to target, dropping existing objects first
+	if err := s.restoreInTransaction(input); err != nil {
 		return fmt.Errorf("failed to restore schema: %v", err)
 	}
 	log.Printf("Schema restored successfully to target database\n")
@@ -61,10 +109,8 @@ func (s *SchemaHandler) DumpAndRestoreSchema() error {
 	return nil
 }
 
-// dropExistingObjects drops all existing objects in the target database
-func (s *SchemaHandler) dropExistingObjects() error {
-	// Create a script to drop all existing objects
-	dropScript := `
+// dropObjectsScript drops all user objects in the target database before a restore
+const dropObjectsScript = `
 DO $$ 
 DECLARE
     schema_rec RECORD;
@@ -132,37 +178,10 @@ BEGIN
 END $$;
 `
 
-	// Create a temporary file for the drop script
-	tempFile, err := os.CreateTemp("", "drop-objects-*.sql")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file for drop script: %v", err)
-	}
-	defer os.Remove(tempFile.Name())
-
-	_, err = tempFile.WriteString(dropScript)
-	if err != nil {
-		return fmt.Errorf("failed to write drop script to temp file: %v", err)
-	}
-	tempFile.Close()
-
-	// Execute the drop script using psql
-	args := []string{
-		"-h", s.target.Host,
-		"-p", fmt.Sprintf("%d", s.target.Port),
-		"-U", s.target.User,
-		"-d", s.target.Database,
-		"-f", tempFile.Name(),
-	}
-
-	cmd := exec.Command("psql", args...)
-
-	// Set the PGPASSWORD environment variable
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", s.target.Password))
-
-	// Set the PGSSLMODE environment variable if SSL mode is specified
-	if s.target.SSLMode != "" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PGSSLMODE=%s", s.target.SSLMode))
-	}
+// dropExistingObjects drops all existing objects in the target database
+func (s *SchemaHandler) dropExistingObjects() error {
+	cmd := s.psqlCommand("-v", "ON_ERROR_STOP=1")
+	cmd.Stdin = strings.NewReader(dropObjectsScript)
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
@@ -181,37 +200,18 @@ func (s *SchemaHandler) DumpSchemaToFile(filePath string) error {
 
 // RestoreSchemaFromFile restores the schema from a specified file path
 func (s *SchemaHandler) RestoreSchemaFromFile(filePath string) error {
-	// First drop existing objects
-	if err := s.dropExistingObjects(); err != nil {
-		return fmt.Errorf("failed to drop existing objects: %v", err)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open dump file: %v", err)
 	}
+	defer file.Close()
 
-	return s.restoreSchema(filePath)
+	return s.RestoreSchemaFromReader(file)
 }
 
 // dumpSchema dumps the schema from the source database to a file
 func (s *SchemaHandler) dumpSchema(dumpFilePath string) error {
-	// pg_dump command with schema-only option
-	args := []string{
-		"-h", s.source.Host,
-		"-p", fmt.Sprintf("%d", s.source.Port),
-		"-U", s.source.User,
-		"-d", s.source.Database,
-		"--schema-only",   // Only dump the schema, not the data
-		"--no-owner",      // Don't output commands to set ownership
-		"--no-privileges", // Don't output privileges (GRANT/REVOKE)
-		"-f", dumpFilePath,
-	}
-
-	cmd := exec.Command("pg_dump", args...)
-
-	// Set the PGPASSWORD environment variable
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", s.source.Password))
-
-	// Set the PGSSLMODE environment variable if SSL mode is specified
-	if s.source.SSLMode != "" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PGSSLMODE=%s", s.source.SSLMode))
-	}
+	cmd := s.pgDumpCommand("-f", dumpFilePath)
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
@@ -223,159 +223,35 @@ func (s *SchemaHandler) dumpSchema(dumpFilePath string) error {
 	return nil
 }
 
-// restoreSchema restores the schema to the target database from a file
-func (s *SchemaHandler) restoreSchema(dumpFilePath string) error {
-	// First, read the file to handle it as stdin for psql
-	file, err := os.Open(dumpFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to open dump file: %v", err)
+// processSchemaFile applies the transformation rules to the statements of a
+// dump. It works one statement at a time, so the input is never held in
+// memory as a whole.
+func processSchemaFile(input io.Reader, output io.Writer, rules *RuleEngine) error {
+	writer := bufio.NewWriterSize(output, 64*1024)
+
+	scanner := NewStatementScanner(input)
+	for scanner.Scan() {
+		sqlText, keep := rules.Apply(scanner.Statement())
+		if !keep {
+			continue
+		}
+		if _, err := fmt.Fprintf(writer, "%s\n\n", sqlText); err != nil {
+			return fmt.Errorf("failed to write to output: %v", err)
+		}
 	}
-	defer file.Close()
-
-	// Modify dump file to add IF NOT EXISTS to CREATE SCHEMA statements
-	// and OR REPLACE to function definitions
-	modifiedDumpPath := dumpFilePath + ".modified"
-	modifiedFile, err := os.Create(modifiedDumpPath)
-	if err != nil {
-		return fmt.Errorf("failed to create modified dump file: %v", err)
-	}
-	defer os.Remove(modifiedDumpPath) // Clean up the modified file afterwards
-	defer modifiedFile.Close()
-
-	// Process the dump file
-	err = processSchemaFile(file, modifiedFile)
-	if err != nil {
-		return fmt.Errorf("failed to process schema file: %v", err)
-	}
-
-	// Reopen the modified file for reading
-	modifiedFile.Close()
-	modifiedFile, err = os.Open(modifiedDumpPath)
-	if err != nil {
-		return fmt.Errorf("failed to open modified dump file: %v", err)
-	}
-	defer modifiedFile.Close()
-
-	// psql command to restore
-	args := []string{
-		"-h", s.target.Host,
-		"-p", fmt.Sprintf("%d", s.target.Port),
-		"-U", s.target.User,
-		"-d", s.target.Database,
-		"-v", "ON_ERROR_STOP=1", // Stop execution if there's an error
-	}
-
-	cmd := exec.Command("psql", args...)
-	cmd.Stdin = modifiedFile // Use the modified dump file as input
-
-	// Set the PGPASSWORD environment variable
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", s.target.Password))
-
-	// Set the PGSSLMODE environment variable if SSL mode is specified
-	if s.target.SSLMode != "" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PGSSLMODE=%s", s.target.SSLMode))
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read input: %v", err)
 	}
 
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("psql restore failed: %v, stderr: %s", err, stderr.String())
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write to output: %v", err)
 	}
-
-	return nil
-}
-
-// processSchemaFile modifies SQL statements to make them idempotent
-func processSchemaFile(input io.Reader, output io.Writer) error {
-	// Read the entire file
-	content, err := io.ReadAll(input)
-	if err != nil {
-		return fmt.Errorf("failed to read input file: %v", err)
-	}
-
-	// Convert to string for easier processing
-	sqlContent := string(content)
-
-	// 1. Replace CREATE SCHEMA with CREATE SCHEMA IF NOT EXISTS
-	sqlContent = strings.Replace(
-		sqlContent,
-		"CREATE SCHEMA ",
-		"CREATE SCHEMA IF NOT EXISTS ",
-		-1,
-	)
-
-	// 2. Replace CREATE FUNCTION with CREATE OR REPLACE FUNCTION
-	sqlContent = strings.Replace(
-		sqlContent,
-		"CREATE FUNCTION ",
-		"CREATE OR REPLACE FUNCTION ",
-		-1,
-	)
-
-	// 3. Replace CREATE TABLE with CREATE TABLE IF NOT EXISTS
-	sqlContent = strings.Replace(
-		sqlContent,
-		"CREATE TABLE ",
-		"CREATE TABLE IF NOT EXISTS ",
-		-1,
-	)
-
-	// 4. Replace CREATE INDEX with CREATE INDEX IF NOT EXISTS
-	sqlContent = strings.Replace(
-		sqlContent,
-		"CREATE INDEX ",
-		"CREATE INDEX IF NOT EXISTS ",
-		-1,
-	)
-
-	// 5. Replace CREATE SEQUENCE with CREATE SEQUENCE IF NOT EXISTS
-	sqlContent = strings.Replace(
-		sqlContent,
-		"CREATE SEQUENCE ",
-		"CREATE SEQUENCE IF NOT EXISTS ",
-		-1,
-	)
-
-	// 6. Replace CREATE VIEW with CREATE OR REPLACE VIEW
-	sqlContent = strings.Replace(
-		sqlContent,
-		"CREATE VIEW ",
-		"CREATE OR REPLACE VIEW ",
-		-1,
-	)
-
-	// Write the modified content to the output
-	_, err = output.Write([]byte(sqlContent))
-	if err != nil {
-		return fmt.Errorf("failed to write to output file: %v", err)
-	}
-
 	return nil
 }
 
 // DumpSchemaToWriter dumps the schema from the source database to a writer
 func (s *SchemaHandler) DumpSchemaToWriter(writer io.Writer) error {
-	// pg_dump command with schema-only option
-	args := []string{
-		"-h", s.source.Host,
-		"-p", fmt.Sprintf("%d", s.source.Port),
-		"-U", s.source.User,
-		"-d", s.source.Database,
-		"--schema-only",   // Only dump the schema, not the data
-		"--no-owner",      // Don't output commands to set ownership
-		"--no-privileges", // Don't output privileges (GRANT/REVOKE)
-	}
-
-	// Add SSL mode if specified
-	if s.source.SSLMode != "" {
-		args = append(args, "--sslmode="+s.source.SSLMode)
-	}
-
-	cmd := exec.Command("pg_dump", args...)
-
-	// Set the PGPASSWORD environment variable
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", s.source.Password))
+	cmd := s.pgDumpCommand()
 
 	cmd.Stdout = writer
 	var stderr bytes.Buffer
@@ -390,54 +266,17 @@ func (s *SchemaHandler) DumpSchemaToWriter(writer io.Writer) error {
 
 // RestoreSchemaFromReader restores the schema to the target database from a reader
 func (s *SchemaHandler) RestoreSchemaFromReader(reader io.Reader) error {
-	// First drop existing objects
-	if err := s.dropExistingObjects(); err != nil {
-		return fmt.Errorf("failed to drop existing objects: %v", err)
-	}
-
-	// Create a buffer to hold the reader contents
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, reader); err != nil {
-		return fmt.Errorf("failed to read input: %v", err)
+	if err := s.detectTargetVersion(); err != nil {
+		return err
 	}
-
-	// Modify the content
-	content := buf.String()
-
-	// Same modifications as in processSchemaFile
-	content = strings.Replace(content, "CREATE SCHEMA ", "CREATE SCHEMA IF NOT EXISTS ", -1)
-	content = strings.Replace(content, "CREATE FUNCTION ", "CREATE OR REPLACE FUNCTION ", -1)
-	content = strings.Replace(content, "CREATE TABLE ", "CREATE TABLE IF NOT EXISTS ", -1)
-	content = strings.Replace(content, "CREATE INDEX ", "CREATE INDEX IF NOT EXISTS ", -1)
-	content = strings.Replace(content, "CREATE SEQUENCE ", "CREATE SEQUENCE IF NOT EXISTS ", -1)
-	content = strings.Replace(content, "CREATE VIEW ", "CREATE OR REPLACE VIEW ", -1)
-
-	// psql command to restore
-	args := []string{
-		"-h", s.target.Host,
-		"-p", fmt.Sprintf("%d", s.target.Port),
-		"-U", s.target.User,
-		"-d", s.target.Database,
-		"-v", "ON_ERROR_STOP=1", // Stop execution if there's an error
+	if s.singleTransaction {
+		return s.restoreInTransaction(reader)
 	}
 
-	// Add SSL mode if specified
-	if s.target.SSLMode != "" {
-		args = append(args, fmt.Sprintf("--sslmode=%s", s.target.SSLMode))
-	}
-
-	cmd := exec.Command("psql", args...)
-	cmd.Stdin = strings.NewReader(content) // Use the modified content as input
-
-	// Set the PGPASSWORD environment variable
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", s.target.Password))
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("psql restore failed: %v, stderr: %s", err, stderr.String())
+	// First drop existing objects
+	if err := s.dropExistingObjects(); err != nil {
+		return fmt.Errorf("failed to drop existing objects: %v", err)
 	}
 
-	return nil
+	return s.restoreStream(reader)
 }
@@ -0,0 +1,340 @@
+package schema
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ObjectInfo identifies the database object a dump statement belongs to, as
+// announced by pg_dump's "-- Name: ...; Type: ...; Schema: ..." comments
+type ObjectInfo struct {
+	Name   string
+	Type   string
+	Schema string
+}
+
+// String returns a human readable description of the object
+func (o ObjectInfo) String() string {
+	if o.Name == "" {
+		return "unknown object"
+	}
+	name := o.Name
+	if o.Schema != "" && o.Schema != "-" {
+		name = o.Schema + "." + o.Name
+	}
+	if o.Type == "" {
+		return name
+	}
+	return fmt.Sprintf("%s %s", o.Type, name)
+}
+
+// Statement is a single SQL statement read from a pg_dump script
+type Statement struct {
+	SQL    string     // Statement text including the terminating semicolon
+	Line   int        // 1-based line in the input where the statement starts
+	Meta   bool       // True for psql meta-commands such as \connect
+	Object ObjectInfo // Object from the closest preceding pg_dump header
+}
+
+// StatementScanner splits a SQL script into statements without loading it
+// into memory. It understands quoted strings, quoted identifiers, comments
+// and dollar-quoted bodies, so semicolons inside them do not end a statement.
+type StatementScanner struct {
+	r      *bufio.Reader
+	line   int
+	header ObjectInfo
+	stmt   Statement
+	err    error
+}
+
+// NewStatementScanner creates a new StatementScanner reading from r
+func NewStatementScanner(r io.Reader) *StatementScanner {
+	return &StatementScanner{
+		r:    bufio.NewReaderSize(r, 64*1024),
+		line: 1,
+	}
+}
+
+// Statement returns the statement produced by the last call to Scan
+func (sc *StatementScanner) Statement() Statement {
+	return sc.stmt
+}
+
+// Err returns the first read error encountered by the scanner
+func (sc *StatementScanner) Err() error {
+	return sc.err
+}
+
+// Scan advances to the next statement. It returns false at the end of the
+// input or on a read error, which is then available from Err.
+func (sc *StatementScanner) Scan() bool {
+	if sc.err != nil {
+		return false
+	}
+
+	var buf bytes.Buffer
+	start := 0
+
+	for {
+		c, err := sc.r.ReadByte()
+		if err == io.EOF {
+			// A trailing statement without a semicolon is still returned
+			if strings.TrimSpace(buf.String()) != "" {
+				sc.emit(buf.String(), start, false)
+				return true
+			}
+			return false
+		}
+		if err != nil {
+			sc.err = err
+			return false
+		}
+
+		// Between statements: skip whitespace and comments, and pick up
+		// the pg_dump object headers
+		if buf.Len() == 0 {
+			switch {
+			case c == '\n':
+				sc.line++
+				continue
+			case c == ' ' || c == '\t' || c == '\r':
+				continue
+			case c == '-' && sc.peek() == '-':
+				comment, err := sc.readLine()
+				if err != nil {
+					return false
+				}
+				sc.parseHeader(comment)
+				continue
+			case c == '/' && sc.peek() == '*':
+				var discard bytes.Buffer
+				discard.WriteByte(c)
+				if err := sc.copyBlockComment(&discard); err != nil {
+					return false
+				}
+				continue
+			case c == '\\':
+				start = sc.line
+				rest, err := sc.readLine()
+				if err != nil {
+					return false
+				}
+				sc.emit("\\"+strings.TrimRight(rest, "\r"), start, true)
+				return true
+			}
+			start = sc.line
+		}
+
+		prev := lastByte(&buf)
+		buf.WriteByte(c)
+
+		var copyErr error
+		switch c {
+		case '\n':
+			sc.line++
+		case '\'':
+			copyErr = sc.copyQuoted(&buf, '\'', prev == 'E' || prev == 'e')
+		case '"':
+			copyErr = sc.copyQuoted(&buf, '"', false)
+		case '-':
+			if sc.peek() == '-' {
+				var rest string
+				rest, copyErr = sc.readLine()
+				buf.WriteString(rest)
+				buf.WriteByte('\n')
+			}
+		case '/':
+			if sc.peek() == '*' {
+				copyErr = sc.copyBlockComment(&buf)
+			}
+		case '$':
+			if !isIdentByte(prev) {
+				copyErr = sc.copyDollarQuoted(&buf)
+			}
+		case ';':
+			sc.emit(buf.String(), start, false)
+			return true
+		}
+		if copyErr != nil {
+			return false
+		}
+	}
+}
+
+func (sc *StatementScanner) emit(text string, line int, meta bool) {
+	sc.stmt = Statement{
+		SQL:    strings.TrimSpace(text),
+		Line:   line,
+		Meta:   meta,
+		Object: sc.header,
+	}
+}
+
+func (sc *StatementScanner) peek() byte {
+	b, err := sc.r.Peek(1)
+	if err != nil || len(b) == 0 {
+		return 0
+	}
+	return b[0]
+}
+
+// readLine consumes the rest of the current line, including the newline
+func (sc *StatementScanner) readLine() (string, error) {
+	line, err := sc.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		sc.err = err
+		return "", err
+	}
+	if strings.HasSuffix(line, "\n") {
+		sc.line++
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// copyQuoted copies a quoted string or identifier up to its closing quote.
+// Doubled quotes are handled naturally as a close followed by a reopen.
+func (sc *StatementScanner) copyQuoted(buf *bytes.Buffer, quote byte, backslashEscapes bool) error {
+	for {
+		c, err := sc.r.ReadByte()
+		if err != nil {
+			return sc.unterminated(err, "quoted string")
+		}
+		buf.WriteByte(c)
+		switch {
+		case c == '\n':
+			sc.line++
+		case c == '\\' && backslashEscapes:
+			next, err := sc.r.ReadByte()
+			if err != nil {
+				return sc.unterminated(err, "quoted string")
+			}
+			buf.WriteByte(next)
+			if next == '\n' {
+				sc.line++
+			}
+		case c == quote:
+			return nil
+		}
+	}
+}
+
+// copyBlockComment copies a possibly nested /* ... */ comment. The opening
+// slash has already been consumed.
+func (sc *StatementScanner) copyBlockComment(buf *bytes.Buffer) error {
+	depth := 0
+	var prev byte = '/'
+	for {
+		c, err := sc.r.ReadByte()
+		if err != nil {
+			return sc.unterminated(err, "block comment")
+		}
+		buf.WriteByte(c)
+		switch {
+		case c == '\n':
+			sc.line++
+		case prev == '/' && c == '*':
+			depth++
+			c = 0 // "/*/" must not close the comment
+		case prev == '*' && c == '/':
+			depth--
+			if depth == 0 {
+				return nil
+			}
+			c = 0
+		}
+		prev = c
+	}
+}
+
+// copyDollarQuoted copies a $tag$ ... $tag$ body if the dollar sign that was
+// just consumed opens one. Otherwise (for example $1 parameters) it is a no-op.
+func (sc *StatementScanner) copyDollarQuoted(buf *bytes.Buffer) error {
+	tagLen := 0
+	for {
+		b, err := sc.r.Peek(tagLen + 1)
+		if err != nil || len(b) <= tagLen {
+			return nil
+		}
+		c := b[tagLen]
+		if c == '$' {
+			break
+		}
+		if !isIdentByte(c) || (tagLen == 0 && c >= '0' && c <= '9') {
+			return nil
+		}
+		tagLen++
+	}
+
+	tag := make([]byte, tagLen+1)
+	if _, err := io.ReadFull(sc.r, tag); err != nil {
+		sc.err = err
+		return err
+	}
+	buf.Write(tag)
+	delimiter := append([]byte{'$'}, tag...)
+
+	bodyStart := buf.Len()
+	for {
+		c, err := sc.r.ReadByte()
+		if err != nil {
+			return sc.unterminated(err, "dollar-quoted string")
+		}
+		buf.WriteByte(c)
+		if c == '\n' {
+			sc.line++
+		}
+		if c == '$' && buf.Len()-bodyStart >= len(delimiter) && bytes.HasSuffix(buf.Bytes(), delimiter) {
+			return nil
+		}
+	}
+}
+
+func (sc *StatementScanner) unterminated(err error, what string) error {
+	if err == io.EOF {
+		err = fmt.Errorf("unterminated %s at end of input (line %d)", what, sc.line)
+	}
+	sc.err = err
+	return err
+}
+
+// parseHeader records the object announced by a pg_dump TOC comment such as
+// "-- Name: customers; Type: TABLE; Schema: public; Owner: -"
+func (sc *StatementScanner) parseHeader(comment string) {
+	comment = strings.TrimSpace(strings.TrimPrefix(comment, "-"))
+	if !strings.HasPrefix(comment, "Name: ") {
+		return
+	}
+
+	var info ObjectInfo
+	for _, field := range strings.Split(comment, "; ") {
+		key, value, found := strings.Cut(field, ": ")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Name":
+			info.Name = value
+		case "Type":
+			info.Type = value
+		case "Schema":
+			info.Schema = value
+		}
+	}
+	sc.header = info
+}
+
+func lastByte(buf *bytes.Buffer) byte {
+	if buf.Len() == 0 {
+		return 0
+	}
+	return buf.Bytes()[buf.Len()-1]
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,110 @@
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatementScanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []Statement
+		wantErr bool
+	}{
+		{
+			name:  "simple statements",
+			input: "CREATE TABLE a (id int);\n\nCREATE TABLE b (id int);\n",
+			want: []Statement{
+				{SQL: "CREATE TABLE a (id int);", Line: 1},
+				{SQL: "CREATE TABLE b (id int);", Line: 3},
+			},
+		},
+		{
+			name:  "semicolons in strings and identifiers",
+			input: "INSERT INTO \"a;b\" VALUES ('x;y', 'it''s;');\nSELECT E'it\\'s; here';\n",
+			want: []Statement{
+				{SQL: "INSERT INTO \"a;b\" VALUES ('x;y', 'it''s;');", Line: 1},
+				{SQL: "SELECT E'it\\'s; here';", Line: 2},
+			},
+		},
+		{
+			name: "dollar-quoted bodies",
+			input: "CREATE FUNCTION f() RETURNS int AS $$\nBEGIN\n  RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;\n" +
+				"CREATE FUNCTION g() RETURNS text AS $body$ SELECT '$$;' $body$ LANGUAGE sql;\n",
+			want: []Statement{
+				{SQL: "CREATE FUNCTION f() RETURNS int AS $$\nBEGIN\n  RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;", Line: 1},
+				{SQL: "CREATE FUNCTION g() RETURNS text AS $body$ SELECT '$$;' $body$ LANGUAGE sql;", Line: 6},
+			},
+		},
+		{
+			name:  "positional parameters are not dollar quotes",
+			input: "PREPARE p AS SELECT $1;\nSELECT 2;\n",
+			want: []Statement{
+				{SQL: "PREPARE p AS SELECT $1;", Line: 1},
+				{SQL: "SELECT 2;", Line: 2},
+			},
+		},
+		{
+			name:  "comments",
+			input: "-- leading; comment\n/* block; /* nested; */ still */\nSELECT 1 -- trailing;\n+ 1;\nSELECT /* ; */ 2;\n",
+			want: []Statement{
+				{SQL: "SELECT 1 -- trailing;\n+ 1;", Line: 3},
+				{SQL: "SELECT /* ; */ 2;", Line: 5},
+			},
+		},
+		{
+			name:  "meta-commands",
+			input: "\\connect mydb\nSET search_path = '';\n",
+			want: []Statement{
+				{SQL: "\\connect mydb", Line: 1, Meta: true},
+				{SQL: "SET search_path = '';", Line: 2},
+			},
+		},
+		{
+			name: "pg_dump headers",
+			input: "--\n-- Name: customers; Type: TABLE; Schema: public; Owner: -\n--\n\nCREATE TABLE public.customers (id int);\n" +
+				"--\n-- Name: customers_pkey; Type: CONSTRAINT; Schema: public; Owner: -\n--\n\nALTER TABLE public.customers ADD PRIMARY KEY (id);\n",
+			want: []Statement{
+				{SQL: "CREATE TABLE public.customers (id int);", Line: 5, Object: ObjectInfo{Name: "customers", Type: "TABLE", Schema: "public"}},
+				{SQL: "ALTER TABLE public.customers ADD PRIMARY KEY (id);", Line: 10, Object: ObjectInfo{Name: "customers_pkey", Type: "CONSTRAINT", Schema: "public"}},
+			},
+		},
+		{
+			name:  "trailing statement without semicolon",
+			input: "SELECT 1;\nSELECT 2",
+			want: []Statement{
+				{SQL: "SELECT 1;", Line: 1},
+				{SQL: "SELECT 2", Line: 2},
+			},
+		},
+		{
+			name:    "unterminated string",
+			input:   "SELECT 1;\nSELECT 'abc;\n",
+			want:    []Statement{{SQL: "SELECT 1;", Line: 1}},
+			wantErr: true,
+		},
+		{
+			name:    "unterminated dollar quote",
+			input:   "DO $$ BEGIN NULL; END;\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := NewStatementScanner(strings.NewReader(tt.input))
+			var got []Statement
+			for scanner.Scan() {
+				got = append(got, scanner.Statement())
+			}
+			if err := scanner.Err(); (err != nil) != tt.wantErr {
+				t.Fatalf("Err() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statements = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
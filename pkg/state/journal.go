@@ -0,0 +1,264 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"pg-migration/pkg/config"
+
+	_ "github.com/lib/pq" // PostgreSQL driver
+)
+
+// Steps of a full migration recorded in the journal, in order
+const (
+	StepDDLCapture  = "ddl-capture"
+	StepSchema      = "schema"
+	StepReplication = "replication"
+	StepInitialSync = "initial-sync"
+)
+
+// stateTable mirrors the journal on the target. It lives in the tooling
+// schema, which a schema restore drops; it is written again with the next
+// completed step.
+const stateTable = `
+CREATE SCHEMA IF NOT EXISTS aiven_db_migrate;
+CREATE TABLE IF NOT EXISTS aiven_db_migrate.migration_state (
+    migration_id text PRIMARY KEY,
+    state jsonb NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+`
+
+// StepRecord is a completed step
+type StepRecord struct {
+	Step        string    `json:"step"`
+	CompletedAt time.Time `json:"completed_at"`
+	LSN         string    `json:"lsn,omitempty"`    // Source WAL position when the step completed
+	Detail      string    `json:"detail,omitempty"` // Step-specific, e.g. the target schema fingerprint
+}
+
+// Journal records the progress of a migration so that an interrupted run
+// can resume after its last completed step
+type Journal struct {
+	MigrationID  string       `json:"migration_id"`
+	Source       string       `json:"source"` // host:port/database
+	Target       string       `json:"target"`
+	Backend      string       `json:"backend,omitempty"`
+	Publication  string       `json:"publication"`
+	Subscription string       `json:"subscription"`
+	Slot         string       `json:"slot"`
+	Steps        []StepRecord `json:"steps"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+
+	path   string
+	mirror *config.DBConfig // Target to mirror the journal to, if any
+}
+
+// Endpoint identifies a database without its credentials
+func Endpoint(cfg *config.DBConfig) string {
+	return fmt.Sprintf("%s:%d/%s", cfg.Host, cfg.Port, cfg.Database)
+}
+
+// Open reads the journal from path. With mirror set, the journal is also
+// kept in a table on that target database and read from there when the
+// file does not exist. A journal that exists nowhere is returned empty.
+func Open(path string, mirror *config.DBConfig, migrationID string) (*Journal, error) {
+	j := &Journal{path: path, mirror: mirror}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, j); err != nil {
+			return nil, fmt.Errorf("failed to parse state file %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	case mirror != nil:
+		if err := j.loadFromTable(migrationID); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// loadFromTable reads the journal of a migration from the target table
+func (j *Journal) loadFromTable(migrationID string) error {
+	db, err := sql.Open("postgres", j.mirror.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer db.Close()
+
+	// The table does not exist until a journal was first mirrored
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('aiven_db_migrate.migration_state') IS NOT NULL;").Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up migration state table: %v", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	var data []byte
+	err = db.QueryRow("SELECT state FROM aiven_db_migrate.migration_state WHERE migration_id = $1;", migrationID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read migration state from target: %v", err)
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return fmt.Errorf("failed to parse migration state from target: %v", err)
+	}
+	return nil
+}
+
+// Empty reports whether no step has been recorded
+func (j *Journal) Empty() bool {
+	return len(j.Steps) == 0
+}
+
+// Step returns the record of a completed step, or nil
+func (j *Journal) Step(step string) *StepRecord {
+	for i := range j.Steps {
+		if j.Steps[i].Step == step {
+			return &j.Steps[i]
+		}
+	}
+	return nil
+}
+
+// Completed reports whether a step has been recorded
+func (j *Journal) Completed(step string) bool {
+	return j.Step(step) != nil
+}
+
+// Last returns the name of the last completed step, or "" if none
+func (j *Journal) Last() string {
+	if len(j.Steps) == 0 {
+		return ""
+	}
+	return j.Steps[len(j.Steps)-1].Step
+}
+
+// Complete records a step, replacing an earlier record of it, and saves the
+// journal
+func (j *Journal) Complete(rec StepRecord) error {
+	if rec.CompletedAt.IsZero() {
+		rec.CompletedAt = time.Now().UTC()
+	}
+	if existing := j.Step(rec.Step); existing != nil {
+		*existing = rec
+	} else {
+		j.Steps = append(j.Steps, rec)
+	}
+	return j.Save()
+}
+
+// Save writes the journal to its file, replacing it atomically, and to the
+// target table when mirrored
+func (j *Journal) Save() error {
+	j.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(j.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("failed to create state directory: %v", err)
+		}
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+
+	if j.mirror == nil {
+		return nil
+	}
+	db, err := sql.Open("postgres", j.mirror.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect to target database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(stateTable); err != nil {
+		return fmt.Errorf("failed to create migration state table on target: %v", err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO aiven_db_migrate.migration_state (migration_id, state, updated_at)
+		VALUES ($1, $2, now())
+		ON CONFLICT (migration_id) DO UPDATE SET state = EXCLUDED.state, updated_at = now();
+	`, j.MigrationID, data)
+	if err != nil {
+		return fmt.Errorf("failed to write migration state to target: %v", err)
+	}
+	return nil
+}
+
+// Reset forgets all recorded steps, removing the file and the table row
+func (j *Journal) Reset() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove state file: %v", err)
+	}
+	if j.mirror != nil {
+		db, err := sql.Open("postgres", j.mirror.ConnectionString())
+		if err != nil {
+			return fmt.Errorf("failed to connect to target database: %v", err)
+		}
+		defer db.Close()
+
+		var exists bool
+		if err := db.QueryRow("SELECT to_regclass('aiven_db_migrate.migration_state') IS NOT NULL;").Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up migration state table: %v", err)
+		}
+		if exists {
+			if _, err := db.Exec("DELETE FROM aiven_db_migrate.migration_state WHERE migration_id = $1;", j.MigrationID); err != nil {
+				return fmt.Errorf("failed to remove migration state from target: %v", err)
+			}
+		}
+	}
+
+	j.MigrationID, j.Backend = "", ""
+	j.Steps = nil
+	return nil
+}
+
+// ConfigDrift compares the recorded identity of the migration with the
+// current one and describes the differences
+func (j *Journal) ConfigDrift(current Journal) []string {
+	if j.Empty() {
+		return nil
+	}
+	var drift []string
+	for _, field := range []struct{ name, recorded, current string }{
+		{"migration ID", j.MigrationID, current.MigrationID},
+		{"source", j.Source, current.Source},
+		{"target", j.Target, current.Target},
+		{"publication", j.Publication, current.Publication},
+		{"subscription", j.Subscription, current.Subscription},
+		{"slot", j.Slot, current.Slot},
+	} {
+		if field.recorded != field.current {
+			drift = append(drift, fmt.Sprintf("%s was %q, now %q", field.name, field.recorded, field.current))
+		}
+	}
+	return drift
+}
+
+// SetIdentity records the identity of the migration in a journal without steps
+func (j *Journal) SetIdentity(current Journal) {
+	if !j.Empty() {
+		return
+	}
+	j.MigrationID = current.MigrationID
+	j.Source, j.Target = current.Source, current.Target
+	j.Publication, j.Subscription, j.Slot = current.Publication, current.Subscription, current.Slot
+}
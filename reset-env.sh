@@ -14,6 +14,9 @@ PASSWORD="postgres123"
 TEST_DB="testdb"
 AIVEN_EXTRAS_REPO="https://github.com/aiven/aiven-extras.git"
 AIVEN_EXTRAS_DIR="/tmp/aiven-extras"
+# Set WITHOUT_AIVEN_EXTRAS=1 to skip building aiven_extras and test the
+# native backend, which the postgres superuser can use
+WITHOUT_AIVEN_EXTRAS="${WITHOUT_AIVEN_EXTRAS:-0}"
 
 # Remove the containers
 docker rm -f $SOURCE_NAME $TARGET_NAME 2>/dev/null || true
@@ -69,6 +72,7 @@ docker exec -i $SOURCE_NAME psql -U postgres << EOF
 CREATE DATABASE $TEST_DB;
 EOF
 
+if [ "$WITHOUT_AIVEN_EXTRAS" != "1" ]; then
 # Clone Aiven Extras repository
 echo "Cloning Aiven Extras repository..."
 git clone $AIVEN_EXTRAS_REPO $AIVEN_EXTRAS_DIR
@@ -92,6 +96,7 @@ cd /aiven-extras
 make && make install
 psql -U postgres -d $TEST_DB -c "CREATE EXTENSION aiven_extras;"
 EOF
+fi
 
 # Create test schema and populate with sample data in the source database
 echo "Creating test schema and sample data..."
@@ -215,6 +220,10 @@ echo "Test environment has been reset and is ready for testing"
 echo "Source PostgreSQL is running on port $SOURCE_PORT"
 echo "Target PostgreSQL is running on port $TARGET_PORT"
 echo "Test database '$TEST_DB' is populated with sample data"
-echo "Aiven Extras has been installed in both source and target databases"
+if [ "$WITHOUT_AIVEN_EXTRAS" != "1" ]; then
+  echo "Aiven Extras has been installed in both source and target databases"
+else
+  echo "Aiven Extras is not installed; the native replication backend will be used"
+fi
 echo ""
 echo "You can now run your tests again."